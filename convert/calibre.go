@@ -0,0 +1,81 @@
+package convert
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/evan-buss/opds-proxy/internal/formats"
+)
+
+// CalibreConverter drives Calibre's ebook-convert to produce Output
+// from any of the input formats Calibre understands.
+type CalibreConverter struct {
+	Output        formats.Format
+	mutex         sync.Mutex
+	available     bool
+	availableOnce sync.Once
+}
+
+// calibreInputFormats are the formats we let ebook-convert handle.
+var calibreInputFormats = []formats.Format{
+	formats.EPUB,
+	formats.MOBI,
+	formats.AZW3,
+	formats.FB2,
+	formats.DOCX,
+	formats.PDF,
+}
+
+func (cc *CalibreConverter) Available() bool {
+	cc.availableOnce.Do(func() {
+		path, err := exec.LookPath("ebook-convert")
+		cc.available = err == nil && path != ""
+	})
+	return cc.available
+}
+
+func (cc *CalibreConverter) HandlesInputFormat(format formats.Format) bool {
+	if format == cc.Output {
+		return false
+	}
+	for _, f := range calibreInputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func (cc *CalibreConverter) OutputFormat() formats.Format {
+	return cc.Output
+}
+
+func (cc *CalibreConverter) Convert(log *slog.Logger, input string) (string, error) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	// ebook-convert picks the output format from the file extension
+	output := strings.TrimSuffix(input, filepath.Ext(input)) + cc.Output.Extension
+
+	cmd := exec.Command("ebook-convert", input, output)
+
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		log.Error("Error converting file",
+			slog.Any("error", err),
+			slog.String("stdout", out.String()),
+			slog.String("stderr", stderr.String()),
+		)
+		return "", fmt.Errorf("ebook-convert conversion to %s failed for %q: %w", cc.Output.Label, input, err)
+	}
+
+	return output, nil
+}
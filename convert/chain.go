@@ -0,0 +1,68 @@
+package convert
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/evan-buss/opds-proxy/internal/formats"
+)
+
+// Chain is a sequence of converters where each one consumes the
+// output of the previous one.
+type Chain struct {
+	Input      formats.Format
+	Converters []Converter
+}
+
+// Output returns the format produced by the last converter in the chain.
+func (c *Chain) Output() formats.Format {
+	if len(c.Converters) == 0 {
+		return c.Input
+	}
+	return c.Converters[len(c.Converters)-1].OutputFormat()
+}
+
+// Formats returns every format the file passes through, starting with the input.
+func (c *Chain) Formats() []formats.Format {
+	result := []formats.Format{c.Input}
+	for _, converter := range c.Converters {
+		result = append(result, converter.OutputFormat())
+	}
+	return result
+}
+
+// String describes the chain, e.g. "MOBI → EPUB → KEPUB".
+// Steps that keep the format are shown by name, e.g. "EPUB (downscale) → KEPUB".
+func (c *Chain) String() string {
+	labels := []string{c.Input.Label}
+	for _, converter := range c.Converters {
+		output := converter.OutputFormat()
+		if converter.HandlesInputFormat(output) {
+			if name, ok := converter.(fmt.Stringer); ok {
+				labels[len(labels)-1] += " (" + name.String() + ")"
+			}
+			continue
+		}
+		labels = append(labels, output.Label)
+	}
+	return strings.Join(labels, " → ")
+}
+
+// Convert runs the input file through every converter in order and returns
+// the path of the final output. Intermediate files are removed along the way.
+func (c *Chain) Convert(log *slog.Logger, input string) (string, error) {
+	current := input
+	for i, converter := range c.Converters {
+		output, err := converter.Convert(log, current)
+		if i > 0 {
+			os.Remove(current)
+		}
+		if err != nil {
+			return "", err
+		}
+		current = output
+	}
+	return current, nil
+}
@@ -12,6 +12,8 @@ type Converter interface {
 	Available() bool
 	// Determine if the convert handles the input format
 	HandlesInputFormat(format formats.Format) bool
+	// The format produced by the converter
+	OutputFormat() formats.Format
 	// Convert the input file to the output file
 	Convert(log *slog.Logger, input string) (string, error)
 }
@@ -0,0 +1,116 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evan-buss/opds-proxy/internal/formats"
+)
+
+const defaultExecTimeout = 5 * time.Minute
+
+// ExecConverter runs an external command to convert Input into Output.
+// The {input} and {output} placeholders in Command are replaced with the
+// file paths. When Input and Output are the same format the converter acts
+// as a filter that is applied whenever a chain passes through that format.
+type ExecConverter struct {
+	Name          string
+	Command       []string
+	Input         formats.Format
+	Output        formats.Format
+	Timeout       time.Duration
+	available     bool
+	availableOnce sync.Once
+}
+
+func (ec *ExecConverter) Available() bool {
+	ec.availableOnce.Do(func() {
+		if len(ec.Command) == 0 {
+			return
+		}
+		path, err := exec.LookPath(ec.Command[0])
+		ec.available = err == nil && path != ""
+	})
+	return ec.available
+}
+
+func (ec *ExecConverter) HandlesInputFormat(format formats.Format) bool {
+	return format == ec.Input
+}
+
+func (ec *ExecConverter) OutputFormat() formats.Format {
+	return ec.Output
+}
+
+func (ec *ExecConverter) String() string {
+	return ec.Name
+}
+
+func (ec *ExecConverter) Convert(log *slog.Logger, input string) (string, error) {
+	// Write into a fresh directory so the output keeps the book's file name
+	// even when the format doesn't change
+	outDir, err := os.MkdirTemp(filepath.Dir(input), "exec-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create output directory for %q: %w", ec.Name, err)
+	}
+	base := filepath.Base(input)
+	if strings.HasSuffix(base, ec.Input.Extension) {
+		base = strings.TrimSuffix(base, ec.Input.Extension)
+	} else {
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	output := filepath.Join(outDir, base+ec.Output.Extension)
+
+	timeout := ec.Timeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	repl := strings.NewReplacer("{input}", input, "{output}", output)
+	args := make([]string, len(ec.Command))
+	for i, arg := range ec.Command {
+		args[i] = repl.Replace(arg)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+
+	log = log.With(slog.String("command", ec.Name))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+		log.Error("Error converting file",
+			slog.Any("error", err),
+			slog.String("stdout", out.String()),
+			slog.String("stderr", stderr.String()),
+		)
+		return "", fmt.Errorf("%s conversion failed for %q: %w", ec.Name, input, err)
+	}
+
+	log.Debug("Converted file",
+		slog.String("stdout", out.String()),
+		slog.String("stderr", stderr.String()),
+	)
+
+	if _, err := os.Stat(output); err != nil {
+		return "", fmt.Errorf("%s did not produce %q: %w", ec.Name, output, err)
+	}
+
+	return output, nil
+}
@@ -0,0 +1,61 @@
+package convert
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evan-buss/opds-proxy/internal/formats"
+)
+
+func TestExecConverter(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "book.epub")
+	if err := os.WriteFile(input, []byte("epub"), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+
+	ec := &ExecConverter{
+		Name:    "copy",
+		Command: []string{"cp", "{input}", "{output}"},
+		Input:   formats.EPUB,
+		Output:  formats.EPUB,
+	}
+	if !ec.Available() {
+		t.Skip("cp not available")
+	}
+
+	output, err := ec.Convert(slog.Default(), input)
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	if filepath.Base(output) != "book.epub" || output == input {
+		t.Fatalf("unexpected output path %q", output)
+	}
+	if b, _ := os.ReadFile(output); string(b) != "epub" {
+		t.Fatalf("unexpected output content %q", b)
+	}
+}
+
+func TestExecConverterTimeout(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "book.epub")
+	os.WriteFile(input, []byte("epub"), 0644)
+
+	ec := &ExecConverter{
+		Name:    "slow",
+		Command: []string{"sleep", "5"},
+		Input:   formats.EPUB,
+		Output:  formats.KEPUB,
+		Timeout: 50 * time.Millisecond,
+	}
+	if !ec.Available() {
+		t.Skip("sleep not available")
+	}
+
+	_, err := ec.Convert(slog.Default(), input)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
@@ -3,41 +3,33 @@ package convert
 import (
 	"fmt"
 	"log/slog"
-	"os/exec"
 	"strings"
-	"sync"
 
 	"github.com/evan-buss/opds-proxy/internal/formats"
+	"github.com/evan-buss/opds-proxy/internal/kepub"
 )
 
-type KepubConverter struct {
-	mutex         sync.Mutex
-	available     bool
-	availableOnce sync.Once
-}
+// KepubConverter converts EPUBs to Kobo's KEPUB format in-process.
+type KepubConverter struct{}
 
+// Available is always true since no external tool is required
 func (kc *KepubConverter) Available() bool {
-	kc.availableOnce.Do(func() {
-		path, err := exec.LookPath("kepubify")
-		kc.available = err == nil && path != ""
-	})
-
-	return kc.available
+	return true
 }
 
 func (kc *KepubConverter) HandlesInputFormat(format formats.Format) bool {
 	return format == formats.EPUB
 }
 
-func (kc *KepubConverter) Convert(_ *slog.Logger, input string) (string, error) {
-	kc.mutex.Lock()
-	defer kc.mutex.Unlock()
+func (kc *KepubConverter) OutputFormat() formats.Format {
+	return formats.KEPUB
+}
 
-	kepubFile := strings.Replace(input, formats.EPUB.Extension, formats.KEPUB.Extension, 1)
+func (kc *KepubConverter) Convert(_ *slog.Logger, input string) (string, error) {
+	kepubFile := strings.TrimSuffix(input, formats.EPUB.Extension) + formats.KEPUB.Extension
 
-	cmd := exec.Command("kepubify", "-v", "-u", "-o", kepubFile, input)
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("kepubify conversion failed for %q: %w", input, err)
+	if err := kepub.ConvertFile(input, kepubFile); err != nil {
+		return "", fmt.Errorf("kepub conversion failed for %q: %w", input, err)
 	}
 
 	return kepubFile, nil
@@ -1,30 +1,148 @@
 package convert
 
 import (
+	"slices"
+
 	"github.com/evan-buss/opds-proxy/internal/device"
 	"github.com/evan-buss/opds-proxy/internal/formats"
 )
 
+// ConverterManager is a registry of converters. Converters are combined
+// into chains to reach a device's preferred format from whatever format
+// the catalog offers, e.g. MOBI -> EPUB -> KEPUB.
 type ConverterManager struct {
-	converters map[device.DeviceType]Converter
+	// Registered converters in order of precedence
+	converters []registration
+}
+
+type registration struct {
+	converter Converter
+	// Devices the converter applies to, empty for all devices
+	devices []device.DeviceType
+}
+
+func (r registration) appliesTo(deviceType device.DeviceType) bool {
+	return len(r.devices) == 0 || slices.Contains(r.devices, deviceType)
+}
+
+// isFilter reports whether the converter keeps the format, such as a script
+// that downscales the images in an EPUB.
+func (r registration) isFilter() bool {
+	return r.converter.HandlesInputFormat(r.converter.OutputFormat())
 }
 
+// fixedLayoutFormats are read natively by e-readers and lose their layout
+// when reflowed, so they're only converted when a format is asked for.
+var fixedLayoutFormats = []formats.Format{formats.PDF}
+
 func NewConverterManager() *ConverterManager {
 	return &ConverterManager{
-		converters: map[device.DeviceType]Converter{
-			device.DeviceKindle: &MobiConverter{},
-			device.DeviceKobo:   &KepubConverter{},
+		converters: []registration{
+			{converter: &KepubConverter{}},
+			{converter: &MobiConverter{}},
+			{converter: &CalibreConverter{Output: formats.EPUB}},
+			{converter: &CalibreConverter{Output: formats.AZW3}},
 		},
 	}
 }
 
-func (cm *ConverterManager) GetConverterForDevice(deviceType device.DeviceType, format formats.Format) Converter {
-	if converter, exists := cm.converters[deviceType]; exists && converter.Available() && converter.HandlesInputFormat(format) {
-		return converter
+// GetChainForDevice returns the chain that converts the input format into
+// the most preferred format the device supports. Fixed layout formats keep
+// their format. It returns nil when the file should be served as is.
+func (cm *ConverterManager) GetChainForDevice(deviceType device.DeviceType, input formats.Format) *Chain {
+	if slices.Contains(fixedLayoutFormats, input) {
+		return cm.withFilters(deviceType, &Chain{Input: input})
+	}
+	for _, target := range deviceType.ConversionTargets() {
+		if input == target {
+			break
+		}
+		if chain := cm.FindChain(deviceType, input, target); chain != nil {
+			return chain
+		}
+	}
+	return cm.withFilters(deviceType, &Chain{Input: input})
+}
+
+// FindChain returns the shortest chain of available converters for the
+// device from input to output, or nil if output can't be reached.
+func (cm *ConverterManager) FindChain(deviceType device.DeviceType, input, output formats.Format) *Chain {
+	if input == output {
+		return nil
+	}
+
+	// Breadth first search over formats so the shortest chain wins.
+	// Ties are broken by converter precedence.
+	type step struct {
+		from      formats.Format
+		converter Converter
+	}
+	steps := map[formats.Format]step{}
+	visited := map[formats.Format]bool{input: true}
+	queue := []formats.Format{input}
+
+	for len(queue) > 0 && !visited[output] {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, r := range cm.converters {
+			next := r.converter.OutputFormat()
+			if visited[next] || !r.appliesTo(deviceType) || !r.converter.HandlesInputFormat(current) || !r.converter.Available() {
+				continue
+			}
+			visited[next] = true
+			steps[next] = step{from: current, converter: r.converter}
+			queue = append(queue, next)
+		}
+	}
+
+	if !visited[output] {
+		return nil
+	}
+
+	var converters []Converter
+	for f := output; f != input; f = steps[f].from {
+		converters = append([]Converter{steps[f].converter}, converters...)
+	}
+
+	return cm.withFilters(deviceType, &Chain{Input: input, Converters: converters})
+}
+
+// Targets returns every format the input can be converted to for the device.
+func (cm *ConverterManager) Targets(deviceType device.DeviceType, input formats.Format) []formats.Format {
+	var targets []formats.Format
+	for _, f := range formats.AllFormats() {
+		if cm.FindChain(deviceType, input, f) != nil {
+			targets = append(targets, f)
+		}
+	}
+	return targets
+}
+
+// withFilters inserts the device's filters after every format the chain
+// passes through. It returns nil if the resulting chain is empty.
+func (cm *ConverterManager) withFilters(deviceType device.DeviceType, chain *Chain) *Chain {
+	var converters []Converter
+	for i, f := range chain.Formats() {
+		if i > 0 {
+			converters = append(converters, chain.Converters[i-1])
+		}
+		for _, r := range cm.converters {
+			if r.isFilter() && r.appliesTo(deviceType) && r.converter.HandlesInputFormat(f) && r.converter.Available() {
+				converters = append(converters, r.converter)
+			}
+		}
+	}
+
+	if len(converters) == 0 {
+		return nil
 	}
-	return nil
+	return &Chain{Input: chain.Input, Converters: converters}
 }
 
-func (cm *ConverterManager) RegisterConverter(deviceType device.DeviceType, converter Converter) {
-	cm.converters[deviceType] = converter
+// RegisterConverter adds a converter to the registry, optionally limited to
+// the given devices. It takes precedence over the converters registered before it.
+func (cm *ConverterManager) RegisterConverter(converter Converter, devices ...device.DeviceType) {
+	r := registration{converter: converter, devices: devices}
+	cm.converters = append([]registration{r}, cm.converters...)
 }
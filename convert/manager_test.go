@@ -0,0 +1,133 @@
+package convert
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/evan-buss/opds-proxy/internal/device"
+	"github.com/evan-buss/opds-proxy/internal/formats"
+)
+
+type fakeConverter struct {
+	from      formats.Format
+	to        formats.Format
+	available bool
+}
+
+func (f *fakeConverter) Available() bool                               { return f.available }
+func (f *fakeConverter) HandlesInputFormat(format formats.Format) bool { return format == f.from }
+func (f *fakeConverter) OutputFormat() formats.Format                  { return f.to }
+func (f *fakeConverter) Convert(_ *slog.Logger, input string) (string, error) {
+	return input + f.to.Extension, nil
+}
+
+func newTestManager(converters ...Converter) *ConverterManager {
+	cm := &ConverterManager{}
+	for _, c := range converters {
+		cm.converters = append(cm.converters, registration{converter: c})
+	}
+	return cm
+}
+
+func TestFindChain(t *testing.T) {
+	cm := newTestManager(
+		&fakeConverter{from: formats.EPUB, to: formats.KEPUB, available: true},
+		&fakeConverter{from: formats.MOBI, to: formats.EPUB, available: true},
+		&fakeConverter{from: formats.PDF, to: formats.EPUB, available: true},
+		&fakeConverter{from: formats.EPUB, to: formats.AZW3, available: true},
+	)
+
+	chain := cm.FindChain(device.DeviceOther, formats.MOBI, formats.KEPUB)
+	if chain == nil {
+		t.Fatalf("expected MOBI to reach KEPUB")
+	}
+	if got := chain.String(); got != "MOBI → EPUB → KEPUB" {
+		t.Fatalf("unexpected chain %q", got)
+	}
+
+	if chain := cm.FindChain(device.DeviceOther, formats.PDF, formats.AZW3); chain == nil || chain.String() != "PDF → EPUB → AZW3" {
+		t.Fatalf("unexpected chain %v", chain)
+	}
+
+	if chain := cm.FindChain(device.DeviceOther, formats.KEPUB, formats.MOBI); chain != nil {
+		t.Fatalf("expected no chain, got %q", chain)
+	}
+
+	out, err := cm.FindChain(device.DeviceOther, formats.MOBI, formats.KEPUB).Convert(slog.Default(), "book")
+	if err != nil || out != "book.epub.kepub.epub" {
+		t.Fatalf("Convert = %q, %v", out, err)
+	}
+}
+
+func TestFindChainSkipsUnavailable(t *testing.T) {
+	cm := newTestManager(
+		&fakeConverter{from: formats.EPUB, to: formats.AZW3, available: false},
+		&fakeConverter{from: formats.EPUB, to: formats.MOBI, available: true},
+	)
+
+	if chain := cm.FindChain(device.DeviceOther, formats.EPUB, formats.AZW3); chain != nil {
+		t.Fatalf("expected unavailable converter to be skipped")
+	}
+	if chain := cm.FindChain(device.DeviceOther, formats.EPUB, formats.MOBI); chain == nil {
+		t.Fatalf("expected EPUB to reach MOBI")
+	}
+}
+
+func TestGetChainForDevice(t *testing.T) {
+	cm := newTestManager(
+		&fakeConverter{from: formats.EPUB, to: formats.MOBI, available: true},
+	)
+
+	// AZW3 is unreachable so the Kindle falls back to MOBI
+	chain := cm.GetChainForDevice(device.DeviceKindle, formats.EPUB)
+	if chain == nil || chain.Output() != formats.MOBI {
+		t.Fatalf("expected Kindle to fall back to MOBI, got %v", chain)
+	}
+
+	// Files already in a preferred format are left alone
+	if chain := cm.GetChainForDevice(device.DeviceKindle, formats.MOBI); chain != nil {
+		t.Fatalf("expected no conversion, got %q", chain)
+	}
+
+	// Other devices always get the original file
+	if chain := cm.GetChainForDevice(device.DeviceOther, formats.EPUB); chain != nil {
+		t.Fatalf("expected no conversion, got %q", chain)
+	}
+
+	// PDFs are read natively and only converted on request
+	cm.RegisterConverter(&fakeConverter{from: formats.PDF, to: formats.EPUB, available: true})
+	if chain := cm.GetChainForDevice(device.DeviceKindle, formats.PDF); chain != nil {
+		t.Fatalf("expected PDF to be served as is, got %q", chain)
+	}
+	if chain := cm.FindChain(device.DeviceKindle, formats.PDF, formats.MOBI); chain == nil {
+		t.Fatalf("expected PDF to still be convertible on request")
+	}
+
+	cm.RegisterConverter(&fakeConverter{from: formats.EPUB, to: formats.AZW3, available: true})
+	if chain := cm.GetChainForDevice(device.DeviceKindle, formats.EPUB); chain == nil || chain.Output() != formats.AZW3 {
+		t.Fatalf("expected registered converter to be used, got %v", chain)
+	}
+}
+
+func TestFiltersAndDeviceRestrictions(t *testing.T) {
+	cm := newTestManager(
+		&fakeConverter{from: formats.EPUB, to: formats.KEPUB, available: true},
+	)
+	cm.RegisterConverter(&ExecConverter{Name: "downscale", Command: []string{"true"}, Input: formats.EPUB, Output: formats.EPUB}, device.DeviceKobo)
+	cm.RegisterConverter(&fakeConverter{from: formats.MOBI, to: formats.EPUB, available: true}, device.DeviceKindle)
+
+	chain := cm.GetChainForDevice(device.DeviceKobo, formats.EPUB)
+	if chain == nil || chain.String() != "EPUB (downscale) → KEPUB" {
+		t.Fatalf("unexpected chain %v", chain)
+	}
+
+	// The MOBI converter is limited to Kindles
+	if chain := cm.FindChain(device.DeviceKobo, formats.MOBI, formats.KEPUB); chain != nil {
+		t.Fatalf("expected no chain for Kobo, got %q", chain)
+	}
+
+	// Filters don't apply to other devices
+	if chain := cm.GetChainForDevice(device.DeviceOther, formats.EPUB); chain != nil {
+		t.Fatalf("expected no conversion, got %q", chain)
+	}
+}
@@ -30,6 +30,10 @@ func (mc *MobiConverter) HandlesInputFormat(format formats.Format) bool {
 	return format == formats.EPUB
 }
 
+func (mc *MobiConverter) OutputFormat() formats.Format {
+	return formats.MOBI
+}
+
 func (mc *MobiConverter) Convert(log *slog.Logger, input string) (string, error) {
 	mc.mutex.Lock()
 	defer mc.mutex.Unlock()
@@ -13,6 +13,7 @@ require (
 require (
 	github.com/gorilla/securecookie v1.1.2
 	github.com/spf13/pflag v1.0.10
+	golang.org/x/crypto v0.41.0
 	golang.org/x/text v0.34.0
 )
 
@@ -34,6 +35,5 @@ require (
 	github.com/mitchellh/copystructure v1.2.0 // indirect
 	github.com/mitchellh/reflectwalk v1.0.2 // indirect
 	github.com/tidwall/sjson v1.2.5
-	golang.org/x/sync v0.19.0
 	golang.org/x/sys v0.35.0 // indirect
 )
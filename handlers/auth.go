@@ -7,20 +7,40 @@ import (
 	"net/url"
 
 	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/linktoken"
 	"github.com/evan-buss/opds-proxy/view"
 	"github.com/gorilla/securecookie"
 )
 
-func Auth(s *securecookie.SecureCookie) http.HandlerFunc {
+func Auth(s *securecookie.SecureCookie, links *linktoken.Store, feeds []auth.FeedConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		returnUrl := r.URL.Query().Get("return")
-		if returnUrl == "" {
+		if r.URL.Query().Get("return") == "" {
 			http.Error(w, "No return URL specified", http.StatusBadRequest)
 			return
 		}
+		// The link has to resolve as well, but that doesn't stop it being
+		// smuggled onto another site
+		returnUrl := localReturnURL(r.URL.Query().Get("return"))
+
+		rUrl, err := url.Parse(returnUrl)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid return URL %q: %v", returnUrl, err), http.StatusBadRequest)
+			return
+		}
+		site, ok := links.Resolve(rUrl.Query().Get("q"))
+		if !ok {
+			http.Error(w, "Unknown or invalid link", http.StatusNotFound)
+			return
+		}
+		domain, err := url.Parse(site)
+		if err != nil {
+			http.Error(w, "Invalid site URL", http.StatusBadRequest)
+			return
+		}
 
 		if r.Method == "GET" {
-			view.Render(w, func(buf io.Writer) error { return view.Login(buf, view.LoginParams{ReturnURL: returnUrl}) })
+			params := view.LoginParams{ReturnURL: returnUrl, Host: feedName(domain, feeds), Prompt: "Log in to access this feed."}
+			view.Render(w, func(buf io.Writer) error { return view.Login(buf, params) })
 			return
 		}
 
@@ -28,37 +48,13 @@ func Auth(s *securecookie.SecureCookie) http.HandlerFunc {
 			username := r.FormValue("username")
 			password := r.FormValue("password")
 
-			rUrl, err := url.Parse(returnUrl)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Invalid return URL %q: %v", returnUrl, err), http.StatusBadRequest)
-				return
-			}
-			site := rUrl.Query().Get("q")
-			domain, err := url.Parse(site)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Invalid site URL %q: %v", site, err), http.StatusBadRequest)
-				return
-			}
-
-			value := map[string]auth.Credentials{
-				domain.Hostname(): {Username: username, Password: password},
-			}
-
-			encoded, err := s.Encode(auth.CookieName, value)
-			if err != nil {
+			// Logins for other feeds are kept, only this origin's credentials are replaced
+			creds := auth.Credentials{Username: username, Password: password}
+			if err := auth.AddCredentials(w, r, s, auth.Origin(domain), creds); err != nil {
 				http.Error(w, fmt.Sprintf("Failed to encode credentials: %v", err), http.StatusInternalServerError)
 				return
 			}
-			cookie := &http.Cookie{
-				Name:  auth.CookieName,
-				Value: encoded,
-				Path:  "/",
-				// Kobo fails to set cookies with HttpOnly or Secure flags
-				Secure:   false,
-				HttpOnly: false,
-			}
 
-			http.SetCookie(w, cookie)
 			http.Redirect(w, r, returnUrl, http.StatusFound)
 			return
 		}
@@ -66,3 +62,14 @@ func Auth(s *securecookie.SecureCookie) http.HandlerFunc {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+// feedName returns the name of the configured feed on the site's origin,
+// falling back to the host itself.
+func feedName(site *url.URL, feeds []auth.FeedConfig) string {
+	for _, feed := range feeds {
+		if feedUrl, err := url.Parse(feed.Url); err == nil && auth.Origin(feedUrl) == auth.Origin(site) {
+			return feed.Name
+		}
+	}
+	return site.Hostname()
+}
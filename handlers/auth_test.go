@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/evan-buss/opds-proxy/internal/linktoken"
+	"github.com/gorilla/securecookie"
+)
+
+func TestAuthOnlyRedirectsToProxyPaths(t *testing.T) {
+	links, err := linktoken.New([]byte("secret"), "", 0, nil)
+	if err != nil {
+		t.Fatalf("linktoken.New error: %v", err)
+	}
+	s := securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	handler := Auth(s, links, nil)
+	token := links.Encode("http://calibre:8083/opds")
+
+	tests := []struct {
+		name       string
+		returnUrl  string
+		wantStatus int
+	}{
+		{"local", "/feed?q=" + token, http.StatusFound},
+		{"other site", "https://evil.example/feed?q=" + token, http.StatusNotFound},
+		{"protocol relative", "//evil.example/feed?q=" + token, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"username": {"user"}, "password": {"pass"}}
+			req := httptest.NewRequest("POST", "/auth?return="+url.QueryEscape(tt.returnUrl), strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if location := rec.Header().Get("Location"); tt.wantStatus == http.StatusFound && location != tt.returnUrl {
+				t.Errorf("Location = %q, want %q", location, tt.returnUrl)
+			}
+		})
+	}
+}
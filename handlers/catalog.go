@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/evan-buss/opds-proxy/convert"
+	"github.com/evan-buss/opds-proxy/internal/allowlist"
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/device"
+	"github.com/evan-buss/opds-proxy/internal/feedcache"
+	"github.com/evan-buss/opds-proxy/internal/filecache"
+	"github.com/evan-buss/opds-proxy/internal/formats"
+	"github.com/evan-buss/opds-proxy/internal/httpx"
+	"github.com/evan-buss/opds-proxy/internal/jobs"
+	"github.com/evan-buss/opds-proxy/internal/linktoken"
+	"github.com/evan-buss/opds-proxy/internal/reqctx"
+	"github.com/evan-buss/opds-proxy/opds"
+	"github.com/evan-buss/opds-proxy/view"
+	"github.com/gorilla/securecookie"
+)
+
+const catalogPath = "/opds"
+
+// KEPUBs are served as EPUBs, but catalog links need a type of their own so
+// reading apps can tell them apart from the original EPUB
+const kepubMimeType = "application/kepub+zip"
+
+// Catalog returns a handler that re-serves upstream feeds as OPDS for
+// reading apps. Every link points back through the proxy and acquisition
+// links are added for each format the converters can produce. Conversions
+// are waited on so clients receive the book directly.
+func Catalog(outputDir string, feeds []auth.FeedConfig, s *securecookie.SecureCookie, debug bool, converters *convert.ConverterManager, cache *filecache.Cache, jobs *jobs.Manager, allowlist *allowlist.Allowlist, links *linktoken.Store, users *auth.Users, feedCache *feedcache.Cache, searches *opds.SearchDescriptions) http.HandlerFunc {
+	h := &FeedHandler{
+		outputDir:  outputDir,
+		feeds:      feeds,
+		s:          s,
+		debug:      debug,
+		converters: converters,
+		cache:      cache,
+		jobs:       jobs,
+		allowlist:  allowlist,
+		links:      links,
+		users:      users,
+		feedCache:  feedCache,
+		searches:   searches,
+		catalog:    true,
+	}
+	return h.ServeHTTP
+}
+
+// serveCatalogRoot serves a navigation feed listing the feeds the user has
+// access to.
+func (h *FeedHandler) serveCatalogRoot(w http.ResponseWriter, r *http.Request) error {
+	now := opds.Time{Time: time.Now()}
+	feed := &opds.Feed{
+		ID:      "urn:opds-proxy:root",
+		Title:   "OPDS Proxy",
+		Updated: now,
+		Links: []opds.Link{
+			{Rel: "self", Href: catalogPath, TypeLink: opds.NavigationFeedContentType},
+			{Rel: "start", Href: catalogPath, TypeLink: opds.NavigationFeedContentType},
+		},
+	}
+	for _, f := range h.feeds {
+		if !h.users.CanAccess(reqctx.User(r.Context()), f.Name) {
+			continue
+		}
+		feed.Entries = append(feed.Entries, opds.Entry{
+			Title:   f.Name,
+			ID:      "urn:opds-proxy:feed:" + url.PathEscape(f.Name),
+			Updated: &now,
+			Links: []opds.Link{{
+				Rel:      "subsection",
+				Href:     catalogPath + "?" + url.Values{"q": {h.links.Encode(f.Url)}}.Encode(),
+				TypeLink: opds.NavigationFeedContentType,
+			}},
+		})
+	}
+
+	w.Header().Set("Content-Type", opds.NavigationFeedContentType)
+	return opds.WriteFeed(w, feed)
+}
+
+func (h *FeedHandler) serveCatalog(w http.ResponseWriter, feed *opds.Feed, feedURL string, deviceType device.DeviceType) error {
+	out := *feed
+
+	links, err := h.catalogLinks(feedURL, feed.Links)
+	if err != nil {
+		return err
+	}
+	out.Links = links
+
+	out.Entries = make([]opds.Entry, 0, len(feed.Entries))
+	for _, entry := range feed.Entries {
+		links, err := h.entryCatalogLinks(feedURL, entry.Links, deviceType)
+		if err != nil {
+			return err
+		}
+		entry.Links = links
+		out.Entries = append(out.Entries, entry)
+	}
+
+	w.Header().Set("Content-Type", feed.ContentType())
+	return opds.WriteFeed(w, &out)
+}
+
+// entryCatalogLinks rewrites an entry's links and adds an acquisition link
+// for every format its downloads can be converted to that isn't already offered.
+func (h *FeedHandler) entryCatalogLinks(feedURL string, links []opds.Link, deviceType device.DeviceType) ([]opds.Link, error) {
+	offered := make(map[formats.Format]bool)
+	for _, link := range opds.Links(links).Downloads() {
+		if format, known := formats.FormatByMimeType(link.TypeLink); known {
+			offered[format] = true
+		}
+	}
+
+	var out []opds.Link
+	for _, link := range links {
+		format, known := formats.FormatByMimeType(link.TypeLink)
+		if !link.IsDownload() || !known {
+			rewritten, err := h.catalogLinks(feedURL, []opds.Link{link})
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, rewritten...)
+			continue
+		}
+
+		href, err := h.catalogHref(feedURL, link.Href, view.AsOriginal)
+		if err != nil {
+			return nil, err
+		}
+		original := link
+		original.Href = href
+		out = append(out, original)
+
+		for _, target := range h.converters.Targets(deviceType, format) {
+			if offered[target] {
+				continue
+			}
+			offered[target] = true
+
+			href, err := h.catalogHref(feedURL, link.Href, strings.ToLower(target.Label))
+			if err != nil {
+				return nil, err
+			}
+			converted := link
+			converted.Href = href
+			converted.TypeLink = catalogMimeType(target)
+			converted.Title = fmt.Sprintf("%s (converted from %s)", target.Label, format.Label)
+			out = append(out, converted)
+		}
+	}
+	return out, nil
+}
+
+// catalogMimeType returns the type of acquisition links for format.
+func catalogMimeType(format formats.Format) string {
+	if format == formats.KEPUB {
+		return kepubMimeType
+	}
+	return format.MimeType
+}
+
+// catalogLinks points links back through the proxy. Search links are
+// turned into Atom templates that the proxy resolves itself.
+func (h *FeedHandler) catalogLinks(feedURL string, links []opds.Link) ([]opds.Link, error) {
+	out := make([]opds.Link, 0, len(links))
+	for _, link := range links {
+		if link.HasRel("search") {
+			absolute, err := resolveURL(feedURL, link.Href)
+			if err != nil {
+				return nil, err
+			}
+			link.Href = catalogPath + "?q=" + h.links.Encode(absolute) + "&search={searchTerms}"
+			link.TypeLink = "application/atom+xml"
+			out = append(out, link)
+			continue
+		}
+
+		href, err := h.catalogHref(feedURL, link.Href, "")
+		if err != nil {
+			return nil, err
+		}
+		link.Href = href
+		out = append(out, link)
+	}
+	return out, nil
+}
+
+// catalogHref returns the proxy URL for href, optionally requesting a format.
+func (h *FeedHandler) catalogHref(feedURL, href, as string) (string, error) {
+	if strings.HasPrefix(href, "data:") {
+		return href, nil
+	}
+
+	absolute, err := resolveURL(feedURL, href)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{"q": {h.links.Encode(absolute)}}
+	if as != "" {
+		query.Set("as", as)
+	}
+	return catalogPath + "?" + query.Encode(), nil
+}
+
+func resolveURL(base, href string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse feed URL %q: %w", base, err)
+	}
+	hrefURL, err := url.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse link %q: %w", href, err)
+	}
+	return baseURL.ResolveReference(hrefURL).String(), nil
+}
+
+// serveJob waits for a conversion job and sends its result.
+func (h *FeedHandler) serveJob(w http.ResponseWriter, r *http.Request, log *slog.Logger, id string) error {
+	job, err := h.jobs.Wait(r.Context(), id)
+	if err != nil {
+		return fmt.Errorf("failed to wait for conversion: %w", err)
+	}
+	if job.Status == jobs.StatusFailed {
+		http.Error(w, "Conversion failed: "+job.Error, http.StatusBadGateway)
+		return nil
+	}
+
+	if err := httpx.ServeFile(w, r, job.Result, filepath.Base(job.Result)); err != nil {
+		return err
+	}
+	log.Info("Sent Converted File")
+	return nil
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/evan-buss/opds-proxy/convert"
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/device"
+	"github.com/evan-buss/opds-proxy/internal/formats"
+	"github.com/evan-buss/opds-proxy/internal/jobs"
+	"github.com/evan-buss/opds-proxy/internal/linktoken"
+	"github.com/evan-buss/opds-proxy/opds"
+)
+
+func TestEntryCatalogLinksAddsKepubToEpub(t *testing.T) {
+	links, err := linktoken.New([]byte("secret"), "", 0, nil)
+	if err != nil {
+		t.Fatalf("linktoken.New error: %v", err)
+	}
+	h := &FeedHandler{converters: convert.NewConverterManager(), links: links}
+
+	entryLinks := []opds.Link{
+		{Rel: opds.AcquisitionFeedRel, Href: "/books/1.epub", TypeLink: formats.EPUB.MimeType},
+	}
+	out, err := h.entryCatalogLinks("http://calibre:8083/opds", entryLinks, device.DeviceKobo)
+	if err != nil {
+		t.Fatalf("entryCatalogLinks error: %v", err)
+	}
+
+	types := make(map[string]int)
+	for _, link := range out {
+		types[link.TypeLink]++
+	}
+	if types[formats.EPUB.MimeType] != 1 {
+		t.Errorf("got %d EPUB links, want the original only: %+v", types[formats.EPUB.MimeType], out)
+	}
+	if types[kepubMimeType] != 1 {
+		t.Errorf("got %d KEPUB links, want 1: %+v", types[kepubMimeType], out)
+	}
+}
+
+func TestCatalogRootListsFeeds(t *testing.T) {
+	links, err := linktoken.New([]byte("secret"), "", 0, nil)
+	if err != nil {
+		t.Fatalf("linktoken.New error: %v", err)
+	}
+	users, err := auth.NewUsers(nil, nil, "")
+	if err != nil {
+		t.Fatalf("NewUsers error: %v", err)
+	}
+	h := &FeedHandler{
+		feeds:   []auth.FeedConfig{{Name: "Calibre", Url: "http://calibre:8083/opds"}},
+		links:   links,
+		users:   users,
+		catalog: true,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/opds", nil))
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != opds.NavigationFeedContentType {
+		t.Fatalf("got %d %q, want a navigation feed", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	feed, err := opds.ParseFeed(rec.Body, false)
+	if err != nil {
+		t.Fatalf("ParseFeed error: %v", err)
+	}
+	if len(feed.Entries) != 1 || feed.Entries[0].Title != "Calibre" || len(feed.Entries[0].Links) != 1 {
+		t.Fatalf("unexpected entries %+v", feed.Entries)
+	}
+	href, _ := url.Parse(feed.Entries[0].Links[0].Href)
+	if got, ok := links.Resolve(href.Query().Get("q")); !ok || got != "http://calibre:8083/opds" {
+		t.Errorf("entry links to %q, want the feed", href)
+	}
+}
+
+func TestServeJobStopsWhenClientLeaves(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	h := &FeedHandler{jobs: jobs.NewManager(1, time.Hour)}
+	job := h.jobs.Submit("", "book.epub", func() (string, error) {
+		<-release
+		return "", nil
+	}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest("GET", "/opds", nil).WithContext(ctx)
+
+	done := make(chan error, 1)
+	go func() { done <- h.serveJob(httptest.NewRecorder(), r, slog.Default(), job.ID) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected an error once the client went away")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected serveJob to stop waiting once the client went away")
+	}
+}
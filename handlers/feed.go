@@ -2,24 +2,29 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"maps"
 	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"reflect"
 	"strings"
-	"sync"
 
 	"log/slog"
 
 	"github.com/evan-buss/opds-proxy/convert"
+	"github.com/evan-buss/opds-proxy/internal/allowlist"
 	"github.com/evan-buss/opds-proxy/internal/auth"
 	"github.com/evan-buss/opds-proxy/internal/device"
+	"github.com/evan-buss/opds-proxy/internal/feedcache"
+	"github.com/evan-buss/opds-proxy/internal/filecache"
 	"github.com/evan-buss/opds-proxy/internal/formats"
 	"github.com/evan-buss/opds-proxy/internal/httpx"
+	"github.com/evan-buss/opds-proxy/internal/jobs"
+	"github.com/evan-buss/opds-proxy/internal/linktoken"
 	"github.com/evan-buss/opds-proxy/internal/reqctx"
 	"github.com/evan-buss/opds-proxy/opds"
 	"github.com/evan-buss/opds-proxy/view"
@@ -32,44 +37,126 @@ type FeedHandler struct {
 	s          *securecookie.SecureCookie
 	debug      bool
 	converters *convert.ConverterManager
-	mu         sync.Mutex
+	cache      *filecache.Cache
+	jobs       *jobs.Manager
+	allowlist  *allowlist.Allowlist
+	links      *linktoken.Store
+	users      *auth.Users
+	feedCache  *feedcache.Cache
+	searches   *opds.SearchDescriptions
+	catalog    bool
 }
 
-func Feed(outputDir string, feeds []auth.FeedConfig, s *securecookie.SecureCookie, debug bool) http.HandlerFunc {
+// Feed returns the feed handler. Conversions run as background jobs on the
+// provided manager. Converted files are stored in cache when it is non-nil
+// so repeated downloads skip the conversion. Only URLs permitted by the
+// allowlist are fetched, and links are passed around as tokens from links.
+// Logged in users can only fetch from the feeds they have access to.
+// Upstream feeds are kept in feedCache when it is non-nil, and search
+// descriptions in searches.
+func Feed(outputDir string, feeds []auth.FeedConfig, s *securecookie.SecureCookie, debug bool, converters *convert.ConverterManager, cache *filecache.Cache, jobs *jobs.Manager, allowlist *allowlist.Allowlist, links *linktoken.Store, users *auth.Users, feedCache *feedcache.Cache, searches *opds.SearchDescriptions) http.HandlerFunc {
 	h := &FeedHandler{
 		outputDir:  outputDir,
 		feeds:      feeds,
 		s:          s,
 		debug:      debug,
-		converters: convert.NewConverterManager(),
+		converters: converters,
+		cache:      cache,
+		jobs:       jobs,
+		allowlist:  allowlist,
+		links:      links,
+		users:      users,
+		feedCache:  feedCache,
+		searches:   searches,
 	}
 	return h.ServeHTTP
 }
 
 func (h *FeedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	queryURL := r.URL.Query().Get("q")
-	if queryURL == "" {
+	token := r.URL.Query().Get("q")
+	if token == "" && h.catalog {
+		// Reading apps need a start URL, so the catalog root lists the feeds
+		if err := h.serveCatalogRoot(w, r); err != nil {
+			reqctx.Logger(r.Context()).Error("Failed to render catalog", slog.Any("error", err))
+		}
+		return
+	}
+	if token == "" {
 		http.Error(w, "No feed specified", http.StatusBadRequest)
 		return
 	}
+	queryURL, ok := h.links.Resolve(token)
+	if !ok {
+		http.Error(w, "Unknown or invalid link", http.StatusNotFound)
+		return
+	}
+
+	log := reqctx.Logger(r.Context())
+
+	// Check before resolving since search descriptions are fetched from the query URL
+	if err := h.allowlist.Check(queryURL); err != nil {
+		log.Warn("Link Not Allowed", slog.Any("error", err))
+		http.Error(w, "This link is not allowed", http.StatusForbidden)
+		return
+	}
+
+	if !h.users.CanFetch(reqctx.User(r.Context()), queryURL) {
+		http.Error(w, "You don't have access to this feed", http.StatusForbidden)
+		return
+	}
 
-	resolvedURL, err := h.resolveQueryURL(queryURL, r.URL.Query().Get("search"))
+	resolvedURL, err := h.resolveQueryURL(r, queryURL)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to parse URL %q: %v", queryURL, err), http.StatusBadRequest)
+		log.Warn("Failed to resolve search", slog.Any("error", err))
+		http.Error(w, "Failed to resolve search", http.StatusBadRequest)
+		return
+	}
+	if err := h.allowlist.Check(resolvedURL); err != nil {
+		log.Warn("Link Not Allowed", slog.Any("error", err))
+		http.Error(w, "This link is not allowed", http.StatusForbidden)
+		return
+	}
+	if !h.users.CanFetch(reqctx.User(r.Context()), resolvedURL) {
+		http.Error(w, "You don't have access to this feed", http.StatusForbidden)
 		return
 	}
 
-	creds := auth.GetCredentials(resolvedURL, r, h.feeds, h.s)
-	resp, err := httpx.Fetch(resolvedURL, 10, func(req *http.Request) {
-		if creds != nil {
-			req.SetBasicAuth(creds.Username, creds.Password)
+	authorization := auth.Authorize(resolvedURL, r, h.feeds, h.users, h.s)
+	if authorization.Credentials == nil && h.catalog && !h.users.Enabled() {
+		// Catalog clients can't log in through the auth page, they send basic auth instead.
+		// With proxy accounts basic auth logs into the proxy and isn't passed on.
+		if username, password, ok := r.BasicAuth(); ok {
+			authorization.Credentials = &auth.Credentials{Username: username, Password: password}
 		}
-	})
+	}
+	client := authorization.Client(h.allowlist.Client())
+	fetch := func(forwardRange bool, header http.Header) (*http.Response, error) {
+		return httpx.Fetch(client, resolvedURL, 10, func(req *http.Request) {
+			maps.Copy(req.Header, header)
+			if forwardRange {
+				httpx.CopyRangeHeaders(req, r)
+			}
+		})
+	}
+
+	// Range requests are passed upstream so passthrough downloads can be resumed
+	cacheKey := feedcache.Key(resolvedURL, reqctx.User(r.Context()), authorization.Credentials)
+	resp, err := h.feedCache.Fetch(resolvedURL, cacheKey, func(header http.Header) (*http.Response, error) {
+		return fetch(true, header)
+	}, isFeedResponse)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to fetch %q: %v", resolvedURL, err), http.StatusBadGateway)
+		// Errors name the upstream URL, which links are meant to hide
+		log.Error("Failed to fetch", slog.String("url", resolvedURL), slog.Any("error", err))
+		http.Error(w, "Failed to fetch from upstream", http.StatusBadGateway)
+		return
+	}
+	defer func() { resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusUnauthorized && h.catalog {
+		w.Header().Set("WWW-Authenticate", `Basic realm="opds-proxy"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusUnauthorized {
 		http.Redirect(w, r, "/auth?return="+r.URL.String(), http.StatusFound)
@@ -91,8 +178,21 @@ func (h *FeedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	deviceType := device.DetectDevice(r.UserAgent())
 
-	if format == formats.ATOM {
-		if err := h.serveAtom(w, r, resp, resolvedURL, deviceType); err != nil {
+	// Conversions need the whole file, not just the requested range
+	if resp.StatusCode == http.StatusPartialContent {
+		if chain, err := h.chainFor(r.URL.Query().Get("as"), deviceType, format); err == nil && chain != nil {
+			resp.Body.Close()
+			resp, err = fetch(false, nil)
+			if err != nil {
+				log.Error("Failed to fetch", slog.String("url", resolvedURL), slog.Any("error", err))
+				http.Error(w, "Failed to fetch from upstream", http.StatusBadGateway)
+				return
+			}
+		}
+	}
+
+	if format == formats.ATOM || format == formats.OPDS2 {
+		if err := h.serveFeed(w, r, resp, resolvedURL, deviceType, format); err != nil {
 			reqctx.Logger(r.Context()).Error("Failed to render feed", slog.Any("error", err))
 		}
 		return
@@ -103,32 +203,93 @@ func (h *FeedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *FeedHandler) resolveQueryURL(queryURL, searchTerm string) (string, error) {
-	parsed, err := url.QueryUnescape(queryURL)
+// isFeedResponse reports whether resp is an OPDS feed rather than a download.
+func isFeedResponse(resp *http.Response) bool {
+	_, ok := feedFormat(resp)
+	return ok
+}
+
+// feedFormat returns the feed format of resp, if it is a feed.
+func feedFormat(resp *http.Response) (formats.Format, bool) {
+	mimeType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
 	if err != nil {
-		return queryURL, fmt.Errorf("failed to unescape query URL %q: %w", queryURL, err)
+		return formats.Format{}, false
 	}
-	queryURL = parsed
+	format, ok := formats.FormatByMimeType(mimeType)
+	return format, ok && (format == formats.ATOM || format == formats.OPDS2)
+}
 
-	if searchTerm == "" {
+// resolveQueryURL fills the search form's values into the search link
+// queryURL. Without any values the link is the feed to show.
+func (h *FeedHandler) resolveQueryURL(r *http.Request, queryURL string) (string, error) {
+	values := searchValues(r)
+	if len(values) == 0 {
 		return queryURL, nil
 	}
+	client := auth.Authorize(queryURL, r, h.feeds, h.users, h.s).Client(h.allowlist.Client())
+	tmpl, err := resolveSearchTemplate(r.Context(), h.searches, client, queryURL)
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Expand(values), nil
+}
 
-	escaped := url.QueryEscape(searchTerm)
-	repl := strings.NewReplacer("{searchTerms}", escaped, "{searchTerms?}", escaped)
+// searchValues returns the search form's values by OpenSearch parameter.
+func searchValues(r *http.Request) map[string]string {
+	values := make(map[string]string)
+	for param, name := range map[string]string{
+		opds.SearchTerms:  "search",
+		opds.SearchTitle:  "title",
+		opds.SearchAuthor: "author",
+	} {
+		if value := strings.TrimSpace(r.URL.Query().Get(name)); value != "" {
+			values[param] = value
+		}
+	}
+	return values
+}
 
-	if strings.Contains(queryURL, "{searchTerms") {
-		return repl.Replace(queryURL), nil
+// resolveSearchTemplate returns the template of a search link, which is
+// either a template itself or an OpenSearch description fetched with
+// client and kept in descriptions.
+func resolveSearchTemplate(ctx context.Context, descriptions *opds.SearchDescriptions, client *http.Client, searchURL string) (*opds.SearchTemplate, error) {
+	if opds.IsSearchTemplate(searchURL) {
+		return opds.NewSearchTemplate(searchURL), nil
 	}
+	return descriptions.Resolve(ctx, client, searchURL)
+}
 
-	if tmpl, err := opds.ResolveOpenSearchTemplate(queryURL); err == nil && tmpl != "" {
-		return repl.Replace(tmpl), nil
+// searchTemplate returns the template of the feed's search link, for
+// showing the fields it can be searched by. It's nil when the feed can't
+// be searched or its description can't be fetched.
+func (h *FeedHandler) searchTemplate(r *http.Request, feed *opds.Feed, feedURL string) *opds.SearchTemplate {
+	link := feed.GetLinks().Search()
+	if link == nil {
+		return nil
+	}
+	base, err := url.Parse(feedURL)
+	if err != nil {
+		return nil
+	}
+	ref, err := url.Parse(link.Href)
+	if err != nil {
+		return nil
+	}
+	searchURL := base.ResolveReference(ref).String()
+	if h.allowlist.Check(searchURL) != nil || !h.users.CanFetch(reqctx.User(r.Context()), searchURL) {
+		return nil
 	}
 
-	return queryURL, nil
+	client := auth.Authorize(searchURL, r, h.feeds, h.users, h.s).Client(h.allowlist.Client())
+	tmpl, err := resolveSearchTemplate(r.Context(), h.searches, client, searchURL)
+	if err != nil {
+		reqctx.Logger(r.Context()).Debug("Failed to resolve search template", slog.Any("error", err))
+		return nil
+	}
+	return tmpl
 }
 
-func (h *FeedHandler) serveAtom(w http.ResponseWriter, r *http.Request, resp *http.Response, url string, deviceType device.DeviceType) error {
+func (h *FeedHandler) serveFeed(w http.ResponseWriter, r *http.Request, resp *http.Response, url string, deviceType device.DeviceType, format formats.Format) error {
 	// Read the body so we can fall back to forwarding it on parse/render errors
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -137,7 +298,12 @@ func (h *FeedHandler) serveAtom(w http.ResponseWriter, r *http.Request, resp *ht
 	// Reset body for downstream parsing
 	resp.Body = io.NopCloser(bytes.NewReader(body))
 
-	feed, err := opds.ParseFeed(resp.Body, h.debug)
+	var feed *opds.Feed
+	if format == formats.OPDS2 {
+		feed, err = opds.ParseFeedJSON(resp.Body)
+	} else {
+		feed, err = opds.ParseFeed(resp.Body, h.debug)
+	}
 	if err != nil {
 		// Reset again so we can forward the full original response body
 		resp.Body = io.NopCloser(bytes.NewReader(body))
@@ -145,6 +311,10 @@ func (h *FeedHandler) serveAtom(w http.ResponseWriter, r *http.Request, resp *ht
 		return nil
 	}
 
+	if h.catalog {
+		return h.serveCatalog(w, feed, url, deviceType)
+	}
+
 	entryID := r.URL.Query().Get("id")
 	if entryID != "" {
 		var entry opds.Entry
@@ -165,21 +335,20 @@ func (h *FeedHandler) serveAtom(w http.ResponseWriter, r *http.Request, resp *ht
 			Entry:            entry,
 			DeviceType:       deviceType,
 			ConverterManager: h.converters,
+			Links:            h.links,
+			SearchTemplate:   h.searchTemplate(r, feed, url),
 		}
 
 		view.Render(w, func(buf io.Writer) error { return view.Entry(buf, params) })
 		return nil
 	}
 
-	params := view.FeedParams{URL: url, Feed: feed}
+	params := view.FeedParams{URL: url, Feed: feed, Links: h.links, SearchTemplate: h.searchTemplate(r, feed, url)}
 	view.Render(w, func(buf io.Writer) error { return view.Feed(buf, params) })
 	return nil
 }
 
 func (h *FeedHandler) serveFile(w http.ResponseWriter, r *http.Request, resp *http.Response, deviceType device.DeviceType, inputFormat formats.Format) error {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
 	log := reqctx.Logger(r.Context())
 
 	filename, err := httpx.ParseFilename(resp)
@@ -188,8 +357,12 @@ func (h *FeedHandler) serveFile(w http.ResponseWriter, r *http.Request, resp *ht
 	}
 	log = log.With(slog.String("file", filename))
 
-	converter := h.converters.GetConverterForDevice(deviceType, inputFormat)
-	if converter == nil {
+	chain, err := h.chainFor(r.URL.Query().Get("as"), deviceType, inputFormat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if chain == nil {
 		httpx.ForwardResponse(w, resp)
 		if filename != "" {
 			log.Info("Sent File")
@@ -197,21 +370,128 @@ func (h *FeedHandler) serveFile(w http.ResponseWriter, r *http.Request, resp *ht
 		return nil
 	}
 
-	epubFile := filepath.Join(h.outputDir, filename)
-	if err := httpx.DownloadToFile(epubFile, resp); err != nil {
-		return err
+	converterName := chain.String()
+	log = log.With(slog.String("converter", converterName))
+	outputExtension := chain.Output().Extension
+
+	// Upstream validators let us find a cached conversion without downloading the file again
+	var cacheKey string
+	if h.cache != nil {
+		if validator := cacheValidator(resp); validator != "" {
+			cacheKey = filecache.Key(resp.Request.URL.String(), validator, converterName, outputExtension)
+			if served, err := h.serveCached(w, r, log, cacheKey); served || err != nil {
+				return err
+			}
+		}
 	}
-	defer os.Remove(epubFile)
 
-	outputFile, err := converter.Convert(log, epubFile)
+	// Each conversion gets its own directory so concurrent jobs can't clobber each other's files
+	if err := os.MkdirAll(h.outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory %q: %w", h.outputDir, err)
+	}
+	workDir, err := os.MkdirTemp(h.outputDir, "convert-*")
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to create working directory: %w", err)
 	}
+	cleanup := func() { os.RemoveAll(workDir) }
 
-	if err := httpx.SendFile(w, outputFile, filepath.Base(outputFile)); err != nil {
+	inputFile := filepath.Join(workDir, filename)
+	if err := httpx.DownloadToFile(inputFile, resp); err != nil {
+		cleanup()
 		return err
 	}
 
-	log.Info("Sent Converted File", slog.String("converter", reflect.TypeOf(converter).String()))
+	// Otherwise fall back to the content hash of the downloaded file
+	if h.cache != nil && cacheKey == "" {
+		hash, err := filecache.HashFile(inputFile)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		cacheKey = filecache.Key(hash, converterName, outputExtension)
+		if served, err := h.serveCached(w, r, log, cacheKey); served || err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	job := h.jobs.Submit(cacheKey, filename, func() (string, error) {
+		outputFile, err := chain.Convert(log, inputFile)
+		if err != nil {
+			log.Error("Conversion failed", slog.Any("error", err))
+			return "", err
+		}
+		log.Info("Converted File")
+
+		if h.cache == nil {
+			return outputFile, nil
+		}
+
+		cachedFile, err := h.cache.Put(cacheKey, outputFile)
+		if err != nil {
+			log.Warn("Failed to cache converted file", slog.Any("error", err))
+			return outputFile, nil
+		}
+		cleanup()
+		return cachedFile, nil
+	}, cleanup)
+
+	log.Info("Queued Conversion", slog.String("job", job.ID))
+
+	if h.catalog {
+		// Catalog clients expect the book itself rather than a progress page
+		return h.serveJob(w, r, log, job.ID)
+	}
+	http.Redirect(w, r, "/jobs/"+job.ID, http.StatusSeeOther)
 	return nil
 }
+
+// chainFor returns the conversion chain for the format requested with the
+// "as" query parameter, falling back to the device's preferred format.
+// A nil chain means the original file is served.
+func (h *FeedHandler) chainFor(as string, deviceType device.DeviceType, input formats.Format) (*convert.Chain, error) {
+	switch as {
+	case "":
+		return h.converters.GetChainForDevice(deviceType, input), nil
+	case view.AsOriginal:
+		return nil, nil
+	}
+
+	target, ok := formats.FormatByLabel(as)
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q", as)
+	}
+	if target == input {
+		return nil, nil
+	}
+
+	chain := h.converters.FindChain(deviceType, input, target)
+	if chain == nil {
+		return nil, fmt.Errorf("cannot convert %s to %s", input.Label, target.Label)
+	}
+	return chain, nil
+}
+
+// serveCached sends the cached conversion for key if there is one.
+func (h *FeedHandler) serveCached(w http.ResponseWriter, r *http.Request, log *slog.Logger, key string) (bool, error) {
+	cachedFile, ok := h.cache.Get(key)
+	if !ok {
+		return false, nil
+	}
+	defer cachedFile.Close()
+
+	if err := httpx.ServeOpenFile(w, r, cachedFile, filepath.Base(cachedFile.Name())); err != nil {
+		return true, err
+	}
+
+	log.Info("Sent Cached File")
+	return true, nil
+}
+
+// cacheValidator returns the upstream ETag or Last-Modified header, if any.
+func cacheValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
@@ -4,6 +4,8 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/reqctx"
 	"github.com/evan-buss/opds-proxy/view"
 )
 
@@ -12,16 +14,31 @@ type HomeLink struct {
 	URL   string
 }
 
-// Home returns a handler that renders the home page with provided links
-func Home(links []HomeLink) http.HandlerFunc {
+// Home returns a handler that renders the home page with provided links,
+// limited to the feeds the logged in user has access to. Searches from the
+// home page are handed to search.
+func Home(links []HomeLink, users *auth.Users, search http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if len(links) == 1 {
-			http.Redirect(w, r, "/feed?q="+links[0].URL, http.StatusFound)
+		if r.URL.Query().Has("search") {
+			search(w, r)
 			return
 		}
 
-		params := make([]view.HomeParams, len(links))
-		for i, l := range links {
+		username := reqctx.User(r.Context())
+		var visible []HomeLink
+		for _, l := range links {
+			if users.CanAccess(username, l.Title) {
+				visible = append(visible, l)
+			}
+		}
+
+		if len(visible) == 1 {
+			http.Redirect(w, r, "/feed?q="+visible[0].URL, http.StatusFound)
+			return
+		}
+
+		params := make([]view.HomeParams, len(visible))
+		for i, l := range visible {
 			params[i] = view.HomeParams{Title: l.Title, URL: l.URL}
 		}
 
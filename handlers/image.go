@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/evan-buss/opds-proxy/internal/allowlist"
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/device"
+	"github.com/evan-buss/opds-proxy/internal/feedcache"
+	"github.com/evan-buss/opds-proxy/internal/filecache"
+	"github.com/evan-buss/opds-proxy/internal/httpx"
+	"github.com/evan-buss/opds-proxy/internal/imaging"
+	"github.com/evan-buss/opds-proxy/internal/linktoken"
+	"github.com/evan-buss/opds-proxy/internal/reqctx"
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	// Largest width or height that can be requested
+	maxImageDimension = 2000
+	// Larger upstream images are refused instead of being decoded
+	maxImageBytes = 20 << 20
+)
+
+type ImageHandler struct {
+	outputDir string
+	feeds     []auth.FeedConfig
+	s         *securecookie.SecureCookie
+	cache     *filecache.Cache
+	allowlist *allowlist.Allowlist
+	links     *linktoken.Store
+	users     *auth.Users
+}
+
+// Image returns a handler that serves covers scaled down to the size they
+// are shown at, in grayscale for e-ink devices. Processed images are stored
+// in cache when it is non-nil. Only URLs permitted by the allowlist are
+// fetched, and images are requested with tokens from links. Logged in users
+// can only fetch from the feeds they have access to.
+func Image(outputDir string, feeds []auth.FeedConfig, s *securecookie.SecureCookie, cache *filecache.Cache, allowlist *allowlist.Allowlist, links *linktoken.Store, users *auth.Users) http.HandlerFunc {
+	h := &ImageHandler{
+		outputDir: outputDir,
+		feeds:     feeds,
+		s:         s,
+		cache:     cache,
+		allowlist: allowlist,
+		links:     links,
+		users:     users,
+	}
+	return h.ServeHTTP
+}
+
+func (h *ImageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := reqctx.Logger(r.Context())
+
+	token := r.URL.Query().Get("q")
+	if token == "" {
+		http.Error(w, "No image specified", http.StatusBadRequest)
+		return
+	}
+	imageURL, ok := h.links.Resolve(token)
+	if !ok {
+		http.Error(w, "Unknown or invalid link", http.StatusNotFound)
+		return
+	}
+	if err := h.allowlist.Check(imageURL); err != nil {
+		log.Warn("Link Not Allowed", slog.Any("error", err))
+		http.Error(w, "This link is not allowed", http.StatusForbidden)
+		return
+	}
+	if !h.users.CanFetch(reqctx.User(r.Context()), imageURL) {
+		http.Error(w, "You don't have access to this feed", http.StatusForbidden)
+		return
+	}
+
+	opts := imaging.Options{
+		MaxWidth:  imageDimension(r.URL.Query().Get("w")),
+		MaxHeight: imageDimension(r.URL.Query().Get("h")),
+		Grayscale: device.DetectDevice(r.UserAgent()).IsEInk(),
+	}
+
+	authorization := auth.Authorize(imageURL, r, h.feeds, h.users, h.s)
+
+	// Covers rarely change, so cached images are served without asking upstream.
+	key := imageCacheKey(imageURL, reqctx.User(r.Context()), authorization.Credentials, opts)
+	if h.cache != nil {
+		if cached, ok := h.cache.Get(key); ok {
+			h.serve(w, r, log, cached)
+			return
+		}
+	}
+
+	resp, err := httpx.Fetch(authorization.Client(h.allowlist.Client()), imageURL, 10, nil)
+	if err != nil {
+		// Errors name the upstream URL, which links are meant to hide
+		log.Error("Failed to fetch image", slog.String("url", imageURL), slog.Any("error", err))
+		http.Error(w, "Failed to fetch image from upstream", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
+		httpx.ForwardResponse(w, resp)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		log.Error("Failed to read image", slog.String("url", imageURL), slog.Any("error", err))
+		http.Error(w, "Failed to read image from upstream", http.StatusBadGateway)
+		return
+	}
+	if len(body) > maxImageBytes {
+		http.Error(w, "Image is too large", http.StatusBadGateway)
+		return
+	}
+
+	var processed bytes.Buffer
+	if err := imaging.Process(&processed, bytes.NewReader(body), opts); err != nil {
+		// Formats we can't decode, such as WebP, and images too large to
+		// decode safely are passed through untouched
+		log.Debug("Failed to process image", slog.Any("error", err))
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		httpx.ForwardResponse(w, resp)
+		return
+	}
+
+	if h.cache != nil {
+		if err := h.store(key, processed.Bytes()); err != nil {
+			log.Warn("Failed to cache image", slog.Any("error", err))
+		} else if cached, ok := h.cache.Get(key); ok {
+			h.serve(w, r, log, cached)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	_, _ = w.Write(processed.Bytes())
+}
+
+func (h *ImageHandler) store(key string, data []byte) error {
+	if err := os.MkdirAll(h.outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory %q: %w", h.outputDir, err)
+	}
+	file, err := os.CreateTemp(h.outputDir, "cover-*.jpg")
+	if err != nil {
+		return fmt.Errorf("failed to create image file: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to write image file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to write image file: %w", err)
+	}
+
+	if _, err := h.cache.Put(key, file.Name()); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+// serve sends the cached image file and closes it.
+func (h *ImageHandler) serve(w http.ResponseWriter, r *http.Request, log *slog.Logger, file *os.File) {
+	defer file.Close()
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if err := httpx.ServeInlineFile(w, r, file); err != nil {
+		log.Error("Failed to send image", slog.Any("error", err))
+	}
+}
+
+// imageCacheKey identifies a processed cover. Like feeds, it includes the
+// proxy user and the upstream credentials so covers fetched with them stay
+// theirs.
+func imageCacheKey(imageURL, user string, creds *auth.Credentials, opts imaging.Options) string {
+	return filecache.Key(feedcache.Key(imageURL, user, creds), strconv.Itoa(opts.MaxWidth), strconv.Itoa(opts.MaxHeight), strconv.FormatBool(opts.Grayscale))
+}
+
+// imageDimension parses a requested width or height, 0 means unconstrained.
+func imageDimension(value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return min(n, maxImageDimension)
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/imaging"
+)
+
+func TestImageCacheKeySeparatesUsersAndCredentials(t *testing.T) {
+	const imageURL = "http://calibre:8083/opds/cover/1"
+	opts := imaging.Options{MaxWidth: 100}
+	base := imageCacheKey(imageURL, "alice", &auth.Credentials{Username: "calibre", Password: "one"}, opts)
+
+	others := map[string]string{
+		"proxy user": imageCacheKey(imageURL, "bob", &auth.Credentials{Username: "calibre", Password: "one"}, opts),
+		"password":   imageCacheKey(imageURL, "alice", &auth.Credentials{Username: "calibre", Password: "two"}, opts),
+		"anonymous":  imageCacheKey(imageURL, "alice", nil, opts),
+		"size":       imageCacheKey(imageURL, "alice", &auth.Credentials{Username: "calibre", Password: "one"}, imaging.Options{MaxWidth: 200}),
+	}
+	for name, key := range others {
+		if key == base {
+			t.Errorf("changing the %s doesn't change the cache key", name)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/evan-buss/opds-proxy/internal/httpx"
+	"github.com/evan-buss/opds-proxy/internal/jobs"
+	"github.com/evan-buss/opds-proxy/internal/reqctx"
+	"github.com/evan-buss/opds-proxy/view"
+)
+
+// Job returns a handler that reports the progress of a background conversion.
+// Once the job is done the converted file is served in place of the progress page.
+func Job(manager *jobs.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := manager.Get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "Conversion not found or expired", http.StatusNotFound)
+			return
+		}
+
+		if job.Status != jobs.StatusDone {
+			params := view.JobParams{
+				Name:     job.Name,
+				Status:   string(job.Status),
+				Error:    job.Error,
+				Elapsed:  time.Since(job.Created).Round(time.Second).String(),
+				Finished: job.IsFinished(),
+			}
+			view.Render(w, func(buf io.Writer) error { return view.Job(buf, params) })
+			return
+		}
+
+		if _, err := os.Stat(job.Result); err != nil {
+			http.Error(w, "Converted file is no longer available", http.StatusGone)
+			return
+		}
+
+		log := reqctx.Logger(r.Context()).With(slog.String("job", job.ID))
+		if err := httpx.ServeFile(w, r, job.Result, filepath.Base(job.Result)); err != nil {
+			log.Error("Failed to send converted file", slog.Any("error", err))
+			return
+		}
+		log.Info("Sent Converted File", slog.String("file", job.Name))
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/reqctx"
+	"github.com/evan-buss/opds-proxy/view"
+	"github.com/gorilla/securecookie"
+)
+
+// Login returns a handler that logs users into the proxy itself, as opposed
+// to Auth which stores credentials for an upstream feed.
+func Login(s *securecookie.SecureCookie, users *auth.Users) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		returnUrl := localReturnURL(r.URL.Query().Get("return"))
+		params := view.LoginParams{ReturnURL: returnUrl, Host: "OPDS Proxy", Prompt: "Log in to continue."}
+
+		if r.Method == "GET" {
+			view.Render(w, func(buf io.Writer) error { return view.Login(buf, params) })
+			return
+		}
+
+		if r.Method == "POST" {
+			username := r.FormValue("username")
+			user, ok := users.Authenticate(username, r.FormValue("password"))
+			if !ok {
+				reqctx.Logger(r.Context()).Warn("Failed Login", slog.String("username", username))
+				params.Error = "Incorrect username or password."
+				view.Render(w, func(buf io.Writer) error { return view.Login(buf, params) })
+				return
+			}
+
+			if err := auth.SetSession(w, s, user.Username); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to encode session: %v", err), http.StatusInternalServerError)
+				return
+			}
+			reqctx.Logger(r.Context()).Info("Logged In", slog.String("username", user.Username))
+			http.Redirect(w, r, returnUrl, http.StatusFound)
+			return
+		}
+
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// localReturnURL only allows returning to paths on the proxy so the login
+// page can't be used to redirect elsewhere.
+func localReturnURL(returnUrl string) string {
+	if !strings.HasPrefix(returnUrl, "/") || strings.HasPrefix(returnUrl, "//") || strings.HasPrefix(returnUrl, "/\\") {
+		return "/"
+	}
+	return returnUrl
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/reqctx"
+	"github.com/evan-buss/opds-proxy/view"
+	"github.com/gorilla/securecookie"
+)
+
+// Logout returns a handler that lists the feeds credentials are stored for
+// and revokes them, one at a time or all at once along with the proxy session.
+func Logout(s *securecookie.SecureCookie, feeds []auth.FeedConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stored := auth.StoredCredentials(r, s)
+
+		if r.Method == "GET" {
+			params := view.LogoutParams{
+				User:          reqctx.User(r.Context()),
+				CanEndSession: auth.HasSession(r),
+			}
+			origins := make([]string, 0, len(stored))
+			for origin := range stored {
+				origins = append(origins, origin)
+			}
+			slices.Sort(origins)
+
+			for _, origin := range origins {
+				name := origin
+				if u, err := url.Parse(origin); err == nil {
+					name = feedName(u, feeds)
+				}
+				params.Logins = append(params.Logins, view.LogoutLogin{Origin: origin, Name: name, Username: stored[origin].Username})
+			}
+
+			view.Render(w, func(buf io.Writer) error { return view.Logout(buf, params) })
+			return
+		}
+
+		if r.Method == "POST" {
+			if r.FormValue("all") != "" {
+				if err := auth.StoreCredentials(w, r, s, nil); err != nil {
+					http.Error(w, fmt.Sprintf("Failed to clear credentials: %v", err), http.StatusInternalServerError)
+					return
+				}
+				auth.ClearSession(w)
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+
+			delete(stored, r.FormValue("origin"))
+			if err := auth.StoreCredentials(w, r, s, stored); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to encode credentials: %v", err), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/logout", http.StatusSeeOther)
+			return
+		}
+
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
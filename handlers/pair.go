@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/pairing"
+	"github.com/evan-buss/opds-proxy/internal/reqctx"
+	"github.com/evan-buss/opds-proxy/view"
+	"github.com/gorilla/securecookie"
+)
+
+const pairPath = "/pair"
+
+// Devices returns a handler that pairs e-readers with the logged in user and
+// the feed logins stored in the browser, and lists paired devices to unpair.
+func Devices(s *securecookie.SecureCookie, devices *pairing.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := reqctx.User(r.Context())
+
+		if r.Method == "GET" {
+			params := view.DevicesParams{}
+			for _, d := range devices.Devices(user) {
+				params.Devices = append(params.Devices, view.DeviceViewModel{
+					ID:      d.ID,
+					Name:    d.Name,
+					Created: d.Created.Format("Jan 2, 2006"),
+				})
+			}
+			view.Render(w, func(buf io.Writer) error { return view.Devices(buf, params) })
+			return
+		}
+
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch r.FormValue("action") {
+		case "pair":
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" {
+				name = "E-Reader"
+			}
+
+			token, code, err := devices.Pair(name, user, auth.StoredCredentials(r, s))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to pair device: %v", err), http.StatusInternalServerError)
+				return
+			}
+			reqctx.Logger(r.Context()).Info("Paired Device", slog.String("device", name))
+
+			params := view.DevicesParams{
+				Name:        name,
+				Code:        code[:4] + "-" + code[4:],
+				CodeMinutes: int(pairing.CodeTTL.Minutes()),
+				PairPage:    baseURL(r) + pairPath,
+				PairURL:     baseURL(r) + pairPath + "/" + token,
+			}
+			view.Render(w, func(buf io.Writer) error { return view.Devices(buf, params) })
+
+		case "revoke":
+			err := devices.Revoke(user, r.FormValue("id"))
+			if errors.Is(err, pairing.ErrNotFound) {
+				http.Error(w, "Device not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to unpair device: %v", err), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/devices", http.StatusSeeOther)
+
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+		}
+	}
+}
+
+// Pair returns a handler that lets an e-reader redeem a pairing code and
+// restores a paired device's session and feed logins from its token.
+func Pair(s *securecookie.SecureCookie, devices *pairing.Store, users *auth.Users) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.PathValue("token")
+		if token == "" {
+			redeemCode(w, r, devices)
+			return
+		}
+
+		device, creds, ok := devices.Restore(token)
+		if ok && device.User != "" && !users.Known(device.User) {
+			ok = false
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			params := view.PairParams{Error: "This device is no longer paired. Pair it again with a new code."}
+			view.Render(w, func(buf io.Writer) error { return view.Pair(buf, params) })
+			return
+		}
+
+		// Accounts let the device log in, gateway users are identified by the gateway instead
+		if device.User != "" && users.Enabled() {
+			if err := auth.SetSession(w, s, device.User); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to encode session: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		deviceReq := r.WithContext(reqctx.WithUser(r.Context(), device.User))
+		if err := auth.StoreCredentials(w, deviceReq, s, creds); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to encode credentials: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// The first visit explains the bookmark, later ones go straight to the feeds
+		if r.URL.Query().Get("new") == "" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		params := view.PairParams{Paired: true, Name: device.Name}
+		view.Render(w, func(buf io.Writer) error { return view.Pair(buf, params) })
+	}
+}
+
+func redeemCode(w http.ResponseWriter, r *http.Request, devices *pairing.Store) {
+	if r.Method == "GET" {
+		view.Render(w, func(buf io.Writer) error { return view.Pair(buf, view.PairParams{}) })
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := devices.Redeem(r.FormValue("code"))
+	if !ok {
+		params := view.PairParams{Error: "That code is invalid or has expired."}
+		view.Render(w, func(buf io.Writer) error { return view.Pair(buf, params) })
+		return
+	}
+	http.Redirect(w, r, pairPath+"/"+token+"?new=1", http.StatusSeeOther)
+}
+
+// baseURL returns the scheme and host the request was made to, for
+// showing addresses to type on another device.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/evan-buss/opds-proxy/internal/allowlist"
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/feedcache"
+	"github.com/evan-buss/opds-proxy/internal/formats"
+	"github.com/evan-buss/opds-proxy/internal/httpx"
+	"github.com/evan-buss/opds-proxy/internal/linktoken"
+	"github.com/evan-buss/opds-proxy/internal/reqctx"
+	"github.com/evan-buss/opds-proxy/opds"
+	"github.com/evan-buss/opds-proxy/view"
+	"github.com/gorilla/securecookie"
+)
+
+// How long all feeds together are given to answer a search
+const searchTimeout = 15 * time.Second
+
+var (
+	errNoSearch      = errors.New("this feed can't be searched")
+	errLoginRequired = errors.New("log in to this feed to search it")
+)
+
+type SearchHandler struct {
+	feeds     []auth.FeedConfig
+	s         *securecookie.SecureCookie
+	debug     bool
+	allowlist *allowlist.Allowlist
+	links     *linktoken.Store
+	users     *auth.Users
+	feedCache *feedcache.Cache
+	searches  *opds.SearchDescriptions
+}
+
+// Search returns a handler that searches every feed the user has access to
+// at once and lists the results grouped by feed. Feeds that don't answer
+// within searchTimeout are reported as timed out.
+func Search(feeds []auth.FeedConfig, s *securecookie.SecureCookie, debug bool, allowlist *allowlist.Allowlist, links *linktoken.Store, users *auth.Users, feedCache *feedcache.Cache, searches *opds.SearchDescriptions) http.HandlerFunc {
+	h := &SearchHandler{
+		feeds:     feeds,
+		s:         s,
+		debug:     debug,
+		allowlist: allowlist,
+		links:     links,
+		users:     users,
+		feedCache: feedCache,
+		searches:  searches,
+	}
+	return h.ServeHTTP
+}
+
+func (h *SearchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	term := strings.TrimSpace(r.URL.Query().Get("search"))
+	if term == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	log := reqctx.Logger(r.Context()).With(slog.String("search", term))
+
+	var feeds []auth.FeedConfig
+	for _, feed := range h.feeds {
+		if h.users.CanAccess(reqctx.User(r.Context()), feed.Name) {
+			feeds = append(feeds, feed)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), searchTimeout)
+	defer cancel()
+
+	type result struct {
+		index int
+		view.SearchResult
+	}
+	done := make(chan result, len(feeds))
+	results := make([]view.SearchResult, len(feeds))
+	for i, feed := range feeds {
+		results[i] = view.SearchResult{Title: feed.Name, URL: feed.Url, Error: searchError(context.DeadlineExceeded)}
+		go func() {
+			res, err := h.searchFeed(ctx, r, feed, term)
+			if err != nil {
+				res.Error = searchError(err)
+				if !errors.Is(err, errNoSearch) {
+					log.Warn("Search Failed", slog.String("feed", feed.Name), slog.Any("error", err))
+				}
+			}
+			done <- result{i, res}
+		}()
+	}
+
+wait:
+	for range feeds {
+		select {
+		case res := <-done:
+			results[res.index] = res.SearchResult
+		case <-ctx.Done():
+			log.Warn("Search Timed Out")
+			break wait
+		}
+	}
+
+	params := view.SearchParams{Search: term, Results: results, Links: h.links}
+	view.Render(w, func(buf io.Writer) error { return view.Search(buf, params) })
+}
+
+// searchFeed finds the search link of the feed's start page and fetches
+// the results for term.
+func (h *SearchHandler) searchFeed(ctx context.Context, r *http.Request, feed auth.FeedConfig, term string) (view.SearchResult, error) {
+	res := view.SearchResult{Title: feed.Name, URL: feed.Url}
+
+	start, err := h.fetchFeed(ctx, r, feed.Url)
+	if err != nil {
+		return res, err
+	}
+
+	link := start.GetLinks().Search()
+	if link == nil {
+		return res, errNoSearch
+	}
+	base, err := url.Parse(feed.Url)
+	if err != nil {
+		return res, err
+	}
+	ref, err := url.Parse(link.Href)
+	if err != nil {
+		return res, fmt.Errorf("invalid search link %q: %w", link.Href, err)
+	}
+	searchURL := base.ResolveReference(ref).String()
+	// Search descriptions are fetched from the link, so it has to be allowed as well
+	if err := h.allowlist.Check(searchURL); err != nil {
+		return res, err
+	}
+
+	client := auth.Authorize(searchURL, r, h.feeds, h.users, h.s).Client(h.allowlist.Client())
+	tmpl, err := resolveSearchTemplate(ctx, h.searches, client, searchURL)
+	if err != nil {
+		return res, err
+	}
+	searchURL = tmpl.Expand(map[string]string{opds.SearchTerms: term})
+
+	results, err := h.fetchFeed(ctx, r, searchURL)
+	if err != nil {
+		return res, err
+	}
+	res.URL = searchURL
+	res.Feed = results
+	return res, nil
+}
+
+// fetchFeed fetches and parses the feed at rawURL with the user's
+// credentials, going through the feed cache.
+func (h *SearchHandler) fetchFeed(ctx context.Context, r *http.Request, rawURL string) (*opds.Feed, error) {
+	if err := h.allowlist.Check(rawURL); err != nil {
+		return nil, err
+	}
+	username := reqctx.User(r.Context())
+	if !h.users.CanFetch(username, rawURL) {
+		return nil, errors.New("you don't have access to this feed")
+	}
+
+	authorization := auth.Authorize(rawURL, r, h.feeds, h.users, h.s)
+	client := authorization.Client(h.allowlist.Client())
+	key := feedcache.Key(rawURL, username, authorization.Credentials)
+	resp, err := h.feedCache.Fetch(rawURL, key, func(header http.Header) (*http.Response, error) {
+		return httpx.FetchContext(ctx, client, rawURL, 10, func(req *http.Request) {
+			maps.Copy(req.Header, header)
+		})
+	}, isFeedResponse)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errLoginRequired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	format, ok := feedFormat(resp)
+	if !ok {
+		return nil, fmt.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	if format == formats.OPDS2 {
+		return opds.ParseFeedJSON(resp.Body)
+	}
+	return opds.ParseFeed(resp.Body, h.debug)
+}
+
+// searchError returns the message shown for a feed that couldn't be searched.
+func searchError(err error) string {
+	switch {
+	case errors.Is(err, errNoSearch):
+		return "This feed can't be searched."
+	case errors.Is(err, errLoginRequired):
+		return "Log in to this feed to search it."
+	case errors.Is(err, context.DeadlineExceeded):
+		return "The search timed out."
+	}
+	// Other errors name upstream URLs, they're only logged
+	return "The search failed."
+}
@@ -0,0 +1,178 @@
+package allowlist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/evan-buss/opds-proxy/internal/auth"
+)
+
+// ErrNotAllowed is returned for upstream URLs the proxy refuses to fetch
+var ErrNotAllowed = errors.New("upstream not allowed")
+
+// Shared address space (RFC 6598) isn't covered by netip.Addr.IsPrivate
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// Allowlist decides which upstream hosts the proxy may fetch from so it
+// can't be used as an open proxy. Origins (scheme, host and port) of
+// configured feeds are always allowed, including on private networks.
+// Additional hosts may be allowed by name, or with a "*." prefix for
+// subdomains, but only when they resolve to public addresses. A single "*"
+// allows any public host.
+type Allowlist struct {
+	feedOrigins map[string]bool
+	feedAddrs   map[string]bool // host:port of the feed origins, as dialed
+	patterns    []string
+	resolver    *net.Resolver
+	dialer      *net.Dialer
+	client      *http.Client
+}
+
+func New(feedURLs []string, allowedHosts []string) (*Allowlist, error) {
+	a := &Allowlist{
+		feedOrigins: make(map[string]bool),
+		feedAddrs:   make(map[string]bool),
+		resolver:    net.DefaultResolver,
+		dialer:      &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+
+	for _, rawURL := range feedURLs {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid feed URL %q", rawURL)
+		}
+		origin := auth.Origin(u)
+		a.feedOrigins[origin] = true
+		_, addr, _ := strings.Cut(origin, "://")
+		a.feedAddrs[addr] = true
+	}
+
+	for _, host := range allowedHosts {
+		pattern := strings.ToLower(strings.TrimSpace(host))
+		if !validPattern(pattern) {
+			return nil, fmt.Errorf("invalid allowed host %q, expected a host name such as example.com or *.example.com", host)
+		}
+		a.patterns = append(a.patterns, pattern)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Connections are checked against the allowlist, so they can't go through a proxy
+	transport.Proxy = nil
+	transport.DialContext = a.dialContext
+	a.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if err := a.Check(req.URL.String()); err != nil {
+				return fmt.Errorf("redirect rejected: %w", err)
+			}
+			return nil
+		},
+	}
+
+	return a, nil
+}
+
+// Client returns an HTTP client that only connects to allowed hosts and
+// rejects redirects that leave them.
+func (a *Allowlist) Client() *http.Client {
+	return a.client
+}
+
+// Check reports whether rawURL may be fetched. Checks that depend on what
+// the host resolves to happen when connecting.
+func (a *Allowlist) Check(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotAllowed, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: unsupported scheme %q", ErrNotAllowed, u.Scheme)
+	}
+	if !a.feedOrigins[auth.Origin(u)] && !a.allowsHost(u.Hostname()) {
+		return fmt.Errorf("%w: %s is not a configured feed or allowed host", ErrNotAllowed, u.Host)
+	}
+	return nil
+}
+
+// allowsHost reports whether host matches one of the allowed host patterns.
+func (a *Allowlist) allowsHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range a.patterns {
+		if pattern == "*" || pattern == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialContext only connects to allowed hosts. Addresses that aren't those
+// of configured feeds are resolved here and refused if any address is private, so DNS
+// can't be used to point an allowed name at the local network.
+func (a *Allowlist) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if a.feedAddrs[strings.ToLower(addr)] {
+		return a.dialer.DialContext(ctx, network, addr)
+	}
+	if !a.allowsHost(host) {
+		return nil, fmt.Errorf("%w: %s is not a configured feed or allowed host", ErrNotAllowed, addr)
+	}
+
+	addrs, err := a.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range addrs {
+		if isInternal(ip) {
+			return nil, fmt.Errorf("%w: %s resolves to internal address %s", ErrNotAllowed, host, ip)
+		}
+	}
+
+	var lastErr error
+	for _, ip := range addrs {
+		conn, err := a.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses found for %s", host)
+	}
+	return nil, lastErr
+}
+
+func validPattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	name := strings.TrimPrefix(pattern, "*.")
+	return name != "" && !strings.ContainsAny(name, "*/:@ ")
+}
+
+func isInternal(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip)
+}
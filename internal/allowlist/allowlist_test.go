@@ -0,0 +1,140 @@
+package allowlist
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	a, err := New([]string{"http://calibre.local:8080/opds"}, []string{"books.example.com", "*.gutenberg.org"})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"http://calibre.local:8080/opds/new", true},
+		{"http://CALIBRE.local:8080/other-case", true},
+		{"http://calibre.local/other-port", false},
+		{"https://calibre.local:8080/other-scheme", false},
+		{"https://books.example.com/catalog", true},
+		{"https://www.gutenberg.org/ebooks.opds/", true},
+		{"https://gutenberg.org/", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://localhost:9000/admin", false},
+		{"https://evil.example.com/", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, tt := range tests {
+		err := a.Check(tt.url)
+		if tt.allowed && err != nil {
+			t.Errorf("Check(%q) = %v, want allowed", tt.url, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("Check(%q) = %v, want ErrNotAllowed", tt.url, err)
+		}
+	}
+}
+
+func TestNewRejectsInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"", "http://example.com", "example.com:8080", "foo.*.com"} {
+		if _, err := New(nil, []string{pattern}); err == nil {
+			t.Errorf("expected pattern %q to be rejected", pattern)
+		}
+	}
+	if _, err := New(nil, []string{"*"}); err != nil {
+		t.Errorf("expected * to be accepted, got %v", err)
+	}
+}
+
+func TestClientAllowsFeedHostOnPrivateNetwork(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	a, err := New([]string{srv.URL}, nil)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	resp, err := a.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("expected feed host to be reachable, got %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestClientBlocksOtherPortsOfFeedHost(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("admin"))
+	}))
+	defer admin.Close()
+
+	a, err := New([]string{"http://127.0.0.1:1/opds"}, []string{"*"})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	_, err = a.Client().Get(admin.URL)
+	if !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("expected ErrNotAllowed, got %v", err)
+	}
+}
+
+func TestClientBlocksAllowedHostOnPrivateNetwork(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	// localhost is allowed by name but resolves to a loopback address
+	a, err := New(nil, []string{"localhost"})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	_, err = a.Client().Get(strings.Replace(srv.URL, "127.0.0.1", "localhost", 1))
+	if !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("expected ErrNotAllowed, got %v", err)
+	}
+}
+
+func TestClientRejectsRedirectsLeavingAllowlist(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	a, err := New([]string{srv.URL}, nil)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	_, err = a.Client().Get(srv.URL)
+	if !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("expected redirect to be rejected, got %v", err)
+	}
+}
+
+func TestIsInternal(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1":        true,
+		"10.1.2.3":         true,
+		"192.168.1.10":     true,
+		"169.254.169.254":  true,
+		"100.64.0.1":       true,
+		"::1":              true,
+		"fd00::1":          true,
+		"::ffff:127.0.0.1": true,
+		"0.0.0.0":          true,
+		"93.184.216.34":    false,
+		"2606:4700::1111":  false,
+	} {
+		if got := isInternal(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isInternal(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// digestChallenge is the server's WWW-Authenticate Digest header (RFC 7616).
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+}
+
+// digestAuthorization returns the Authorization header answering the digest
+// challenge in header, if there is one the proxy can answer.
+func digestAuthorization(header http.Header, method, uri string, creds Credentials) (string, bool) {
+	for _, value := range header.Values("WWW-Authenticate") {
+		challenge, ok := parseDigestChallenge(value)
+		if !ok {
+			continue
+		}
+		if answer, ok := challenge.answer(method, uri, creds, newCnonce()); ok {
+			return answer, true
+		}
+	}
+	return "", false
+}
+
+func parseDigestChallenge(value string) (digestChallenge, bool) {
+	scheme, params, _ := strings.Cut(strings.TrimSpace(value), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return digestChallenge{}, false
+	}
+
+	var c digestChallenge
+	for key, value := range parseAuthParams(params) {
+		switch key {
+		case "realm":
+			c.realm = value
+		case "nonce":
+			c.nonce = value
+		case "opaque":
+			c.opaque = value
+		case "algorithm":
+			c.algorithm = value
+		case "qop":
+			c.qop = value
+		}
+	}
+	return c, c.nonce != ""
+}
+
+// parseAuthParams splits comma separated key=value pairs, values may be
+// quoted and contain commas.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(strings.TrimLeft(key, ", ")))
+		rest = strings.TrimSpace(rest)
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+		s = strings.TrimLeft(s, ", ")
+	}
+	return params
+}
+
+// answer computes the Authorization header for the challenge. Only the
+// "auth" quality of protection is supported, which is all a GET needs.
+func (c digestChallenge) answer(method, uri string, creds Credentials, cnonce string) (string, bool) {
+	algorithm := strings.ToUpper(c.algorithm)
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", false
+	}
+	h := func(parts ...string) string {
+		sum := newHash()
+		sum.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	qop := ""
+	if c.qop != "" {
+		for option := range strings.SplitSeq(c.qop, ",") {
+			if strings.TrimSpace(option) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return "", false
+		}
+	}
+
+	const nc = "00000001"
+	ha1 := h(creds.Username, c.realm, creds.Password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1, c.nonce, cnonce)
+	}
+	ha2 := h(method, uri)
+
+	var response string
+	if qop == "" {
+		response = h(ha1, c.nonce, ha2)
+	} else {
+		response = h(ha1, c.nonce, nc, cnonce, qop, ha2)
+	}
+
+	fields := []string{
+		`username="` + quoteEscape(creds.Username) + `"`,
+		`realm="` + quoteEscape(c.realm) + `"`,
+		`nonce="` + quoteEscape(c.nonce) + `"`,
+		`uri="` + quoteEscape(uri) + `"`,
+		`response="` + response + `"`,
+	}
+	if c.algorithm != "" {
+		fields = append(fields, "algorithm="+c.algorithm)
+	}
+	if qop != "" {
+		fields = append(fields, "qop="+qop, "nc="+nc, `cnonce="`+cnonce+`"`)
+	}
+	if c.opaque != "" {
+		fields = append(fields, `opaque="`+quoteEscape(c.opaque)+`"`)
+	}
+	return "Digest " + strings.Join(fields, ", "), true
+}
+
+func quoteEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+func newCnonce() string {
+	return rand.Text()[:16]
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Scheme is how requests to a feed's server are authenticated.
+type Scheme string
+
+const (
+	// SchemeBasic sends the username and password with HTTP basic auth
+	SchemeBasic Scheme = "basic"
+	// SchemeBearer sends the token in an "Authorization: Bearer" header
+	SchemeBearer Scheme = "bearer"
+	// SchemeHeader sends the token in a custom header, such as X-API-Key
+	SchemeHeader Scheme = "header"
+	// SchemeQuery sends the token in a query parameter
+	SchemeQuery Scheme = "query"
+	// SchemeDigest answers the server's HTTP digest challenge with the username and password
+	SchemeDigest Scheme = "digest"
+)
+
+// ParseScheme returns the scheme with the given name, basic when empty.
+func ParseScheme(name string) (Scheme, error) {
+	switch scheme := Scheme(strings.ToLower(name)); scheme {
+	case "":
+		return SchemeBasic, nil
+	case SchemeBasic, SchemeBearer, SchemeHeader, SchemeQuery, SchemeDigest:
+		return scheme, nil
+	}
+	return "", fmt.Errorf("unknown auth type %q, expected basic, bearer, header, query or digest", name)
+}
+
+// NeedsName reports whether the scheme needs a header or query parameter name.
+func (s Scheme) NeedsName() bool {
+	return s == SchemeHeader || s == SchemeQuery
+}
+
+// Authorization authenticates requests to one upstream server using the
+// scheme of the feed it belongs to. It's only applied to requests to the
+// server's origin, so credentials aren't sent along when redirected away.
+type Authorization struct {
+	Scheme Scheme
+	// Header or query parameter the token is sent in
+	Name        string
+	Credentials *Credentials
+	UserAgent   string
+
+	origin string
+}
+
+// Authorize returns the authorization for requests to rawUrl, with the
+// scheme and user agent of the feed it belongs to and the credentials
+// from GetCredentials.
+func Authorize(rawUrl string, req *http.Request, feeds []FeedConfig, users *Users, s *securecookie.SecureCookie) *Authorization {
+	a := &Authorization{Scheme: SchemeBasic}
+	requestUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return a
+	}
+	a.origin = Origin(requestUrl)
+	a.Credentials = GetCredentials(rawUrl, req, feeds, users, s)
+
+	if feed := feedForUrl(requestUrl, feeds); feed != nil {
+		a.UserAgent = feed.UserAgent
+		if feed.Auth != nil && feed.Auth.Scheme != "" {
+			a.Scheme = feed.Auth.Scheme
+			a.Name = feed.Auth.Name
+		}
+	}
+	return a
+}
+
+// feedForUrl returns the feed u belongs to: the one with the longest URL
+// whose path is a prefix of u's on the same origin. Links outside every
+// feed's path, such as covers, fall back to the first feed on the origin.
+func feedForUrl(u *url.URL, feeds []FeedConfig) *FeedConfig {
+	var match, fallback *FeedConfig
+	for i, feed := range feeds {
+		feedUrl, err := url.Parse(feed.Url)
+		if err != nil || Origin(feedUrl) != Origin(u) {
+			continue
+		}
+		if fallback == nil {
+			fallback = &feeds[i]
+		}
+		if !strings.HasPrefix(u.Path, feedUrl.Path) {
+			continue
+		}
+		if match == nil || len(feed.Url) > len(match.Url) {
+			match = &feeds[i]
+		}
+	}
+	if match == nil {
+		return fallback
+	}
+	return match
+}
+
+// Apply adds the user agent and credentials to req. Digest auth needs the
+// server's challenge first, so it's only answered by the client from Client.
+func (a *Authorization) Apply(req *http.Request) {
+	if a == nil || Origin(req.URL) != a.origin {
+		return
+	}
+	if a.UserAgent != "" {
+		req.Header.Set("User-Agent", a.UserAgent)
+	}
+
+	creds := a.Credentials
+	if creds == nil {
+		return
+	}
+	switch a.Scheme {
+	case SchemeBasic:
+		req.SetBasicAuth(creds.Username, creds.Password)
+	case SchemeBearer:
+		req.Header.Set("Authorization", "Bearer "+creds.secret())
+	case SchemeHeader:
+		req.Header.Set(a.Name, creds.secret())
+	case SchemeQuery:
+		// Appended rather than re-encoded, so the rest of the query reaches
+		// the server exactly as the feed wrote it
+		param := url.QueryEscape(a.Name) + "=" + url.QueryEscape(creds.secret())
+		if req.URL.RawQuery == "" {
+			req.URL.RawQuery = param
+		} else {
+			req.URL.RawQuery += "&" + param
+		}
+	}
+}
+
+// Client returns a copy of c that authenticates its requests.
+func (a *Authorization) Client(c *http.Client) *http.Client {
+	if a == nil {
+		return c
+	}
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client := *c
+	client.Transport = &authTransport{base: base, auth: a}
+	return &client
+}
+
+type authTransport struct {
+	base http.RoundTripper
+	auth *Authorization
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authed := req.Clone(req.Context())
+	t.auth.Apply(authed)
+	resp, err := t.base.RoundTrip(authed)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.auth.Scheme == SchemeDigest && t.auth.Credentials != nil && resp.StatusCode == http.StatusUnauthorized &&
+		Origin(req.URL) == t.auth.origin && req.Body == nil {
+		if header, ok := digestAuthorization(resp.Header, req.Method, req.URL.RequestURI(), *t.auth.Credentials); ok {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			authed = req.Clone(req.Context())
+			t.auth.Apply(authed)
+			authed.Header.Set("Authorization", header)
+			if resp, err = t.base.RoundTrip(authed); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Callers see the request they made, without tokens added to the query
+	resp.Request = req
+	return resp, nil
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestAuthorizationSchemes(t *testing.T) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name  string
+		auth  FeedAuth
+		check func(*http.Request) bool
+	}{
+		{"basic", FeedAuth{Username: "user", Password: "pass"}, func(r *http.Request) bool {
+			username, password, ok := r.BasicAuth()
+			return ok && username == "user" && password == "pass"
+		}},
+		{"bearer", FeedAuth{Scheme: SchemeBearer, Token: "secret"}, func(r *http.Request) bool {
+			return r.Header.Get("Authorization") == "Bearer secret"
+		}},
+		{"header", FeedAuth{Scheme: SchemeHeader, Name: "X-API-Key", Token: "secret"}, func(r *http.Request) bool {
+			return r.Header.Get("X-API-Key") == "secret" && r.Header.Get("Authorization") == ""
+		}},
+		{"query", FeedAuth{Scheme: SchemeQuery, Name: "apikey", Token: "secret"}, func(r *http.Request) bool {
+			return r.URL.Query().Get("apikey") == "secret" && r.URL.Query().Get("page") == "2"
+		}},
+	}
+
+	s := securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	users, err := NewUsers(nil, nil, "")
+	if err != nil {
+		t.Fatalf("NewUsers error: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feeds := []FeedConfig{{Name: "Books", Url: upstream.URL + "/opds", Auth: &tt.auth, UserAgent: "Reader/1.0"}}
+			feedURL := upstream.URL + "/opds?page=2"
+			a := Authorize(feedURL, httptest.NewRequest("GET", "/feed", nil), feeds, users, s)
+
+			resp, err := a.Client(http.DefaultClient).Get(feedURL)
+			if err != nil {
+				t.Fatalf("Get error: %v", err)
+			}
+			resp.Body.Close()
+
+			if !tt.check(got) {
+				t.Errorf("upstream request not authenticated: %v %v", got.URL, got.Header)
+			}
+			if ua := got.Header.Get("User-Agent"); ua != "Reader/1.0" {
+				t.Errorf("User-Agent = %q, want Reader/1.0", ua)
+			}
+			if resp.Request.URL.String() != feedURL {
+				t.Errorf("response request URL = %q, want %q", resp.Request.URL, feedURL)
+			}
+		})
+	}
+}
+
+func TestAuthorizationNotSentToOtherOrigins(t *testing.T) {
+	var leaked http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = r.Header
+	}))
+	defer other.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/cover.jpg", http.StatusFound)
+	}))
+	defer upstream.Close()
+
+	users, _ := NewUsers(nil, nil, "")
+	feeds := []FeedConfig{{Name: "Books", Url: upstream.URL, Auth: &FeedAuth{Scheme: SchemeHeader, Name: "X-API-Key", Token: "secret"}}}
+	a := Authorize(upstream.URL+"/cover", httptest.NewRequest("GET", "/image", nil), feeds, users, nil)
+
+	resp, err := a.Client(http.DefaultClient).Get(upstream.URL + "/cover")
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	resp.Body.Close()
+
+	if leaked == nil {
+		t.Fatal("redirect wasn't followed")
+	}
+	if leaked.Get("X-API-Key") != "" {
+		t.Error("token sent to another origin")
+	}
+}
+
+func TestAuthorizeUsesLongestMatchingFeed(t *testing.T) {
+	users, _ := NewUsers(nil, nil, "")
+	feeds := []FeedConfig{
+		{Name: "Comics", Url: "http://books:8080/comics", Auth: &FeedAuth{Scheme: SchemeHeader, Name: "X-API-Key"}},
+		{Name: "Library", Url: "http://books:8080/opds"},
+		{Name: "Audio", Url: "http://books:8080/opds/audio", Auth: &FeedAuth{Scheme: SchemeQuery, Name: "apikey"}, UserAgent: "Audio/1.0"},
+	}
+
+	tests := []struct {
+		url    string
+		scheme Scheme
+		ua     string
+	}{
+		{"http://books:8080/opds/audio/1", SchemeQuery, "Audio/1.0"},
+		{"http://books:8080/opds/new", SchemeBasic, ""},
+		{"http://books:8080/comics/1", SchemeHeader, ""},
+		// Outside every feed, the first feed on the origin applies
+		{"http://books:8080/cover/1", SchemeHeader, ""},
+	}
+	for _, tt := range tests {
+		a := Authorize(tt.url, httptest.NewRequest("GET", "/feed", nil), feeds, users, nil)
+		if a.Scheme != tt.scheme || a.UserAgent != tt.ua {
+			t.Errorf("Authorize(%q) = %q %q, want %q %q", tt.url, a.Scheme, a.UserAgent, tt.scheme, tt.ua)
+		}
+	}
+}
+
+func TestQuerySchemeKeepsRawQuery(t *testing.T) {
+	a := &Authorization{Scheme: SchemeQuery, Name: "api key", Credentials: &Credentials{Token: "a&b"}, origin: "http://books:80"}
+
+	req := httptest.NewRequest("GET", "http://books/opds?b=2&a=1&sig=x%2By", nil)
+	a.Apply(req)
+	if want := "b=2&a=1&sig=x%2By&api+key=a%26b"; req.URL.RawQuery != want {
+		t.Errorf("RawQuery = %q, want %q", req.URL.RawQuery, want)
+	}
+
+	req = httptest.NewRequest("GET", "http://books/opds", nil)
+	a.Apply(req)
+	if want := "api+key=a%26b"; req.URL.RawQuery != want {
+		t.Errorf("RawQuery = %q, want %q", req.URL.RawQuery, want)
+	}
+}
+
+func TestDigestAnswer(t *testing.T) {
+	// Examples from RFC 7616 section 3.9.1
+	creds := Credentials{Username: "Mufasa", Password: "Circle of Life"}
+	cnonce := "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+	tests := []struct {
+		algorithm, response string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+
+	for _, tt := range tests {
+		challenge, ok := parseDigestChallenge(`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=` + tt.algorithm +
+			`, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`)
+		if !ok {
+			t.Fatalf("%s: failed to parse challenge", tt.algorithm)
+		}
+		answer, ok := challenge.answer("GET", "/dir/index.html", creds, cnonce)
+		if !ok {
+			t.Fatalf("%s: challenge not answered", tt.algorithm)
+		}
+		if !strings.Contains(answer, `response="`+tt.response+`"`) {
+			t.Errorf("%s: answer = %s, want response %s", tt.algorithm, answer, tt.response)
+		}
+		if !strings.Contains(answer, `opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`) {
+			t.Errorf("%s: answer doesn't echo opaque: %s", tt.algorithm, answer)
+		}
+	}
+
+	if _, ok := parseDigestChallenge(`Basic realm="books"`); ok {
+		t.Error("expected basic challenge to be ignored")
+	}
+	challenge, _ := parseDigestChallenge(`Digest realm="books", nonce="abc", algorithm=SHA-512-256`)
+	if _, ok := challenge.answer("GET", "/", creds, cnonce); ok {
+		t.Error("expected unsupported algorithm to be refused")
+	}
+}
+
+func TestDigestClient(t *testing.T) {
+	creds := Credentials{Username: "user", Password: "pass"}
+	attempts := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		header := r.Header.Get("Authorization")
+		params := parseAuthParams(strings.TrimPrefix(header, "Digest "))
+		challenge := digestChallenge{realm: "books", nonce: "n0nce", qop: "auth"}
+		want, _ := challenge.answer(r.Method, r.URL.RequestURI(), creds, params["cnonce"])
+		if header == "" || header != want {
+			w.Header().Add("WWW-Authenticate", `Basic realm="books"`)
+			w.Header().Add("WWW-Authenticate", `Digest realm="books", nonce="n0nce", qop="auth"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}))
+	defer upstream.Close()
+
+	users, _ := NewUsers(nil, nil, "")
+	feeds := []FeedConfig{{Name: "Books", Url: upstream.URL, Auth: &FeedAuth{Scheme: SchemeDigest, Username: creds.Username, Password: creds.Password}}}
+	a := Authorize(upstream.URL+"/opds?page=1", httptest.NewRequest("GET", "/feed", nil), feeds, users, nil)
+
+	resp, err := a.Client(http.DefaultClient).Get(upstream.URL + "/opds?page=1")
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if attempts != 2 {
+		t.Errorf("upstream saw %d requests, want 2", attempts)
+	}
+}
@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+
+	"github.com/gorilla/securecookie"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const SessionCookieName = "session"
+
+// Sessions last 30 days, matching the securecookie default
+const sessionMaxAge = 30 * 24 * 60 * 60
+
+type User struct {
+	Username string
+	// Empty for users that only log in through a forward-auth gateway
+	PasswordHash string
+	// Names of the feeds the user may browse, all feeds when empty
+	Feeds []string
+	// Upstream credentials by feed name
+	Credentials map[string]Credentials
+}
+
+// Users holds the proxy's accounts. Without any accounts the proxy is open
+// to everyone and every feed is visible. Users can also be identified by a
+// header set by a forward-auth gateway in front of the proxy.
+type Users struct {
+	users         map[string]User
+	feeds         []FeedConfig
+	forwardHeader string
+	// Compared against for unknown usernames so they take as long as known ones
+	dummyHash []byte
+	// Credentials that already passed bcrypt. Catalog clients send basic
+	// auth with every request, checking each one would be far too slow.
+	verified sync.Map
+}
+
+// NewUsers returns the accounts for users. When forwardHeader is set, the
+// header identifies users authenticated by a gateway and accounts don't
+// need a password.
+func NewUsers(users []User, feeds []FeedConfig, forwardHeader string) (*Users, error) {
+	u := &Users{users: make(map[string]User), feeds: feeds, forwardHeader: forwardHeader}
+	hasFeed := func(name string) bool {
+		return slices.ContainsFunc(feeds, func(f FeedConfig) bool { return f.Name == name })
+	}
+
+	for _, user := range users {
+		if user.PasswordHash != "" || forwardHeader == "" {
+			if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+				return nil, fmt.Errorf("user %q: invalid bcrypt password hash: %w", user.Username, err)
+			}
+		}
+		for _, name := range user.Feeds {
+			if !hasFeed(name) {
+				return nil, fmt.Errorf("user %q: unknown feed %q", user.Username, name)
+			}
+		}
+		for name := range user.Credentials {
+			if !hasFeed(name) {
+				return nil, fmt.Errorf("user %q: credentials for unknown feed %q", user.Username, name)
+			}
+		}
+		u.users[user.Username] = user
+	}
+
+	if len(u.users) > 0 {
+		dummyHash, err := bcrypt.GenerateFromPassword([]byte("opds-proxy"), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		u.dummyHash = dummyHash
+	}
+	return u, nil
+}
+
+// Enabled reports whether any accounts are configured.
+func (u *Users) Enabled() bool {
+	return len(u.users) > 0
+}
+
+// LoginRequired reports whether requests need to identify a user, either
+// because accounts are configured or a forward-auth gateway is in use.
+func (u *Users) LoginRequired() bool {
+	return u.Enabled() || u.forwardHeader != ""
+}
+
+// Known reports whether username may use the proxy. Without configured
+// accounts anyone the gateway lets through is known.
+func (u *Users) Known(username string) bool {
+	if !u.Enabled() {
+		return username != ""
+	}
+	_, ok := u.users[username]
+	return ok
+}
+
+// Identify returns the name of the user making the request, or an empty
+// string. The forward-auth header is only believed when the request came
+// from a trusted proxy, otherwise the session cookie is checked and, when
+// accounts are configured, basic auth.
+func (u *Users) Identify(req *http.Request, s *securecookie.SecureCookie, fromTrustedProxy bool) string {
+	if u.forwardHeader != "" && fromTrustedProxy {
+		if username := req.Header.Get(u.forwardHeader); username != "" {
+			return username
+		}
+	}
+
+	if !u.Enabled() {
+		return ""
+	}
+	if user, ok := u.sessionUser(req, s); ok {
+		return user.Username
+	}
+	if username, password, ok := req.BasicAuth(); ok {
+		if user, ok := u.Authenticate(username, password); ok {
+			return user.Username
+		}
+	}
+	return ""
+}
+
+// Authenticate checks a username and password.
+func (u *Users) Authenticate(username, password string) (User, bool) {
+	user, exists := u.users[username]
+	// Gateway only accounts can't log in with a password
+	exists = exists && user.PasswordHash != ""
+
+	key := sha256.Sum256([]byte(username + "\x00" + password + "\x00" + user.PasswordHash))
+	if exists {
+		if _, ok := u.verified.Load(key); ok {
+			return user, true
+		}
+	}
+
+	hash := u.dummyHash
+	if exists {
+		hash = []byte(user.PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !exists {
+		return User{}, false
+	}
+	u.verified.Store(key, true)
+	return user, true
+}
+
+// Lookup returns the user with the given name.
+func (u *Users) Lookup(username string) (User, bool) {
+	user, ok := u.users[username]
+	return user, ok
+}
+
+// feedCredentials returns the user's own upstream credentials for a feed.
+func (u *Users) feedCredentials(username, feedName string) *Credentials {
+	creds, ok := u.users[username].Credentials[feedName]
+	if !ok {
+		return nil
+	}
+	return &creds
+}
+
+// CanAccess reports whether the user may browse the named feed.
+func (u *Users) CanAccess(username, feedName string) bool {
+	if !u.Enabled() {
+		return true
+	}
+	user, ok := u.users[username]
+	if !ok {
+		return false
+	}
+	return len(user.Feeds) == 0 || slices.Contains(user.Feeds, feedName)
+}
+
+// CanFetch reports whether the user may fetch rawURL through the proxy. URLs
+// on the origin of a configured feed need access to one of the feeds on that
+// origin. Other origins are only reachable when allowed_hosts permits them and
+// aren't restricted per user.
+func (u *Users) CanFetch(username, rawURL string) bool {
+	if !u.Enabled() {
+		return true
+	}
+	if _, ok := u.users[username]; !ok {
+		return false
+	}
+
+	requestUrl, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	feedOrigin := false
+	for _, feed := range u.feeds {
+		feedUrl, err := url.Parse(feed.Url)
+		if err != nil || Origin(feedUrl) != Origin(requestUrl) {
+			continue
+		}
+		feedOrigin = true
+		if u.CanAccess(username, feed.Name) {
+			return true
+		}
+	}
+	return !feedOrigin
+}
+
+// SetSession logs the user in by setting the session cookie.
+func SetSession(w http.ResponseWriter, s *securecookie.SecureCookie, username string) error {
+	encoded, err := s.Encode(SessionCookieName, username)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   SessionCookieName,
+		Value:  encoded,
+		Path:   "/",
+		MaxAge: sessionMaxAge,
+		// Kobo fails to set cookies with HttpOnly or Secure flags
+		Secure:   false,
+		HttpOnly: false,
+	})
+	return nil
+}
+
+// sessionUser returns the user logged in with the session cookie.
+func (u *Users) sessionUser(req *http.Request, s *securecookie.SecureCookie) (User, bool) {
+	cookie, err := req.Cookie(SessionCookieName)
+	if err != nil {
+		return User{}, false
+	}
+
+	var username string
+	if err := s.Decode(SessionCookieName, cookie.Value, &username); err != nil {
+		return User{}, false
+	}
+	// Removed accounts lose access straight away
+	return u.Lookup(username)
+}
+
+// HasSession reports whether the request carries a session cookie that
+// ClearSession can remove.
+func HasSession(req *http.Request) bool {
+	_, err := req.Cookie(SessionCookieName)
+	return err == nil
+}
+
+// ClearSession logs the user out of the proxy.
+func ClearSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: SessionCookieName, Path: "/", MaxAge: -1})
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/evan-buss/opds-proxy/internal/reqctx"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testUsers(t *testing.T) *Users {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hash password: %v", err)
+	}
+	feeds := []FeedConfig{
+		{Name: "Calibre", Url: "http://calibre:8083/opds"},
+		{Name: "Kids", Url: "http://kids:8083/opds"},
+	}
+	users, err := NewUsers([]User{
+		{Username: "alice", PasswordHash: string(hash)},
+		{Username: "bob", PasswordHash: string(hash), Feeds: []string{"Kids"}},
+		{Username: "carol", Credentials: map[string]Credentials{"Calibre": {Username: "carol", Password: "calibre"}}},
+	}, feeds, "Remote-User")
+	if err != nil {
+		t.Fatalf("NewUsers error: %v", err)
+	}
+	return users
+}
+
+func TestAuthenticate(t *testing.T) {
+	users := testUsers(t)
+
+	for range 2 {
+		if _, ok := users.Authenticate("alice", "secret"); !ok {
+			t.Error("expected valid credentials to authenticate")
+		}
+	}
+	if _, ok := users.Authenticate("alice", "wrong"); ok {
+		t.Error("expected wrong password to fail")
+	}
+	if _, ok := users.Authenticate("mallory", "secret"); ok {
+		t.Error("expected unknown user to fail")
+	}
+	if _, ok := users.Authenticate("carol", ""); ok {
+		t.Error("expected gateway only user not to log in with a password")
+	}
+}
+
+func TestFeedAccess(t *testing.T) {
+	users := testUsers(t)
+
+	tests := []struct {
+		username, url string
+		want          bool
+	}{
+		{"alice", "http://calibre:8083/opds/books", true},
+		{"bob", "http://kids:8083/opds/books", true},
+		{"bob", "http://calibre:8083/opds/books", false},
+		{"bob", "HTTP://Calibre:8083/opds/books", false},
+		{"bob", "http://covers.example.com/1.jpg", true},
+		{"", "http://kids:8083/opds", false},
+	}
+	for _, tt := range tests {
+		if got := users.CanFetch(tt.username, tt.url); got != tt.want {
+			t.Errorf("CanFetch(%q, %q) = %v, want %v", tt.username, tt.url, got, tt.want)
+		}
+	}
+
+	if users.CanAccess("bob", "Calibre") || !users.CanAccess("bob", "Kids") {
+		t.Error("expected bob to only see the Kids feed")
+	}
+
+	open, err := NewUsers(nil, nil, "")
+	if err != nil {
+		t.Fatalf("NewUsers error: %v", err)
+	}
+	if !open.CanFetch("", "http://calibre:8083/opds") || !open.CanAccess("", "Calibre") {
+		t.Error("expected everything to be accessible without accounts")
+	}
+}
+
+func TestNewUsersValidates(t *testing.T) {
+	if _, err := NewUsers([]User{{Username: "alice", PasswordHash: "plaintext"}}, nil, ""); err == nil {
+		t.Error("expected an error for a password that isn't a bcrypt hash")
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if _, err := NewUsers([]User{{Username: "alice", PasswordHash: string(hash), Feeds: []string{"Missing"}}}, nil, ""); err == nil {
+		t.Error("expected an error for an unknown feed")
+	}
+	if _, err := NewUsers([]User{{Username: "alice"}}, nil, ""); err == nil {
+		t.Error("expected a password to be required without forward auth")
+	}
+}
+
+func TestSession(t *testing.T) {
+	users := testUsers(t)
+	s := securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+
+	rec := httptest.NewRecorder()
+	if err := SetSession(rec, s, "bob"); err != nil {
+		t.Fatalf("SetSession error: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if got := users.Identify(req, s, false); got != "bob" {
+		t.Errorf("expected session for bob, got %q", got)
+	}
+
+	forged := httptest.NewRequest("GET", "/", nil)
+	forged.Header.Set("Cookie", SessionCookieName+"=bob")
+	if got := users.Identify(forged, s, false); got != "" {
+		t.Errorf("expected a forged session to be rejected, got %q", got)
+	}
+}
+
+func TestIdentifyForwardAuth(t *testing.T) {
+	users := testUsers(t)
+	s := securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Remote-User", "carol")
+	if got := users.Identify(req, s, true); got != "carol" {
+		t.Errorf("expected header from trusted proxy to identify carol, got %q", got)
+	}
+	if got := users.Identify(req, s, false); got != "" {
+		t.Errorf("expected header from untrusted client to be ignored, got %q", got)
+	}
+
+	basic := httptest.NewRequest("GET", "/", nil)
+	basic.SetBasicAuth("alice", "secret")
+	if got := users.Identify(basic, s, true); got != "alice" {
+		t.Errorf("expected basic auth to identify alice, got %q", got)
+	}
+}
+
+func TestUserCredentials(t *testing.T) {
+	users := testUsers(t)
+	feeds := []FeedConfig{
+		{Name: "Calibre", Url: "http://calibre:8083/opds", Auth: &FeedAuth{Username: "shared", Password: "shared"}},
+	}
+	s := securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if creds := GetCredentials("http://calibre:8083/opds/books", req.WithContext(reqctx.WithUser(req.Context(), "carol")), feeds, users, s); creds == nil || creds.Username != "carol" {
+		t.Errorf("expected carol's own credentials, got %+v", creds)
+	}
+	if creds := GetCredentials("http://calibre:8083/opds/books", req.WithContext(reqctx.WithUser(req.Context(), "alice")), feeds, users, s); creds == nil || creds.Username != "shared" {
+		t.Errorf("expected the feed's shared credentials, got %+v", creds)
+	}
+}
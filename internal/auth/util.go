@@ -1,8 +1,10 @@
 package auth
 
 import (
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/evan-buss/opds-proxy/internal/reqctx"
 	"github.com/gorilla/securecookie"
@@ -11,15 +13,98 @@ import (
 type Credentials struct {
 	Username string
 	Password string
+	// API key for token schemes, the password is used when it's empty
+	Token string
+}
+
+// secret returns what token schemes send.
+func (c Credentials) secret() string {
+	if c.Token != "" {
+		return c.Token
+	}
+	return c.Password
 }
 
 const CookieName = "auth-creds"
 
-func GetCredentials(rawUrl string, req *http.Request, feeds []FeedConfig, s *securecookie.SecureCookie) *Credentials {
+// CookieCodecName returns the name credential cookies are signed with. It
+// includes the logged in user so one user's cookie is useless to another.
+func CookieCodecName(username string) string {
+	if username == "" {
+		return CookieName
+	}
+	return CookieName + ":" + username
+}
+
+// Origin returns the scheme, host and port credentials for u are stored
+// under, so servers on different ports of the same host are kept apart.
+func Origin(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	port := u.Port()
+	if port == "" {
+		switch scheme {
+		case "https":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// StoredCredentials returns the credentials in the request's cookie by origin.
+func StoredCredentials(req *http.Request, s *securecookie.SecureCookie) map[string]Credentials {
+	value := make(map[string]Credentials)
+
+	cookie, err := req.Cookie(CookieName)
+	if err != nil {
+		return value
+	}
+	if err := s.Decode(CookieCodecName(reqctx.User(req.Context())), cookie.Value, &value); err != nil {
+		return make(map[string]Credentials)
+	}
+	return value
+}
+
+// StoreCredentials writes the credentials cookie, removing it when there
+// are no credentials left.
+func StoreCredentials(w http.ResponseWriter, req *http.Request, s *securecookie.SecureCookie, value map[string]Credentials) error {
+	cookie := &http.Cookie{
+		Name: CookieName,
+		Path: "/",
+		// Kobo fails to set cookies with HttpOnly or Secure flags
+		Secure:   false,
+		HttpOnly: false,
+	}
+
+	if len(value) == 0 {
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+		return nil
+	}
+
+	encoded, err := s.Encode(CookieCodecName(reqctx.User(req.Context())), value)
+	if err != nil {
+		return err
+	}
+	cookie.Value = encoded
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// AddCredentials stores creds for origin alongside the other stored logins.
+func AddCredentials(w http.ResponseWriter, req *http.Request, s *securecookie.SecureCookie, origin string, creds Credentials) error {
+	value := StoredCredentials(req, s)
+	value[origin] = creds
+	return StoreCredentials(w, req, s, value)
+}
+
+func GetCredentials(rawUrl string, req *http.Request, feeds []FeedConfig, users *Users, s *securecookie.SecureCookie) *Credentials {
 	requestUrl, err := url.Parse(rawUrl)
 	if err != nil {
 		return nil
 	}
+	username := reqctx.User(req.Context())
 
 	// Try to get credentials from the config first
 	for _, feed := range feeds {
@@ -28,12 +113,17 @@ func GetCredentials(rawUrl string, req *http.Request, feeds []FeedConfig, s *sec
 			continue
 		}
 
-		if feedUrl.Hostname() != requestUrl.Hostname() {
+		if Origin(feedUrl) != Origin(requestUrl) {
 			continue
 		}
 
+		// The user's own credentials take precedence over the feed's shared ones
+		if creds := users.feedCredentials(username, feed.Name); creds != nil {
+			return creds
+		}
+
 		cfg := feed.Auth
-		if cfg == nil || cfg.Username == "" || cfg.Password == "" {
+		if cfg == nil || (cfg.Token == "" && (cfg.Username == "" || cfg.Password == "")) {
 			continue
 		}
 
@@ -44,31 +134,29 @@ func GetCredentials(rawUrl string, req *http.Request, feeds []FeedConfig, s *sec
 			continue
 		}
 
-		return &Credentials{Username: cfg.Username, Password: cfg.Password}
+		return &Credentials{Username: cfg.Username, Password: cfg.Password, Token: cfg.Token}
 	}
 
 	// Otherwise, try to get credentials from the cookie
-	cookie, err := req.Cookie(CookieName)
-	if err != nil {
-		return nil
+	if creds, ok := StoredCredentials(req, s)[Origin(requestUrl)]; ok {
+		return &creds
 	}
-
-	value := make(map[string]*Credentials)
-	if err = s.Decode(CookieName, cookie.Value, &value); err != nil {
-		return nil
-	}
-
-	return value[requestUrl.Hostname()]
+	return nil
 }
 
 type FeedAuth struct {
+	Scheme Scheme
+	// Header or query parameter name for the header and query schemes
+	Name      string
 	Username  string
 	Password  string
+	Token     string
 	LocalOnly bool
 }
 
 type FeedConfig struct {
-	Name string
-	Url  string
-	Auth *FeedAuth
+	Name      string
+	Url       string
+	Auth      *FeedAuth
+	UserAgent string
 }
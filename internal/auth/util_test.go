@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestOrigin(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"http://calibre:8083/opds", "http://calibre:8083"},
+		{"http://Calibre/opds", "http://calibre:80"},
+		{"https://books.example.com/opds", "https://books.example.com:443"},
+		{"http://[::1]:8080/", "http://[::1]:8080"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := Origin(u); got != tt.want {
+			t.Errorf("Origin(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestAddCredentialsKeepsOtherLogins(t *testing.T) {
+	s := securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	users, err := NewUsers(nil, nil, "")
+	if err != nil {
+		t.Fatalf("NewUsers error: %v", err)
+	}
+
+	// Two servers on the same host only differ by port
+	first := httptest.NewRecorder()
+	if err := AddCredentials(first, httptest.NewRequest("POST", "/auth", nil), s, "http://calibre:8083", Credentials{Username: "a"}); err != nil {
+		t.Fatalf("AddCredentials error: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/auth", nil)
+	req.AddCookie(first.Result().Cookies()[0])
+	second := httptest.NewRecorder()
+	if err := AddCredentials(second, req, s, "http://calibre:8084", Credentials{Username: "b"}); err != nil {
+		t.Fatalf("AddCredentials error: %v", err)
+	}
+
+	req = httptest.NewRequest("GET", "/feed", nil)
+	req.AddCookie(second.Result().Cookies()[0])
+	for rawUrl, want := range map[string]string{"http://calibre:8083/opds": "a", "http://calibre:8084/opds": "b"} {
+		if creds := GetCredentials(rawUrl, req, nil, users, s); creds == nil || creds.Username != want {
+			t.Errorf("GetCredentials(%q) = %+v, want user %q", rawUrl, creds, want)
+		}
+	}
+	if creds := GetCredentials("http://calibre:8085/opds", req, nil, users, s); creds != nil {
+		t.Errorf("expected no credentials for another port, got %+v", creds)
+	}
+}
@@ -0,0 +1,130 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Headers the client address can be read from when behind a proxy
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded"
+)
+
+// Resolver determines the address of the client that made a request.
+// Forwarding headers are only honoured for hops added by trusted proxies,
+// anyone else can put whatever they like in them.
+type Resolver struct {
+	trusted []netip.Prefix
+	header  string
+}
+
+// New returns a resolver that trusts proxies within the given CIDR ranges or
+// addresses and reads the forwarded chain from header, either
+// X-Forwarded-For or Forwarded. An empty header defaults to X-Forwarded-For.
+func New(trustedProxies []string, header string) (*Resolver, error) {
+	r := &Resolver{header: HeaderXForwardedFor}
+
+	switch {
+	case header == "" || strings.EqualFold(header, HeaderXForwardedFor):
+	case strings.EqualFold(header, HeaderForwarded):
+		r.header = HeaderForwarded
+	default:
+		return nil, fmt.Errorf("unsupported client IP header %q, expected %s or %s", header, HeaderXForwardedFor, HeaderForwarded)
+	}
+
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q, expected an IP address or CIDR range", proxy)
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		r.trusted = append(r.trusted, prefix.Masked())
+	}
+
+	return r, nil
+}
+
+// ClientIP returns the address of the client. The forwarded chain is walked
+// from right to left starting at the connection's peer, and the first hop
+// that isn't a trusted proxy is the client. Malformed hops end the walk at
+// the proxy that reported them. The result is invalid if the peer address
+// can't be parsed.
+func (r *Resolver) ClientIP(req *http.Request) netip.Addr {
+	addr, ok := parseHop(req.RemoteAddr)
+	if !ok {
+		return netip.Addr{}
+	}
+
+	hops := r.hops(req.Header)
+	for i := len(hops) - 1; i >= 0 && r.isTrusted(addr); i-- {
+		hop, ok := parseHop(hops[i])
+		if !ok {
+			break
+		}
+		addr = hop
+	}
+	return addr
+}
+
+// IsTrustedProxy reports whether the request came directly from a trusted
+// proxy, so headers it sets can be believed.
+func (r *Resolver) IsTrustedProxy(req *http.Request) bool {
+	addr, ok := parseHop(req.RemoteAddr)
+	return ok && r.isTrusted(addr)
+}
+
+func (r *Resolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// hops returns the forwarded addresses in the order proxies appended them.
+func (r *Resolver) hops(header http.Header) []string {
+	var hops []string
+	for _, line := range header.Values(r.header) {
+		for element := range strings.SplitSeq(line, ",") {
+			if r.header == HeaderXForwardedFor {
+				hops = append(hops, strings.TrimSpace(element))
+				continue
+			}
+			hops = append(hops, forwardedFor(element))
+		}
+	}
+	return hops
+}
+
+// forwardedFor returns the for parameter of a Forwarded header element (RFC 7239).
+func forwardedFor(element string) string {
+	for pair := range strings.SplitSeq(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(key, "for") {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// parseHop parses an address with an optional port, IPv6 addresses may be bracketed.
+func parseHop(hop string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(hop, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
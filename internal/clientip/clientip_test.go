@@ -0,0 +1,83 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		values     []string
+		want       string
+	}{
+		{"no proxy", "", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"spoofed from untrusted peer", "", "203.0.113.7:1234", []string{"10.0.0.1"}, "203.0.113.7"},
+		{"trusted proxy", "", "10.0.0.2:1234", []string{"198.51.100.9"}, "198.51.100.9"},
+		{"client prepends spoofed hop", "", "10.0.0.2:1234", []string{"10.0.0.1, 198.51.100.9"}, "198.51.100.9"},
+		{"chain of trusted proxies", "", "10.0.0.2:1234", []string{"198.51.100.9, 10.0.0.3"}, "198.51.100.9"},
+		{"multiple header lines", "", "10.0.0.2:1234", []string{"192.0.2.1", "198.51.100.9"}, "198.51.100.9"},
+		{"only trusted hops", "", "10.0.0.2:1234", []string{"10.0.0.3"}, "10.0.0.3"},
+		{"malformed hop", "", "10.0.0.2:1234", []string{"10.0.0.1, garbage"}, "10.0.0.2"},
+		{"single trusted address", "", "192.168.1.5:1234", []string{"198.51.100.9"}, "198.51.100.9"},
+		{"ipv6 peer", "", "[2001:db8::1]:1234", []string{"10.0.0.1"}, "2001:db8::1"},
+		{"forwarded", "Forwarded", "10.0.0.2:1234", []string{`for=10.0.0.1, for="[2001:db8::17]:4711";proto=https`}, "2001:db8::17"},
+		{"forwarded ignores x-forwarded-for", "Forwarded", "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"forwarded obfuscated", "Forwarded", "10.0.0.2:1234", []string{"for=_hidden"}, "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New([]string{"10.0.0.0/8", "192.168.1.5"}, tt.header)
+			if err != nil {
+				t.Fatalf("New error: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.values {
+				req.Header.Add(r.header, v)
+			}
+			// Only the configured header is read
+			req.Header.Set("X-Real-IP", "10.9.9.9")
+			if r.header == HeaderForwarded {
+				req.Header.Set(HeaderXForwardedFor, "10.9.9.9")
+			}
+
+			if got := r.ClientIP(req); got.String() != tt.want {
+				t.Errorf("ClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	if _, err := New([]string{"not-an-ip"}, ""); err == nil {
+		t.Error("expected an error for an invalid trusted proxy")
+	}
+	if _, err := New(nil, "X-Real-IP"); err == nil {
+		t.Error("expected an error for an unsupported header")
+	}
+}
+
+func TestIsTrustedProxy(t *testing.T) {
+	r, err := New([]string{"10.0.0.0/8"}, "")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	if !r.IsTrustedProxy(req) {
+		t.Error("expected peer in a trusted range to be trusted")
+	}
+
+	// The forwarded chain doesn't matter, only the direct peer
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set(HeaderXForwardedFor, "10.0.0.2")
+	if r.IsTrustedProxy(req) {
+		t.Error("expected untrusted peer not to be trusted")
+	}
+}
@@ -1,46 +1,228 @@
 package debounce
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"io"
+	"maps"
 	"net"
 	"net/http"
-	"net/http/httptest"
-	"strconv"
+	"sync"
 	"time"
 
-	"github.com/evan-buss/opds-proxy/internal/cache"
-	"github.com/evan-buss/opds-proxy/internal/httpx"
-	"golang.org/x/sync/singleflight"
+	"github.com/evan-buss/opds-proxy/internal/reqctx"
 )
 
+// Responses larger than this are spilled to a temporary file
+const memoryLimit = 1 << 20
+
+// NewDebounceMiddleware coalesces identical requests from the same client.
+// The first request is handled normally and its response is streamed straight
+// to the client while also being recorded. Concurrent duplicates, and duplicates
+// arriving within the debounce window afterwards, replay the recorded response
+// as it is being written instead of running the handler again. Clients are
+// told apart by the address resolved by the request middleware, falling back
+// to the connection's peer address, and by the logged in user. Only GET and
+// HEAD requests are coalesced, form submissions always run the handler.
+//
+// The first request's handler is only canceled once its client went away
+// and no duplicate is waiting for the response.
 func NewDebounceMiddleware(debounce time.Duration) func(next http.HandlerFunc) http.HandlerFunc {
-	responseCache := cache.NewCache[httptest.ResponseRecorder](cache.CacheConfig{CleanupInterval: time.Second, TTL: debounce})
-	singleflight := singleflight.Group{}
+	var mutex sync.Mutex
+	inflight := make(map[string]*sharedResponse)
 
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
-			ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-			hash := md5.Sum([]byte(ip + r.URL.Path + r.URL.RawQuery))
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				next(w, r)
+				return
+			}
+
+			var ip string
+			if addr, ok := reqctx.ClientIP(r.Context()); ok {
+				ip = addr.String()
+			} else {
+				ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+			}
+			hash := md5.Sum([]byte(r.Method + ip + reqctx.User(r.Context()) + r.URL.Path + r.URL.RawQuery + r.Header.Get("Range")))
 			key := string(hex.EncodeToString(hash[:]))
 
-			if entry, exists := responseCache.Get(key); exists {
-				w.Header().Set("X-Debounce", "true")
-				httpx.WriteRecorder(entry, w)
+			mutex.Lock()
+			if shared, exists := inflight[key]; exists {
+				shared.readers++
+				mutex.Unlock()
+
+				if shared.isDone() {
+					w.Header().Set("X-Debounce", "true")
+				} else {
+					w.Header().Set("X-Shared", "true")
+				}
+				shared.replay(w)
+
+				mutex.Lock()
+				shared.readers--
+				shared.cancelIfUnused()
+				shared.releaseIfUnused()
+				mutex.Unlock()
 				return
 			}
 
-			rw, _, shared := singleflight.Do(key, func() (interface{}, error) {
-				rw := httptest.NewRecorder()
-				next(rw, r)
-				return rw, nil
+			ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+			defer cancel()
+			shared := newSharedResponse()
+			shared.readers++
+			shared.cancel = cancel
+			inflight[key] = shared
+			mutex.Unlock()
+
+			stop := context.AfterFunc(r.Context(), func() {
+				mutex.Lock()
+				defer mutex.Unlock()
+				shared.clientGone = true
+				shared.cancelIfUnused()
 			})
+			defer stop()
+
+			w.Header().Set("X-Shared", "false")
+			tee := &teeWriter{w: w, shared: shared}
+
+			// Deferred so duplicates aren't left waiting if the handler panics
+			defer func() {
+				tee.finish()
+
+				mutex.Lock()
+				shared.readers--
+				mutex.Unlock()
+
+				time.AfterFunc(debounce, func() {
+					mutex.Lock()
+					defer mutex.Unlock()
+					if inflight[key] == shared {
+						delete(inflight, key)
+					}
+					shared.expired = true
+					shared.releaseIfUnused()
+				})
+			}()
+
+			next(tee, r.WithContext(ctx))
+		}
+	}
+}
 
-			recorder := rw.(*httptest.ResponseRecorder)
-			responseCache.Set(key, recorder)
+// sharedResponse is a response recorded by the first request for a key.
+// Fields other than the header and body are guarded by the middleware's mutex.
+type sharedResponse struct {
+	header      http.Header
+	code        int
+	headerReady chan struct{}
+	body        *spillBuffer
+	done        chan struct{}
+	readers     int
+	expired     bool
+	clientGone  bool // the first request's client went away
+	cancel      context.CancelFunc
+}
+
+func newSharedResponse() *sharedResponse {
+	return &sharedResponse{
+		headerReady: make(chan struct{}),
+		body:        newSpillBuffer(memoryLimit),
+		done:        make(chan struct{}),
+	}
+}
 
-			w.Header().Set("X-Shared", strconv.FormatBool(shared))
-			httpx.WriteRecorder(recorder, w)
+func (s *sharedResponse) isDone() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// replay streams the recorded response to w, waiting for more of the body as needed.
+func (s *sharedResponse) replay(w http.ResponseWriter) {
+	<-s.headerReady
+	for k, v := range s.header {
+		if k == "X-Shared" || k == "X-Debounce" {
+			continue
 		}
+		w.Header()[k] = v
+	}
+	w.WriteHeader(s.code)
+	_, _ = io.Copy(w, s.body.reader())
+}
+
+// cancelIfUnused cancels the first request's handler once its client went
+// away and only the handler itself is left reading.
+func (s *sharedResponse) cancelIfUnused() {
+	if s.clientGone && s.readers <= 1 {
+		s.cancel()
+	}
+}
+
+func (s *sharedResponse) releaseIfUnused() {
+	if s.expired && s.readers == 0 {
+		s.body.Release()
+	}
+}
+
+// teeWriter writes the response to the primary client and records it for duplicates.
+type teeWriter struct {
+	w           http.ResponseWriter
+	shared      *sharedResponse
+	wroteHeader bool
+	clientGone  bool
+}
+
+func (t *teeWriter) Header() http.Header {
+	return t.w.Header()
+}
+
+func (t *teeWriter) WriteHeader(code int) {
+	if t.wroteHeader {
+		return
+	}
+	t.wroteHeader = true
+	t.shared.header = maps.Clone(t.w.Header())
+	t.shared.code = code
+	close(t.shared.headerReady)
+	t.w.WriteHeader(code)
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+	if _, err := t.shared.body.Write(p); err != nil {
+		return 0, err
+	}
+
+	// Keep recording for duplicates even if the primary client went away
+	if !t.clientGone {
+		if _, err := t.w.Write(p); err != nil {
+			t.clientGone = true
+		}
+	}
+	return len(p), nil
+}
+
+func (t *teeWriter) Flush() {
+	if f, ok := t.w.(http.Flusher); ok && !t.clientGone {
+		f.Flush()
+	}
+}
+
+func (t *teeWriter) Unwrap() http.ResponseWriter {
+	return t.w
+}
+
+func (t *teeWriter) finish() {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
 	}
+	t.shared.body.Close()
+	close(t.shared.done)
 }
@@ -1,6 +1,8 @@
 package debounce
 
 import (
+	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"sync"
@@ -104,3 +106,151 @@ func TestDebounceMiddleware(t *testing.T) {
 		}
 	})
 }
+
+func TestDebounceStreaming(t *testing.T) {
+	release := make(chan struct{})
+	firstChunk := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write([]byte("first "))
+		close(firstChunk)
+		<-release
+		w.Write([]byte("second"))
+	})
+	wrappedHandler := NewDebounceMiddleware(500 * time.Millisecond)(handler)
+
+	primary := httptest.NewRecorder()
+	primaryDone := make(chan struct{})
+	go func() {
+		wrappedHandler.ServeHTTP(primary, httptest.NewRequest("GET", "/book", nil))
+		close(primaryDone)
+	}()
+
+	<-firstChunk
+	// The primary client receives data before the handler has finished
+	if got := primary.Body.String(); got != "first " {
+		t.Fatalf("expected first chunk to be streamed, got %q", got)
+	}
+
+	follower := httptest.NewRecorder()
+	followerDone := make(chan struct{})
+	go func() {
+		wrappedHandler.ServeHTTP(follower, httptest.NewRequest("GET", "/book", nil))
+		close(followerDone)
+	}()
+
+	close(release)
+	<-primaryDone
+	<-followerDone
+
+	if got := follower.Body.String(); got != "first second" {
+		t.Fatalf("unexpected follower body %q", got)
+	}
+	if got := follower.Header().Get("Content-Type"); got != "application/pdf" {
+		t.Fatalf("unexpected follower content type %q", got)
+	}
+}
+
+func TestSpillBuffer(t *testing.T) {
+	b := newSpillBuffer(4)
+	defer b.Release()
+
+	b.Write([]byte("abc"))
+	if b.file != nil {
+		t.Fatalf("expected small writes to stay in memory")
+	}
+	b.Write([]byte("defgh"))
+	if b.file == nil {
+		t.Fatalf("expected buffer to spill to disk")
+	}
+	b.Close()
+
+	got, err := io.ReadAll(b.reader())
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != "abcdefgh" {
+		t.Fatalf("unexpected content %q", got)
+	}
+}
+
+func TestDebounceCancellation(t *testing.T) {
+	canceled := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial "))
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-release:
+			w.Write([]byte("done"))
+		}
+	})
+	wrappedHandler := NewDebounceMiddleware(time.Millisecond)(handler)
+
+	t.Run("Abandoned", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			wrappedHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abandoned", nil).WithContext(ctx))
+			close(done)
+		}()
+		cancel()
+
+		select {
+		case <-canceled:
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected the handler to be canceled once its client went away")
+		}
+		<-done
+	})
+
+	t.Run("Shared", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		primaryDone := make(chan struct{})
+		go func() {
+			wrappedHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/shared", nil).WithContext(ctx))
+			close(primaryDone)
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		follower := httptest.NewRecorder()
+		followerDone := make(chan struct{})
+		go func() {
+			wrappedHandler.ServeHTTP(follower, httptest.NewRequest("GET", "/shared", nil))
+			close(followerDone)
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		// The follower still waits for the response, so the handler keeps going
+		cancel()
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+		<-primaryDone
+		<-followerDone
+
+		if got := follower.Body.String(); got != "partial done" {
+			t.Fatalf("unexpected follower body %q", got)
+		}
+	})
+}
+
+func TestDebounceOnlyCoalescesReads(t *testing.T) {
+	calls := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(r.Method))
+	})
+	wrappedHandler := NewDebounceMiddleware(500 * time.Millisecond)(handler)
+
+	for _, method := range []string{"POST", "POST", "GET", "HEAD"} {
+		rec := httptest.NewRecorder()
+		wrappedHandler.ServeHTTP(rec, httptest.NewRequest(method, "/pair", nil))
+		if method != "HEAD" && rec.Body.String() != method {
+			t.Errorf("%s got the response %q", method, rec.Body.String())
+		}
+	}
+	if calls != 4 {
+		t.Errorf("handler called %d times, want every request handled", calls)
+	}
+}
@@ -0,0 +1,123 @@
+package debounce
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// spillBuffer is an append-only buffer that can be read by several readers
+// while it is still being written. It is held in memory until it grows past
+// limit and then moves to a temporary file so large downloads aren't kept
+// in memory.
+type spillBuffer struct {
+	mem    []byte
+	file   *os.File
+	size   int64
+	limit  int
+	closed bool
+	mutex  sync.Mutex
+	cond   *sync.Cond
+}
+
+func newSpillBuffer(limit int) *spillBuffer {
+	b := &spillBuffer{limit: limit}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	defer b.cond.Broadcast()
+
+	if b.file == nil && len(b.mem)+len(p) > b.limit {
+		file, err := os.CreateTemp("", "opds-proxy-debounce-*")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := file.Write(b.mem); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return 0, err
+		}
+		b.file = file
+		b.mem = nil
+	}
+
+	if b.file != nil {
+		n, err := b.file.WriteAt(p, b.size)
+		b.size += int64(n)
+		return n, err
+	}
+
+	b.mem = append(b.mem, p...)
+	b.size += int64(len(p))
+	return len(p), nil
+}
+
+// ReadAt reads from the buffer at off, blocking until data is available
+// or the buffer is closed.
+func (b *spillBuffer) ReadAt(p []byte, off int64) (int, error) {
+	b.mutex.Lock()
+	for off >= b.size && !b.closed {
+		b.cond.Wait()
+	}
+	if off >= b.size {
+		b.mutex.Unlock()
+		return 0, io.EOF
+	}
+
+	available := b.size - off
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+
+	if b.file == nil {
+		n := copy(p, b.mem[off:])
+		b.mutex.Unlock()
+		return n, nil
+	}
+
+	file := b.file
+	b.mutex.Unlock()
+	return file.ReadAt(p, off)
+}
+
+// Close marks the end of the written data and wakes up waiting readers.
+func (b *spillBuffer) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+	return nil
+}
+
+// Release frees the buffer and removes its temporary file.
+// It must only be called once there are no more readers.
+func (b *spillBuffer) Release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.file = nil
+	}
+	b.mem = nil
+}
+
+// reader returns an io.Reader that streams the buffer from the start.
+func (b *spillBuffer) reader() io.Reader {
+	return &spillReader{b: b}
+}
+
+type spillReader struct {
+	b   *spillBuffer
+	off int64
+}
+
+func (r *spillReader) Read(p []byte) (int, error) {
+	n, err := r.b.ReadAt(p, r.off)
+	r.off += int64(n)
+	return n, err
+}
@@ -15,6 +15,15 @@ const (
 	DeviceOther  DeviceType = "other"
 )
 
+// ParseDeviceType returns the device type with the given name
+func ParseDeviceType(name string) (DeviceType, bool) {
+	switch d := DeviceType(strings.ToLower(name)); d {
+	case DeviceKobo, DeviceKindle, DeviceOther:
+		return d, true
+	}
+	return "", false
+}
+
 // DetectDevice determines the device type based on the user agent string
 func DetectDevice(userAgent string) DeviceType {
 	if strings.Contains(userAgent, "Kobo") {
@@ -28,12 +37,27 @@ func DetectDevice(userAgent string) DeviceType {
 
 // GetPreferredFormat returns the preferred MIME type for this device type
 func (d DeviceType) GetPreferredFormat() formats.Format {
+	if targets := d.ConversionTargets(); len(targets) > 0 {
+		return targets[0]
+	}
+	return formats.EPUB // Default to EPUB
+}
+
+// ConversionTargets returns the formats files are converted to for this
+// device type in order of preference. Other devices get the original file.
+func (d DeviceType) ConversionTargets() []formats.Format {
 	switch d {
 	case DeviceKobo:
-		return formats.KEPUB // KEPUB is EPUB-based
+		return []formats.Format{formats.KEPUB, formats.EPUB} // KEPUB is EPUB-based
 	case DeviceKindle:
-		return formats.MOBI
+		return []formats.Format{formats.AZW3, formats.MOBI}
 	default:
-		return formats.EPUB // Default to EPUB
+		return nil
 	}
 }
+
+// IsEInk reports whether the device has an e-ink screen.
+// Color e-ink models can't be told apart by their user agent.
+func (d DeviceType) IsEInk() bool {
+	return d == DeviceKobo || d == DeviceKindle
+}
@@ -0,0 +1,253 @@
+package feedcache
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/filecache"
+)
+
+// Cache is a size-capped, least recently used store of upstream feed
+// responses kept in memory. Responses are fresh for as long as the upstream
+// Cache-Control or Expires headers allow, or for the feed's TTL when they
+// say nothing. Stale responses are revalidated with their ETag or
+// Last-Modified, and served as is when the upstream is failing.
+type Cache struct {
+	maxBytes   int64
+	defaultTTL time.Duration
+	feedTTLs   map[string]time.Duration
+	entries    map[string]*list.Element
+	order      *list.List // front is the most recently used entry
+	size       int64
+	mutex      sync.Mutex
+	now        func() time.Time
+}
+
+type entry struct {
+	key     string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// New returns a cache holding up to maxBytes of response bodies. feedTTLs
+// sets the TTL of URLs starting with a feed's URL, other URLs use defaultTTL.
+func New(maxBytes int64, defaultTTL time.Duration, feedTTLs map[string]time.Duration) *Cache {
+	return &Cache{
+		maxBytes:   maxBytes,
+		defaultTTL: defaultTTL,
+		feedTTLs:   feedTTLs,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+// Key returns the cache key for rawURL fetched by the proxy user with
+// creds, so responses are never shared between different logins.
+func Key(rawURL string, user string, creds *auth.Credentials) string {
+	if creds == nil {
+		return filecache.Key(rawURL, user)
+	}
+	return filecache.Key(rawURL, user, creds.Username, creds.Password, creds.Token)
+}
+
+// Fetch returns the response for rawURL, from the cache while it's fresh.
+// Otherwise fetch is called, with the conditional headers to revalidate
+// the stored response if there is one. Successful responses that pass
+// cacheable are stored. A nil cache always calls fetch.
+func (c *Cache) Fetch(rawURL, key string, fetch func(header http.Header) (*http.Response, error), cacheable func(*http.Response) bool) (*http.Response, error) {
+	if c == nil {
+		return fetch(nil)
+	}
+
+	stored, ok := c.get(key)
+	if ok && c.now().Before(stored.expires) {
+		return stored.response(), nil
+	}
+
+	conditional := make(http.Header)
+	if ok {
+		if etag := stored.header.Get("ETag"); etag != "" {
+			conditional.Set("If-None-Match", etag)
+		}
+		if lastModified := stored.header.Get("Last-Modified"); lastModified != "" {
+			conditional.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := fetch(conditional)
+	if err != nil {
+		if ok {
+			return stored.response(), nil
+		}
+		return nil, err
+	}
+
+	if ok && (resp.StatusCode == http.StatusNotModified || resp.StatusCode >= 500) {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotModified {
+			stored = stored.revalidated(resp.Header)
+			lifetime, _ := c.lifetime(rawURL, stored.header)
+			stored.expires = c.now().Add(lifetime)
+			c.put(stored)
+		}
+		return stored.response(), nil
+	}
+
+	if resp.StatusCode != http.StatusOK || !cacheable(resp) {
+		return resp, nil
+	}
+	lifetime, store := c.lifetime(rawURL, resp.Header)
+	if !store {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.maxBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		if ok {
+			return stored.response(), nil
+		}
+		return nil, err
+	}
+	if int64(len(body)) > c.maxBytes {
+		// Too large to keep, hand over what was read and the rest of the body
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	c.put(&entry{key: key, header: resp.Header.Clone(), body: body, expires: c.now().Add(lifetime)})
+	return resp, nil
+}
+
+// lifetime returns how long a response with header stays fresh, and
+// whether it may be stored at all.
+func (c *Cache) lifetime(rawURL string, header http.Header) (time.Duration, bool) {
+	for directive := range strings.SplitSeq(strings.Join(header.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store":
+			return 0, false
+		case "no-cache":
+			return 0, true
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+				return time.Duration(max(seconds, 0)) * time.Second, true
+			}
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			// Invalid dates, like "0", mean already expired
+			return 0, true
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = c.now()
+		}
+		return max(expiresAt.Sub(date), 0), true
+	}
+
+	return c.ttl(rawURL), true
+}
+
+// ttl returns the TTL of the feed with the longest URL rawURL starts with.
+func (c *Cache) ttl(rawURL string) time.Duration {
+	ttl, matched := c.defaultTTL, ""
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ttl
+	}
+	for feedURL, feedTTL := range c.feedTTLs {
+		f, err := url.Parse(feedURL)
+		if err != nil || auth.Origin(f) != auth.Origin(u) || !strings.HasPrefix(u.Path, f.Path) {
+			continue
+		}
+		if len(feedURL) > len(matched) {
+			ttl, matched = feedTTL, feedURL
+		}
+	}
+	return ttl
+}
+
+func (c *Cache) get(key string) (*entry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*entry), true
+}
+
+// put stores e, replacing any entry with the same key, and evicts least
+// recently used entries until the cache fits its size cap.
+func (c *Cache) put(e *entry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[e.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[e.key] = c.order.PushFront(e)
+	c.size += int64(len(e.body))
+
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	e := elem.Value.(*entry)
+	c.order.Remove(elem)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.body))
+}
+
+// revalidated returns a copy of e with the headers of a 304 response,
+// which may carry new validators and freshness information.
+func (e *entry) revalidated(header http.Header) *entry {
+	updated := *e
+	updated.header = e.header.Clone()
+	for _, name := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified"} {
+		if values := header.Values(name); len(values) > 0 {
+			updated.header[name] = values
+		}
+	}
+	return &updated
+}
+
+func (e *entry) response() *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,181 @@
+package feedcache
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/evan-buss/opds-proxy/internal/auth"
+)
+
+// upstream serves a feed with an ETag and counts requests by outcome.
+type upstream struct {
+	cacheControl string
+	body         string
+	fail         bool
+	fetched      int
+	revalidated  int
+}
+
+func (u *upstream) fetch(header http.Header) (*http.Response, error) {
+	if u.fail {
+		return nil, errors.New("connection refused")
+	}
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "application/atom+xml")
+	rec.Header().Set("ETag", `"v1"`)
+	if u.cacheControl != "" {
+		rec.Header().Set("Cache-Control", u.cacheControl)
+	}
+	if header.Get("If-None-Match") == `"v1"` {
+		u.revalidated++
+		rec.WriteHeader(http.StatusNotModified)
+		return rec.Result(), nil
+	}
+	u.fetched++
+	io.WriteString(rec, u.body)
+	return rec.Result(), nil
+}
+
+func always(*http.Response) bool { return true }
+
+func newTestCache(ttl time.Duration) (*Cache, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := New(1024, ttl, map[string]time.Duration{"http://calibre/opds/new": time.Hour})
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func readBody(t *testing.T, resp *http.Response, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestFetchServesFreshAndRevalidatesStale(t *testing.T) {
+	c, now := newTestCache(time.Minute)
+	up := &upstream{body: "feed"}
+	key := Key("http://calibre/opds", "", nil)
+
+	for range 2 {
+		resp, err := c.Fetch("http://calibre/opds", key, up.fetch, always)
+		if body := readBody(t, resp, err); body != "feed" {
+			t.Errorf("body = %q, want feed", body)
+		}
+	}
+	if up.fetched != 1 || up.revalidated != 0 {
+		t.Fatalf("fetched %d revalidated %d, want the second request served from cache", up.fetched, up.revalidated)
+	}
+
+	*now = now.Add(2 * time.Minute)
+	resp, err := c.Fetch("http://calibre/opds", key, up.fetch, always)
+	if body := readBody(t, resp, err); body != "feed" {
+		t.Errorf("body after revalidation = %q, want feed", body)
+	}
+	if up.fetched != 1 || up.revalidated != 1 {
+		t.Errorf("fetched %d revalidated %d, want a conditional request", up.fetched, up.revalidated)
+	}
+}
+
+func TestFetchHonoursCacheControl(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		fetched      int
+		revalidated  int
+	}{
+		{"no-store", 2, 0},
+		{"no-cache", 1, 1},
+		{"max-age=0", 1, 1},
+		{"private, max-age=600", 1, 0},
+	}
+
+	for _, tt := range tests {
+		c, _ := newTestCache(time.Minute)
+		up := &upstream{body: "feed", cacheControl: tt.cacheControl}
+		for range 2 {
+			resp, err := c.Fetch("http://calibre/opds", "key", up.fetch, always)
+			readBody(t, resp, err)
+		}
+		if up.fetched != tt.fetched || up.revalidated != tt.revalidated {
+			t.Errorf("%s: fetched %d revalidated %d, want %d and %d", tt.cacheControl, up.fetched, up.revalidated, tt.fetched, tt.revalidated)
+		}
+	}
+}
+
+func TestFetchServesStaleOnError(t *testing.T) {
+	c, now := newTestCache(time.Minute)
+	up := &upstream{body: "feed"}
+	resp, err := c.Fetch("http://calibre/opds", "key", up.fetch, always)
+	readBody(t, resp, err)
+
+	*now = now.Add(time.Hour)
+	up.fail = true
+	resp, err = c.Fetch("http://calibre/opds", "key", up.fetch, always)
+	if body := readBody(t, resp, err); body != "feed" {
+		t.Errorf("body = %q, want the stale feed", body)
+	}
+
+	if _, err := c.Fetch("http://calibre/opds/other", "other", up.fetch, always); err == nil {
+		t.Error("expected the error without a stored response")
+	}
+}
+
+func TestFetchFeedTTL(t *testing.T) {
+	c, now := newTestCache(time.Minute)
+	up := &upstream{body: "feed"}
+	for _, rawURL := range []string{"http://calibre/opds/new?page=1", "http://calibre/opds"} {
+		resp, err := c.Fetch(rawURL, rawURL, up.fetch, always)
+		readBody(t, resp, err)
+	}
+
+	*now = now.Add(10 * time.Minute)
+	for _, rawURL := range []string{"http://calibre/opds/new?page=1", "http://calibre/opds"} {
+		resp, err := c.Fetch(rawURL, rawURL, up.fetch, always)
+		readBody(t, resp, err)
+	}
+	if up.revalidated != 1 {
+		t.Errorf("revalidated %d, want only the feed with the default TTL", up.revalidated)
+	}
+}
+
+func TestFetchSkipsUncacheableAndLargeResponses(t *testing.T) {
+	c, _ := newTestCache(time.Minute)
+	up := &upstream{body: "book"}
+	for range 2 {
+		resp, err := c.Fetch("http://calibre/book.epub", "book", up.fetch, func(*http.Response) bool { return false })
+		readBody(t, resp, err)
+	}
+	if up.fetched != 2 {
+		t.Errorf("fetched %d, want downloads to skip the cache", up.fetched)
+	}
+
+	large := make([]byte, 2048)
+	up = &upstream{body: string(large)}
+	resp, err := c.Fetch("http://calibre/opds", "large", up.fetch, always)
+	if body := readBody(t, resp, err); len(body) != len(large) {
+		t.Errorf("body is %d bytes, want %d", len(body), len(large))
+	}
+	if c.size != 0 {
+		t.Errorf("cache holds %d bytes, want the large response skipped", c.size)
+	}
+}
+
+func TestKeySeparatesLogins(t *testing.T) {
+	keys := map[string]bool{
+		Key("http://calibre/opds", "", nil):                                             true,
+		Key("http://calibre/opds", "alice", nil):                                        true,
+		Key("http://calibre/opds", "", &auth.Credentials{Username: "a", Password: "1"}): true,
+		Key("http://calibre/opds", "", &auth.Credentials{Username: "a", Password: "2"}): true,
+		Key("http://calibre/opds", "", &auth.Credentials{Token: "t"}):                   true,
+	}
+	if len(keys) != 5 {
+		t.Errorf("got %d distinct keys, want 5", len(keys))
+	}
+}
@@ -0,0 +1,250 @@
+package filecache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cache is a size-capped, least recently used store of files on disk.
+// Each entry lives in its own directory named after its key so the
+// original file name is preserved and can be used when serving it.
+type Cache struct {
+	dir      string
+	maxBytes int64
+	entries  map[string]*list.Element
+	order    *list.List // front is the most recently used entry
+	size     int64
+	mutex    sync.Mutex
+}
+
+type entry struct {
+	key  string
+	path string
+	size int64
+}
+
+// New opens (or creates) a cache rooted at dir. Entries left behind by a
+// previous run are picked up again, ordered by when they were last used.
+func New(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %q: %w", dir, err)
+	}
+
+	c := &Cache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.evict(nil)
+
+	return c, nil
+}
+
+// Key derives a stable cache key from the given parts.
+func Key(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HashFile returns the hex encoded SHA-256 digest of the file contents.
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %q: %w", path, err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to hash file %q: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Get opens the cached file for key and marks it as recently used. The file
+// is opened while the cache is locked, so it stays readable even if it's
+// evicted before it has been served. The caller closes the file.
+func (c *Cache) Get(key string) (*os.File, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+
+	e := elem.Value.(*entry)
+	file, err := os.Open(e.path)
+	if err != nil {
+		// Removed from underneath us, forget about it
+		c.remove(elem)
+		return nil, false
+	}
+
+	// Record the access on the entry directory so the file itself,
+	// and any validators derived from it, stay untouched
+	now := time.Now()
+	_ = os.Chtimes(filepath.Dir(e.path), now, now)
+	c.order.MoveToFront(elem)
+	return file, true
+}
+
+// Put moves the file at src into the cache under key and returns its new path.
+// Least recently used entries are evicted until the cache fits its size cap.
+func (c *Cache) Put(key string, src string) (string, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file %q: %w", src, err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, exists := c.entries[key]; exists {
+		c.remove(elem)
+	}
+
+	entryDir := filepath.Join(c.dir, key)
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cache entry %q: %w", entryDir, err)
+	}
+
+	dst := filepath.Join(entryDir, filepath.Base(src))
+	if err := moveFile(src, dst); err != nil {
+		os.RemoveAll(entryDir)
+		return "", err
+	}
+
+	elem := c.order.PushFront(&entry{key: key, path: dst, size: info.Size()})
+	c.entries[key] = elem
+	c.size += info.Size()
+	c.evict(elem)
+
+	return dst, nil
+}
+
+// Size returns the total size in bytes of all cached files.
+func (c *Cache) Size() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
+
+func (c *Cache) load() error {
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory %q: %w", c.dir, err)
+	}
+
+	type found struct {
+		entry
+		modTime time.Time
+	}
+
+	var existing []found
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		entryDir := filepath.Join(c.dir, d.Name())
+		files, err := os.ReadDir(entryDir)
+		if err != nil || len(files) != 1 || files[0].IsDir() {
+			// Partial or foreign entry, don't trust it
+			os.RemoveAll(entryDir)
+			continue
+		}
+		info, err := files[0].Info()
+		if err != nil {
+			continue
+		}
+		dirInfo, err := d.Info()
+		if err != nil {
+			continue
+		}
+		existing = append(existing, found{
+			entry:   entry{key: d.Name(), path: filepath.Join(entryDir, files[0].Name()), size: info.Size()},
+			modTime: dirInfo.ModTime(),
+		})
+	}
+
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].modTime.Before(existing[j].modTime)
+	})
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, f := range existing {
+		e := f.entry
+		c.entries[e.key] = c.order.PushFront(&e)
+		c.size += e.size
+	}
+	return nil
+}
+
+// evict removes least recently used entries until the cache fits its cap.
+// The keep element is never evicted so a freshly stored file can be served.
+func (c *Cache) evict(keep *list.Element) {
+	for c.size > c.maxBytes {
+		oldest := c.order.Back()
+		if oldest == nil || oldest == keep {
+			return
+		}
+		c.remove(oldest)
+	}
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	e := elem.Value.(*entry)
+	c.order.Remove(elem)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	os.RemoveAll(filepath.Dir(e.path))
+}
+
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	// Rename fails across filesystems, fall back to copying
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q: %w", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create file %q: %w", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %q to %q: %w", src, dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write file %q: %w", dst, err)
+	}
+
+	os.Remove(src)
+	return nil
+}
@@ -0,0 +1,153 @@
+package filecache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTemp(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write %q: %v", path, err)
+	}
+	return path
+}
+
+func TestPutGet(t *testing.T) {
+	src := t.TempDir()
+	c, err := New(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	key := Key("https://example.com/book.epub", `"etag"`, "kepub")
+	path, err := c.Put(key, writeTemp(t, src, "book.kepub.epub", "hello"))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if filepath.Base(path) != "book.kepub.epub" {
+		t.Fatalf("expected file name to be preserved, got %q", path)
+	}
+
+	got, ok := c.Get(key)
+	if !ok || got.Name() != path {
+		t.Fatalf("Get = %v, %v; want %q, true", got, ok, path)
+	}
+	got.Close()
+	if _, err := os.Stat(filepath.Join(src, "book.kepub.epub")); !os.IsNotExist(err) {
+		t.Fatalf("expected source file to be moved into the cache")
+	}
+
+	if _, ok := c.Get(Key("other")); ok {
+		t.Fatalf("expected miss for unknown key")
+	}
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	src := t.TempDir()
+	c, err := New(t.TempDir(), 10)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if _, err := c.Put("a", writeTemp(t, src, "a", "aaaa")); err != nil {
+		t.Fatalf("Put a: %v", err)
+	}
+	if _, err := c.Put("b", writeTemp(t, src, "b", "bbbb")); err != nil {
+		t.Fatalf("Put b: %v", err)
+	}
+	// Touch a so b becomes the oldest entry
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("expected a to be cached")
+	}
+	if _, err := c.Put("c", writeTemp(t, src, "c", "cccc")); err != nil {
+		t.Fatalf("Put c: %v", err)
+	}
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatalf("expected b to be evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("expected a to survive eviction")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Fatalf("expected c to be cached")
+	}
+	if c.Size() != 8 {
+		t.Fatalf("unexpected size %d", c.Size())
+	}
+}
+
+func TestGetSurvivesEviction(t *testing.T) {
+	src := t.TempDir()
+	c, err := New(t.TempDir(), 4)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if _, err := c.Put("a", writeTemp(t, src, "a", "aaaa")); err != nil {
+		t.Fatalf("Put a: %v", err)
+	}
+	file, ok := c.Get("a")
+	if !ok {
+		t.Fatalf("expected a to be cached")
+	}
+	defer file.Close()
+
+	// Evicts a while it's being served
+	if _, err := c.Put("b", writeTemp(t, src, "b", "bbbb")); err != nil {
+		t.Fatalf("Put b: %v", err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil || string(data) != "aaaa" {
+		t.Fatalf("read evicted file = %q, %v", data, err)
+	}
+}
+
+func TestKeepsOversizedNewestEntry(t *testing.T) {
+	c, err := New(t.TempDir(), 2)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	path, err := c.Put("big", writeTemp(t, t.TempDir(), "big", "too large"))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected newest entry to remain on disk: %v", err)
+	}
+}
+
+func TestReloadsExistingEntries(t *testing.T) {
+	dir := t.TempDir()
+	src := t.TempDir()
+
+	c, err := New(dir, 1024)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	oldPath, _ := c.Put("old", writeTemp(t, src, "old", "1234"))
+	if _, err := c.Put("new", writeTemp(t, src, "new", "5678")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Dir(oldPath), past, past)
+
+	// Reopen with a cap that only fits one entry
+	c, err = New(dir, 4)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, ok := c.Get("old"); ok {
+		t.Fatalf("expected oldest entry to be evicted on load")
+	}
+	if _, ok := c.Get("new"); !ok {
+		t.Fatalf("expected newest entry to be loaded")
+	}
+}
@@ -1,5 +1,7 @@
 package formats
 
+import "strings"
+
 // Format represents a supported ebook format
 type Format struct {
 	// MIME type for the format
@@ -46,7 +48,21 @@ var (
 		MimeType:            "application/x-mobi8-ebook",
 		Extension:           ".azw3",
 		Label:               "AZW3",
-		ConvertibleFromEPUB: false, // Not currently supported for conversion
+		ConvertibleFromEPUB: true, // Requires Calibre's ebook-convert
+	}
+
+	FB2 = Format{
+		MimeType:            "application/x-fictionbook+xml",
+		Extension:           ".fb2",
+		Label:               "FB2",
+		ConvertibleFromEPUB: false, // Input only
+	}
+
+	DOCX = Format{
+		MimeType:            "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		Extension:           ".docx",
+		Label:               "DOCX",
+		ConvertibleFromEPUB: false, // Input only
 	}
 
 	// OPDS/Atom feed format
@@ -56,11 +72,19 @@ var (
 		Label:               "ATOM",
 		ConvertibleFromEPUB: false,
 	}
+
+	// OPDS 2.0 feed format
+	OPDS2 = Format{
+		MimeType:            "application/opds+json",
+		Extension:           ".json",
+		Label:               "OPDS2",
+		ConvertibleFromEPUB: false,
+	}
 )
 
 // AllFormats returns all supported formats
 func AllFormats() []Format {
-	return []Format{EPUB, KEPUB, MOBI, PDF, AZW3, ATOM}
+	return []Format{EPUB, KEPUB, MOBI, PDF, AZW3, FB2, DOCX, ATOM, OPDS2}
 }
 
 // FormatByMimeType returns the format for a given MIME type
@@ -71,12 +95,17 @@ func FormatByMimeType(mimeType string) (Format, bool) {
 		MOBI.MimeType:  MOBI,
 		PDF.MimeType:   PDF,
 		AZW3.MimeType:  AZW3,
+		FB2.MimeType:   FB2,
+		DOCX.MimeType:  DOCX,
 		ATOM.MimeType:  ATOM,
+		OPDS2.MimeType: OPDS2,
 		// Legacy/alternative MIME types
 		"application/mobi":       MOBI,
 		"application/x-epub+zip": EPUB,
+		"application/x-fb2":      FB2,
+		"text/fb2+xml":           FB2,
 	}
-	
+
 	format, exists := formats[mimeType]
 	return format, exists
 }
@@ -89,13 +118,26 @@ func FormatByExtension(extension string) (Format, bool) {
 		MOBI.Extension:  MOBI,
 		PDF.Extension:   PDF,
 		AZW3.Extension:  AZW3,
+		FB2.Extension:   FB2,
+		DOCX.Extension:  DOCX,
 		ATOM.Extension:  ATOM,
+		OPDS2.Extension: OPDS2,
 	}
-	
+
 	format, exists := formats[extension]
 	return format, exists
 }
 
+// FormatByLabel returns the format with the given label, ignoring case
+func FormatByLabel(label string) (Format, bool) {
+	for _, format := range AllFormats() {
+		if strings.EqualFold(format.Label, label) {
+			return format, true
+		}
+	}
+	return Format{}, false
+}
+
 // GetMimeTypeLabel returns the human-readable label for a MIME type
 func GetMimeTypeLabel(mimeType string) string {
 	if format, exists := FormatByMimeType(mimeType); exists {
@@ -113,4 +155,4 @@ func ConvertibleFormats() []Format {
 		}
 	}
 	return convertible
-}
\ No newline at end of file
+}
@@ -1,6 +1,9 @@
 package httpx
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"maps"
@@ -20,23 +23,40 @@ import (
 	"golang.org/x/text/unicode/norm"
 )
 
-func Fetch(url string, timeoutSeconds int, setAuth func(*http.Request)) (*http.Response, error) {
-	client := &http.Client{}
+// Fetch issues a GET request for url with the given client.
+func Fetch(client *http.Client, url string, timeoutSeconds int, setAuth func(*http.Request)) (*http.Response, error) {
+	return FetchContext(context.Background(), client, url, timeoutSeconds, setAuth)
+}
+
+// FetchContext is Fetch with a context that can cancel the request.
+func FetchContext(ctx context.Context, client *http.Client, url string, timeoutSeconds int, setAuth func(*http.Request)) (*http.Response, error) {
+	c := *client
 	if timeoutSeconds > 0 {
-		client.Timeout = time.Duration(timeoutSeconds) * time.Second
+		c.Timeout = time.Duration(timeoutSeconds) * time.Second
 	}
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request for %q: %w", url, err)
 	}
 	if setAuth != nil {
 		setAuth(req)
 	}
-	return client.Do(req)
+	return c.Do(req)
 }
 
+// CopyRangeHeaders copies the client's Range and If-Range headers to the upstream request.
+func CopyRangeHeaders(dst *http.Request, src *http.Request) {
+	for _, key := range []string{"Range", "If-Range"} {
+		if value := src.Header.Get(key); value != "" {
+			dst.Header.Set(key, value)
+		}
+	}
+}
+
+// ForwardResponse copies the upstream response, including its status code, to w.
 func ForwardResponse(w http.ResponseWriter, resp *http.Response) {
 	maps.Copy(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
 }
 
@@ -65,38 +85,55 @@ func DownloadToFile(dstPath string, resp *http.Response) error {
 	return nil
 }
 
-func SendFile(w http.ResponseWriter, filePath, outFilename string) error {
+// ServeFile writes the file to the response as an attachment named outFilename.
+// Range, If-Range and conditional requests are handled so interrupted
+// downloads can be resumed.
+func ServeFile(w http.ResponseWriter, r *http.Request, filePath, outFilename string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
-		os.Remove(filePath)
 		return fmt.Errorf("failed to open file %q: %w", filePath, err)
 	}
-	defer func() {
-		file.Close()
-		os.Remove(filePath)
-	}()
+	defer file.Close()
+	return ServeOpenFile(w, r, file, outFilename)
+}
+
+// ServeOpenFile is ServeFile for a file that's already open, such as one
+// that could be removed once it's been opened. The caller closes the file.
+func ServeOpenFile(w http.ResponseWriter, r *http.Request, file *os.File, outFilename string) error {
+	disposition := mime.FormatMediaType(
+		"attachment",
+		map[string]string{"filename": sanitizeFilenameASCII7(outFilename)},
+	)
+	return serveFile(w, r, file, outFilename, disposition)
+}
 
+// ServeInlineFile writes the open file to the response for display in the
+// page, such as images. The caller closes the file.
+func ServeInlineFile(w http.ResponseWriter, r *http.Request, file *os.File) error {
+	return serveFile(w, r, file, filepath.Base(file.Name()), "inline")
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, file *os.File, name, disposition string) error {
 	info, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to stat file %q: %w", filePath, err)
+		return fmt.Errorf("failed to stat file %q: %w", file.Name(), err)
 	}
 
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
-	w.Header().Set("Content-Disposition",
-		mime.FormatMediaType(
-			"attachment",
-			map[string]string{"filename": sanitizeFilenameASCII7(outFilename)},
-		),
-	)
-	w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(filePath)))
+	w.Header().Set("ETag", fileETag(file.Name(), info))
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(file.Name())))
 
-	_, err = io.Copy(w, file)
-	if err != nil {
-		return fmt.Errorf("failed to send file %q: %w", filePath, err)
-	}
+	http.ServeContent(w, r, name, info.ModTime(), file)
 	return nil
 }
 
+// fileETag derives a strong ETag from the file's location and size.
+// Served files are never modified in place so this identifies the content.
+func fileETag(filePath string, info os.FileInfo) string {
+	hash := sha256.Sum256(fmt.Appendf(nil, "%s:%d", filePath, info.Size()))
+	return `"` + hex.EncodeToString(hash[:8]) + `"`
+}
+
 func sanitizeFilenameASCII7(s string) string {
 	// Remove most diacritics and nonspacing marks (Mn)
 	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
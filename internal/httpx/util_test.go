@@ -97,3 +97,68 @@ func TestDownloadToFile(t *testing.T) {
 		t.Fatalf("unexpected content: %q", string(b))
 	}
 }
+
+func TestServeFile_Range(t *testing.T) {
+	tmp, err := os.MkdirTemp("", "httpx-serve-*")
+	if err != nil {
+		t.Fatalf("mkdtemp: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "book.epub")
+	if err := os.WriteFile(path, []byte("hello world"), 0644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", "bytes=6-")
+	rr := httptest.NewRecorder()
+	if err := ServeFile(rr, req, path, "book.epub"); err != nil {
+		t.Fatalf("ServeFile error: %v", err)
+	}
+
+	if rr.Code != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", rr.Code)
+	}
+	if got := rr.Body.String(); got != "world" {
+		t.Fatalf("unexpected body: %q", got)
+	}
+	if got := rr.Header().Get("Content-Range"); got != "bytes 6-10/11" {
+		t.Fatalf("unexpected Content-Range: %q", got)
+	}
+	if rr.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("expected Accept-Ranges header")
+	}
+}
+
+func TestServeFile_NotModified(t *testing.T) {
+	tmp, err := os.MkdirTemp("", "httpx-serve-*")
+	if err != nil {
+		t.Fatalf("mkdtemp: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "book.epub")
+	if err := os.WriteFile(path, []byte("hello world"), 0644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	if err := ServeFile(rr, httptest.NewRequest(http.MethodGet, "/", nil), path, "book.epub"); err != nil {
+		t.Fatalf("ServeFile error: %v", err)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected ETag header")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	if err := ServeFile(rr, req, path, "book.epub"); err != nil {
+		t.Fatalf("ServeFile error: %v", err)
+	}
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rr.Code)
+	}
+}
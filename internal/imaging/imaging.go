@@ -0,0 +1,146 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+
+	// Register the decoders covers are commonly served in
+	_ "image/gif"
+	_ "image/png"
+)
+
+// DefaultQuality is the JPEG quality used when Options.Quality is zero
+const DefaultQuality = 75
+
+// MaxPixels caps the size of images that are decoded. A few kilobytes of
+// PNG can claim dimensions that would take gigabytes of memory to decode.
+const MaxPixels = 25_000_000
+
+// ErrTooLarge is returned for images with more than MaxPixels pixels
+var ErrTooLarge = errors.New("image is too large to process")
+
+// Options controls how an image is processed.
+type Options struct {
+	// Bounds to fit the image within. Zero leaves a dimension unconstrained.
+	MaxWidth  int
+	MaxHeight int
+	// Convert to grayscale, e-ink screens can't show color anyway
+	Grayscale bool
+	// JPEG quality between 1 and 100
+	Quality int
+}
+
+// Process decodes the image from r, scales it down to fit the bounds,
+// optionally converts it to grayscale and writes it to w as a progressive
+// JPEG, so readers can show a preview while the rest loads. Images with
+// more than MaxPixels pixels are refused with ErrTooLarge before they're
+// decoded.
+func Process(w io.Writer, r io.Reader, opts Options) error {
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return fmt.Errorf("%w: %dx%d", ErrTooLarge, config.Width, config.Height)
+	}
+
+	src, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	var img image.Image = Resize(flatten(src), opts.MaxWidth, opts.MaxHeight)
+	if opts.Grayscale {
+		img = Grayscale(img)
+	}
+
+	quality := opts.Quality
+	if quality <= 0 || quality > 100 {
+		quality = DefaultQuality
+	}
+	if err := encodeProgressive(w, img, quality); err != nil {
+		return fmt.Errorf("failed to encode image: %w", err)
+	}
+	return nil
+}
+
+// Resize scales src down to fit within maxWidth x maxHeight, keeping its
+// aspect ratio. Each destination pixel is the average of the source pixels
+// it covers, which gives clean results when shrinking. Images that already
+// fit are returned unchanged.
+func Resize(src *image.RGBA, maxWidth, maxHeight int) *image.RGBA {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return src
+	}
+
+	scale := 1.0
+	if maxWidth > 0 {
+		scale = math.Min(scale, float64(maxWidth)/float64(width))
+	}
+	if maxHeight > 0 {
+		scale = math.Min(scale, float64(maxHeight)/float64(height))
+	}
+	if scale >= 1 {
+		return src
+	}
+
+	dstWidth := max(1, int(math.Round(float64(width)*scale)))
+	dstHeight := max(1, int(math.Round(float64(height)*scale)))
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for dy := range dstHeight {
+		y0 := dy * height / dstHeight
+		y1 := max(y0+1, (dy+1)*height/dstHeight)
+		for dx := range dstWidth {
+			x0 := dx * width / dstWidth
+			x1 := max(x0+1, (dx+1)*width/dstWidth)
+
+			var r, g, b, a, n int
+			for y := y0; y < y1; y++ {
+				row := src.Pix[y*src.Stride:]
+				for x := x0; x < x1; x++ {
+					p := row[x*4 : x*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+
+			i := dst.PixOffset(dx, dy)
+			dst.Pix[i+0] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+// Grayscale converts img to a grayscale image using the usual luma weights.
+func Grayscale(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, bounds.Min, draw.Src)
+	return gray
+}
+
+// flatten draws src onto a white background so transparent covers don't
+// turn black once encoded as JPEG. The result starts at the origin.
+func flatten(src image.Image) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Over)
+	return dst
+}
@@ -0,0 +1,187 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func solid(width, height int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestResizeKeepsAspectRatio(t *testing.T) {
+	tests := []struct {
+		name                string
+		maxWidth, maxHeight int
+		wantW, wantH        int
+	}{
+		{"width bound", 100, 0, 100, 150},
+		{"height bound", 0, 60, 40, 60},
+		{"both bounds", 100, 100, 67, 100},
+		{"already fits", 1000, 1000, 400, 600},
+		{"unconstrained", 0, 0, 400, 600},
+	}
+
+	src := solid(400, 600, color.RGBA{R: 10, G: 20, B: 30, A: 255})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Resize(src, tt.maxWidth, tt.maxHeight).Bounds()
+			if got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+				t.Errorf("Resize() = %dx%d, want %dx%d", got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestResizeAveragesPixels(t *testing.T) {
+	// Alternating black and white columns average out to mid gray
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for y := range 2 {
+		for x := range 4 {
+			if x%2 == 0 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	dst := Resize(src, 2, 0)
+	if got := dst.RGBAAt(0, 0); got.R != 127 || got.G != 127 || got.B != 127 || got.A != 255 {
+		t.Errorf("expected mid gray, got %v", got)
+	}
+}
+
+func TestProcessGrayscaleJPEG(t *testing.T) {
+	var in bytes.Buffer
+	if err := png.Encode(&in, solid(300, 450, color.RGBA{R: 200, A: 255})); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := Process(&out, &in, Options{MaxHeight: 90, Grayscale: true}); err != nil {
+		t.Fatalf("Process error: %v", err)
+	}
+
+	img, err := jpeg.Decode(&out)
+	if err != nil {
+		t.Fatalf("output is not a JPEG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 60 || b.Dy() != 90 {
+		t.Errorf("unexpected size %dx%d", b.Dx(), b.Dy())
+	}
+	if _, ok := img.(*image.Gray); !ok {
+		t.Errorf("expected a grayscale JPEG, got %T", img)
+	}
+}
+
+func TestProcessFlattensTransparency(t *testing.T) {
+	var in bytes.Buffer
+	if err := png.Encode(&in, solid(10, 10, color.Transparent)); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := Process(&out, &in, Options{}); err != nil {
+		t.Fatalf("Process error: %v", err)
+	}
+
+	img, err := jpeg.Decode(&out)
+	if err != nil {
+		t.Fatalf("output is not a JPEG: %v", err)
+	}
+	if r, g, b, _ := img.At(5, 5).RGBA(); r>>8 < 250 || g>>8 < 250 || b>>8 < 250 {
+		t.Errorf("expected transparent pixels to become white, got %v", img.At(5, 5))
+	}
+}
+
+func TestProcessRejectsNonImages(t *testing.T) {
+	var out bytes.Buffer
+	if err := Process(&out, bytes.NewReader([]byte("not an image")), Options{}); err == nil {
+		t.Fatal("expected an error for non-image input")
+	}
+}
+
+func TestProcessRejectsHugeImages(t *testing.T) {
+	var small bytes.Buffer
+	if err := gif.Encode(&small, solid(1, 1, color.White), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Claim a 65535x65535 logical screen in the GIF header
+	data := small.Bytes()
+	copy(data[6:10], []byte{0xff, 0xff, 0xff, 0xff})
+
+	var out bytes.Buffer
+	if err := Process(&out, bytes.NewReader(data), Options{}); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestProcessWritesProgressiveJPEG(t *testing.T) {
+	// Odd dimensions exercise the partial blocks and MCUs at the edges
+	src := image.NewRGBA(image.Rect(0, 0, 37, 23))
+	for y := range 23 {
+		for x := range 37 {
+			src.Set(x, y, color.RGBA{R: uint8(x * 7), G: uint8(y * 11), B: 128, A: 255})
+		}
+	}
+
+	for _, grayscale := range []bool{false, true} {
+		var in bytes.Buffer
+		if err := png.Encode(&in, src); err != nil {
+			t.Fatalf("encode png: %v", err)
+		}
+
+		var out bytes.Buffer
+		if err := Process(&out, &in, Options{Grayscale: grayscale, Quality: 90}); err != nil {
+			t.Fatalf("Process error: %v", err)
+		}
+		if !bytes.Contains(out.Bytes(), []byte{0xff, 0xc2}) || bytes.Contains(out.Bytes(), []byte{0xff, 0xc0}) {
+			t.Errorf("grayscale=%v: expected a progressive frame header", grayscale)
+		}
+
+		img, err := jpeg.Decode(&out)
+		if err != nil {
+			t.Fatalf("grayscale=%v: output is not a JPEG: %v", grayscale, err)
+		}
+		if b := img.Bounds(); b.Dx() != 37 || b.Dy() != 23 {
+			t.Fatalf("grayscale=%v: unexpected size %dx%d", grayscale, b.Dx(), b.Dy())
+		}
+
+		var want image.Image = src
+		if grayscale {
+			want = Grayscale(src)
+		}
+		var diff, n int
+		for y := range 23 {
+			for x := range 37 {
+				r1, g1, b1, _ := want.At(x, y).RGBA()
+				r2, g2, b2, _ := img.At(x, y).RGBA()
+				diff += abs(int(r1>>8)-int(r2>>8)) + abs(int(g1>>8)-int(g2>>8)) + abs(int(b1>>8)-int(b2>>8))
+				n += 3
+			}
+		}
+		if avg := float64(diff) / float64(n); avg > 4 {
+			t.Errorf("grayscale=%v: decoded image differs by %.1f on average", grayscale, avg)
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,548 @@
+package imaging
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// The standard library only writes baseline JPEGs, so covers are encoded
+// here instead. Progressive JPEGs carry the same data split into several
+// scans: first the DC coefficient of every block, giving a blurry preview,
+// then the remaining AC coefficients in bands of increasing frequency.
+// Only spectral selection is used, successive approximation buys little
+// for images this small. The quantization and Huffman tables are the
+// example tables from Annex K of the spec, the same ones image/jpeg uses.
+
+// unzig maps a zig-zag position to its index in a natural order block.
+var unzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// unscaledQuant are the luminance and chrominance quantization tables in
+// zig-zag order, before they're scaled for the requested quality.
+var unscaledQuant = [2][64]byte{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// huffmanSpec is a Huffman table as stored in a DHT segment: count[i] is
+// the number of codes of length i+1 and value lists the coded symbols.
+type huffmanSpec struct {
+	count [16]byte
+	value []byte
+}
+
+// huffmanSpecs are the luminance DC, luminance AC, chrominance DC and
+// chrominance AC tables, indexed by table class and destination.
+var huffmanSpecs = [2][2]huffmanSpec{
+	{
+		{
+			[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+			[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		},
+		{
+			[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+			[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		},
+	},
+	{
+		{
+			[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+			[]byte{
+				0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+				0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+				0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+				0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+				0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+				0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+				0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+				0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+				0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+				0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+				0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+				0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+				0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+				0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+				0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+				0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+				0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+				0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+				0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+				0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+				0xf9, 0xfa,
+			},
+		},
+		{
+			[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+			[]byte{
+				0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+				0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+				0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+				0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+				0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+				0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+				0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+				0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+				0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+				0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+				0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+				0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+				0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+				0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+				0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+				0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+				0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+				0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+				0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+				0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+				0xf9, 0xfa,
+			},
+		},
+	},
+}
+
+const (
+	dcClass = 0
+	acClass = 1
+)
+
+// huffmanCode is a code word and its length in bits.
+type huffmanCode struct {
+	bits uint32
+	size uint8
+}
+
+// huffmanCodes assigns the canonical code of every symbol in spec.
+func huffmanCodes(spec huffmanSpec) [256]huffmanCode {
+	var codes [256]huffmanCode
+	code, k := uint32(0), 0
+	for i, n := range spec.count {
+		for range n {
+			codes[spec.value[k]] = huffmanCode{bits: code, size: uint8(i + 1)}
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// dctCos[u][x] is the DCT basis function including its normalization, so a
+// one dimensional transform is a dot product with a row.
+var dctCos = func() (t [8][8]float64) {
+	for u := range 8 {
+		c := 0.5
+		if u == 0 {
+			c = 0.5 / math.Sqrt2
+		}
+		for x := range 8 {
+			t[u][x] = c * math.Cos(float64((2*x+1)*u)*math.Pi/16)
+		}
+	}
+	return t
+}()
+
+// component is one color channel, with its samples already transformed
+// and quantized into blocks of coefficients in zig-zag order.
+type component struct {
+	id byte
+	// Sampling factors
+	h, v int
+	// Quantization and Huffman table destination
+	table int
+	// Blocks per row and column, padded to whole MCUs
+	blocksX, blocksY int
+	// Blocks per row and column that cover the component itself. Scans
+	// of a single component only visit these.
+	scanX, scanY int
+	blocks       [][64]int32
+}
+
+// scan is one entry of the progression: the components it covers and the
+// range of zig-zag coefficients it carries.
+type scan struct {
+	components []int
+	start, end int
+}
+
+// plane is a single channel of samples.
+type plane struct {
+	width, height int
+	pix           []float64
+}
+
+func (p *plane) at(x, y int) float64 {
+	x = min(x, p.width-1)
+	y = min(y, p.height-1)
+	return p.pix[y*p.width+x]
+}
+
+// halve averages every 2x2 square of samples.
+func (p *plane) halve() *plane {
+	dst := &plane{width: (p.width + 1) / 2, height: (p.height + 1) / 2}
+	dst.pix = make([]float64, dst.width*dst.height)
+	for y := range dst.height {
+		for x := range dst.width {
+			sum := p.at(2*x, 2*y) + p.at(2*x+1, 2*y) + p.at(2*x, 2*y+1) + p.at(2*x+1, 2*y+1)
+			dst.pix[y*dst.width+x] = sum / 4
+		}
+	}
+	return dst
+}
+
+// encodeProgressive writes img to w as a progressive JPEG at the given
+// quality between 1 and 100. Grayscale images are written with a single
+// component, everything else as YCbCr with 4:2:0 chroma subsampling.
+func encodeProgressive(w io.Writer, img image.Image, quality int) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 || width > 0xffff || height > 0xffff {
+		return errors.New("image dimensions out of range")
+	}
+
+	quant := scaledQuant(quality)
+
+	var planes []*plane
+	var components []*component
+	var scans []scan
+	if gray, ok := img.(*image.Gray); ok {
+		y := &plane{width: width, height: height, pix: make([]float64, width*height)}
+		for py := range height {
+			row := gray.Pix[gray.PixOffset(bounds.Min.X, bounds.Min.Y+py):]
+			for px := range width {
+				y.pix[py*width+px] = float64(row[px])
+			}
+		}
+		planes = []*plane{y}
+		components = []*component{{id: 1, h: 1, v: 1, table: 0}}
+		scans = []scan{{[]int{0}, 0, 0}, {[]int{0}, 1, 5}, {[]int{0}, 6, 63}}
+	} else {
+		y := &plane{width: width, height: height, pix: make([]float64, width*height)}
+		cb := &plane{width: width, height: height, pix: make([]float64, width*height)}
+		cr := &plane{width: width, height: height, pix: make([]float64, width*height)}
+		rgba, ok := img.(*image.RGBA)
+		if !ok {
+			rgba = flatten(img)
+			bounds = rgba.Bounds()
+		}
+		for py := range height {
+			row := rgba.Pix[rgba.PixOffset(bounds.Min.X, bounds.Min.Y+py):]
+			for px := range width {
+				p := row[px*4 : px*4+3]
+				yy, u, v := color.RGBToYCbCr(p[0], p[1], p[2])
+				i := py*width + px
+				y.pix[i], cb.pix[i], cr.pix[i] = float64(yy), float64(u), float64(v)
+			}
+		}
+		planes = []*plane{y, cb.halve(), cr.halve()}
+		components = []*component{
+			{id: 1, h: 2, v: 2, table: 0},
+			{id: 2, h: 1, v: 1, table: 1},
+			{id: 3, h: 1, v: 1, table: 1},
+		}
+		// A coarse preview of the whole cover comes first, the fine luma
+		// detail last.
+		scans = []scan{
+			{[]int{0, 1, 2}, 0, 0},
+			{[]int{0}, 1, 5},
+			{[]int{1}, 1, 63},
+			{[]int{2}, 1, 63},
+			{[]int{0}, 6, 63},
+		}
+	}
+
+	maxH, maxV := components[0].h, components[0].v
+	mcusX := (width + 8*maxH - 1) / (8 * maxH)
+	mcusY := (height + 8*maxV - 1) / (8 * maxV)
+	for i, c := range components {
+		c.blocksX, c.blocksY = mcusX*c.h, mcusY*c.v
+		c.scanX = (planes[i].width + 7) / 8
+		c.scanY = (planes[i].height + 7) / 8
+		c.blocks = make([][64]int32, c.blocksX*c.blocksY)
+		for by := range c.blocksY {
+			for bx := range c.blocksX {
+				transform(&c.blocks[by*c.blocksX+bx], planes[i], bx*8, by*8, &quant[c.table])
+			}
+		}
+	}
+
+	e := &encoder{w: bufio.NewWriter(w)}
+	for i := range huffmanSpecs {
+		for j := range huffmanSpecs[i] {
+			e.codes[i][j] = huffmanCodes(huffmanSpecs[i][j])
+		}
+	}
+
+	tables := 1
+	if len(components) > 1 {
+		tables = 2
+	}
+
+	e.write([]byte{0xff, 0xd8})
+	e.writeDQT(quant[:tables])
+	e.writeSOF2(width, height, components)
+	e.writeDHT(tables)
+	for _, s := range scans {
+		e.writeScan(s, components, mcusX, mcusY)
+	}
+	e.write([]byte{0xff, 0xd9})
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// scaledQuant scales the quantization tables for quality the same way
+// libjpeg and image/jpeg do.
+func scaledQuant(quality int) (quant [2][64]byte) {
+	quality = min(max(quality, 1), 100)
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	for i := range quant {
+		for j := range quant[i] {
+			x := (int(unscaledQuant[i][j])*scale + 50) / 100
+			quant[i][j] = byte(min(max(x, 1), 255))
+		}
+	}
+	return quant
+}
+
+// transform computes the quantized DCT of the 8x8 samples at (x0, y0),
+// repeating the edge samples past the end of the plane.
+func transform(dst *[64]int32, p *plane, x0, y0 int, quant *[64]byte) {
+	var samples, rows [64]float64
+	for y := range 8 {
+		for x := range 8 {
+			samples[y*8+x] = p.at(x0+x, y0+y) - 128
+		}
+	}
+	for y := range 8 {
+		for u := range 8 {
+			var sum float64
+			for x := range 8 {
+				sum += dctCos[u][x] * samples[y*8+x]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+	for k, n := range unzig {
+		u, v := n%8, n/8
+		var sum float64
+		for y := range 8 {
+			sum += dctCos[v][y] * rows[y*8+u]
+		}
+		limit := float64(1023)
+		if k == 0 {
+			limit = 2047
+		}
+		q := math.Round(sum / float64(quant[k]))
+		dst[k] = int32(min(max(q, -limit), limit))
+	}
+}
+
+// encoder writes the segments and entropy coded data, remembering the
+// first write error.
+type encoder struct {
+	w     *bufio.Writer
+	err   error
+	codes [2][2][256]huffmanCode
+	// Pending bits, most significant first
+	bits  uint32
+	nBits uint32
+}
+
+func (e *encoder) write(p []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+}
+
+func (e *encoder) writeSegment(marker byte, payload []byte) {
+	n := len(payload) + 2
+	e.write([]byte{0xff, marker, byte(n >> 8), byte(n)})
+	e.write(payload)
+}
+
+func (e *encoder) writeDQT(quant [][64]byte) {
+	var payload []byte
+	for i, q := range quant {
+		payload = append(payload, byte(i))
+		payload = append(payload, q[:]...)
+	}
+	e.writeSegment(0xdb, payload)
+}
+
+func (e *encoder) writeSOF2(width, height int, components []*component) {
+	payload := []byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), byte(len(components))}
+	for _, c := range components {
+		payload = append(payload, c.id, byte(c.h<<4|c.v), byte(c.table))
+	}
+	e.writeSegment(0xc2, payload)
+}
+
+func (e *encoder) writeDHT(tables int) {
+	var payload []byte
+	for class := range huffmanSpecs {
+		for id := range tables {
+			spec := huffmanSpecs[class][id]
+			payload = append(payload, byte(class<<4|id))
+			payload = append(payload, spec.count[:]...)
+			payload = append(payload, spec.value...)
+		}
+	}
+	e.writeSegment(0xc4, payload)
+}
+
+func (e *encoder) writeScan(s scan, components []*component, mcusX, mcusY int) {
+	payload := []byte{byte(len(s.components))}
+	for _, i := range s.components {
+		c := components[i]
+		if s.start == 0 {
+			payload = append(payload, c.id, byte(c.table<<4))
+		} else {
+			payload = append(payload, c.id, byte(c.table))
+		}
+	}
+	payload = append(payload, byte(s.start), byte(s.end), 0)
+	e.writeSegment(0xda, payload)
+
+	if len(s.components) == 1 {
+		c := components[s.components[0]]
+		var pred int32
+		for by := range c.scanY {
+			for bx := range c.scanX {
+				b := &c.blocks[by*c.blocksX+bx]
+				if s.start == 0 {
+					pred = e.emitDC(c, b[0], pred)
+				} else {
+					e.emitAC(c, b, s.start, s.end)
+				}
+			}
+		}
+	} else {
+		// Interleaved scans are only used for DC coefficients, which
+		// are coded in MCU order
+		preds := make([]int32, len(components))
+		for my := range mcusY {
+			for mx := range mcusX {
+				for _, i := range s.components {
+					c := components[i]
+					for v := range c.v {
+						for h := range c.h {
+							b := &c.blocks[(my*c.v+v)*c.blocksX+mx*c.h+h]
+							preds[i] = e.emitDC(c, b[0], preds[i])
+						}
+					}
+				}
+			}
+		}
+	}
+	e.flushBits()
+}
+
+// emitDC codes the difference between dc and the previous DC coefficient
+// of the component and returns dc as the new prediction.
+func (e *encoder) emitDC(c *component, dc, pred int32) int32 {
+	size, bits := magnitude(dc - pred)
+	e.emitCode(e.codes[dcClass][c.table][size])
+	e.emitBits(bits, size)
+	return dc
+}
+
+// emitAC codes the coefficients start through end of b. Runs of trailing
+// zeros are ended with a plain EOB, the standard tables have no codes for
+// longer end-of-band runs.
+func (e *encoder) emitAC(c *component, b *[64]int32, start, end int) {
+	codes := &e.codes[acClass][c.table]
+	run := 0
+	for k := start; k <= end; k++ {
+		if b[k] == 0 {
+			run++
+			continue
+		}
+		for run > 15 {
+			e.emitCode(codes[0xf0])
+			run -= 16
+		}
+		size, bits := magnitude(b[k])
+		e.emitCode(codes[byte(run<<4)|size])
+		e.emitBits(bits, size)
+		run = 0
+	}
+	if run > 0 {
+		e.emitCode(codes[0x00])
+	}
+}
+
+// magnitude returns the size category of x and the bits that encode it.
+func magnitude(x int32) (uint8, uint32) {
+	a := x
+	if a < 0 {
+		a = -a
+		x--
+	}
+	var size uint8
+	for a > 0 {
+		size++
+		a >>= 1
+	}
+	return size, uint32(x) & (1<<size - 1)
+}
+
+func (e *encoder) emitCode(c huffmanCode) {
+	e.emitBits(c.bits, c.size)
+}
+
+func (e *encoder) emitBits(bits uint32, size uint8) {
+	e.bits = e.bits<<size | bits
+	e.nBits += uint32(size)
+	for e.nBits >= 8 {
+		b := byte(e.bits >> (e.nBits - 8))
+		e.write([]byte{b})
+		if b == 0xff {
+			e.write([]byte{0x00})
+		}
+		e.nBits -= 8
+	}
+	e.bits &= 1<<e.nBits - 1
+}
+
+// flushBits pads the last byte of a scan with one bits.
+func (e *encoder) flushBits() {
+	if e.nBits > 0 {
+		pad := uint8(8 - e.nBits)
+		e.emitBits(1<<pad-1, pad)
+	}
+}
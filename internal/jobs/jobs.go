@@ -0,0 +1,205 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrNotFound is returned when waiting on a job that doesn't exist or has expired.
+var ErrNotFound = errors.New("job not found")
+
+type Status string
+
+const (
+	StatusQueued  Status = "queued"
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+// Job is a snapshot of a background job's state.
+type Job struct {
+	ID       string
+	Key      string
+	Name     string
+	Status   Status
+	Result   string
+	Error    string
+	Created  time.Time
+	Finished time.Time
+}
+
+// IsFinished reports whether the job has stopped running, successfully or not.
+func (j Job) IsFinished() bool {
+	return j.Status == StatusDone || j.Status == StatusFailed
+}
+
+// RunFunc performs the work of a job and returns the path of its result.
+type RunFunc func() (string, error)
+
+type record struct {
+	job     Job
+	cleanup func()
+	done    chan struct{}
+}
+
+// Manager runs jobs in the background with a bounded number of workers.
+// Finished jobs are kept around for ttl so clients can poll for the result.
+type Manager struct {
+	jobs    map[string]*record
+	workers chan struct{}
+	ttl     time.Duration
+	mutex   sync.Mutex
+}
+
+func NewManager(workers int, ttl time.Duration) *Manager {
+	m := &Manager{
+		jobs:    make(map[string]*record),
+		workers: make(chan struct{}, max(workers, 1)),
+		ttl:     ttl,
+	}
+	go m.cleanupLoop()
+	return m
+}
+
+// Submit queues run as a new job. If a job with the same non-empty key is
+// already queued or running, or done with its result still on disk, that job
+// is returned instead and cleanup is called immediately since the caller's
+// inputs are no longer needed. Otherwise cleanup is called once the job expires.
+func (m *Manager) Submit(key, name string, run RunFunc, cleanup func()) Job {
+	m.mutex.Lock()
+	if key != "" {
+		for _, r := range m.jobs {
+			if r.job.Key == key && r.reusable() {
+				m.mutex.Unlock()
+				if cleanup != nil {
+					cleanup()
+				}
+				return r.job
+			}
+		}
+	}
+
+	r := &record{
+		job: Job{
+			ID:      uuid.NewString(),
+			Key:     key,
+			Name:    name,
+			Status:  StatusQueued,
+			Created: time.Now(),
+		},
+		cleanup: cleanup,
+		done:    make(chan struct{}),
+	}
+	m.jobs[r.job.ID] = r
+	m.mutex.Unlock()
+
+	go m.run(r, run)
+
+	return r.job
+}
+
+// reusable reports whether the job can be handed out for a duplicate
+// submission. Results of done jobs may have been evicted from the cache.
+func (r *record) reusable() bool {
+	switch r.job.Status {
+	case StatusQueued, StatusRunning:
+		return true
+	case StatusDone:
+		_, err := os.Stat(r.job.Result)
+		return err == nil
+	}
+	return false
+}
+
+// Get returns the current state of the job with the given ID.
+func (m *Manager) Get(id string) (Job, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r, exists := m.jobs[id]
+	if !exists {
+		return Job{}, false
+	}
+	return r.job, true
+}
+
+// Wait blocks until the job with the given ID has finished or ctx is done
+// and returns the job's final state.
+func (m *Manager) Wait(ctx context.Context, id string) (Job, error) {
+	m.mutex.Lock()
+	r, exists := m.jobs[id]
+	m.mutex.Unlock()
+	if !exists {
+		return Job{}, ErrNotFound
+	}
+
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return Job{}, ctx.Err()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return r.job, nil
+}
+
+func (m *Manager) run(r *record, run RunFunc) {
+	m.workers <- struct{}{}
+	defer func() { <-m.workers }()
+
+	m.setStatus(r, StatusRunning)
+
+	result, err := run()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	defer close(r.done)
+	r.job.Finished = time.Now()
+	if err != nil {
+		r.job.Status = StatusFailed
+		r.job.Error = err.Error()
+		return
+	}
+	r.job.Status = StatusDone
+	r.job.Result = result
+}
+
+func (m *Manager) setStatus(r *record, status Status) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	r.job.Status = status
+}
+
+func (m *Manager) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.cleanExpired()
+	}
+}
+
+func (m *Manager) cleanExpired() {
+	m.mutex.Lock()
+	var expired []*record
+	for id, r := range m.jobs {
+		if r.job.IsFinished() && time.Since(r.job.Finished) > m.ttl {
+			delete(m.jobs, id)
+			expired = append(expired, r)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, r := range expired {
+		if r.cleanup != nil {
+			r.cleanup()
+		}
+	}
+}
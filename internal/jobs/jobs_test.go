@@ -0,0 +1,157 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFinished(t *testing.T, m *Manager, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		job, ok := m.Get(id)
+		if !ok {
+			t.Fatalf("job %q not found", id)
+		}
+		if job.IsFinished() {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %q did not finish", id)
+	return Job{}
+}
+
+func TestSubmitSuccess(t *testing.T) {
+	m := NewManager(1, time.Hour)
+	job := m.Submit("", "book.epub", func() (string, error) { return "out.kepub.epub", nil }, nil)
+
+	if job.Status != StatusQueued {
+		t.Fatalf("expected new job to be queued, got %q", job.Status)
+	}
+
+	job = waitFinished(t, m, job.ID)
+	if job.Status != StatusDone || job.Result != "out.kepub.epub" {
+		t.Fatalf("unexpected job state: %+v", job)
+	}
+}
+
+func TestSubmitFailure(t *testing.T) {
+	m := NewManager(1, time.Hour)
+	job := m.Submit("", "book.epub", func() (string, error) { return "", errors.New("boom") }, nil)
+
+	job = waitFinished(t, m, job.ID)
+	if job.Status != StatusFailed || job.Error != "boom" {
+		t.Fatalf("unexpected job state: %+v", job)
+	}
+}
+
+func TestSubmitDeduplicatesByKey(t *testing.T) {
+	m := NewManager(1, time.Hour)
+	release := make(chan struct{})
+	var runs, cleanups atomic.Int32
+
+	run := func() (string, error) {
+		runs.Add(1)
+		<-release
+		return "out", nil
+	}
+	cleanup := func() { cleanups.Add(1) }
+
+	first := m.Submit("key", "book.epub", run, cleanup)
+	second := m.Submit("key", "book.epub", run, cleanup)
+	close(release)
+
+	if first.ID != second.ID {
+		t.Fatalf("expected duplicate submission to return the existing job")
+	}
+	if cleanups.Load() != 1 {
+		t.Fatalf("expected duplicate inputs to be cleaned up immediately, got %d", cleanups.Load())
+	}
+
+	waitFinished(t, m, first.ID)
+	if runs.Load() != 1 {
+		t.Fatalf("expected a single run, got %d", runs.Load())
+	}
+}
+
+func TestSubmitSkipsDoneJobWithoutResult(t *testing.T) {
+	m := NewManager(1, time.Hour)
+	result := filepath.Join(t.TempDir(), "out.kepub.epub")
+	if err := os.WriteFile(result, []byte("book"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run := func() (string, error) { return result, nil }
+
+	first := m.Submit("key", "book.epub", run, nil)
+	waitFinished(t, m, first.ID)
+	if again := m.Submit("key", "book.epub", run, nil); again.ID != first.ID {
+		t.Fatalf("expected the done job to be reused while its result exists")
+	}
+
+	os.Remove(result)
+	if again := m.Submit("key", "book.epub", run, nil); again.ID == first.ID {
+		t.Fatalf("expected a new job once the result was removed")
+	}
+}
+
+func TestCleanExpired(t *testing.T) {
+	m := NewManager(1, 0)
+	var cleaned atomic.Bool
+	job := m.Submit("", "book.epub", func() (string, error) { return "out", nil }, func() { cleaned.Store(true) })
+	waitFinished(t, m, job.ID)
+
+	time.Sleep(time.Millisecond)
+	m.cleanExpired()
+
+	if _, ok := m.Get(job.ID); ok {
+		t.Fatalf("expected expired job to be removed")
+	}
+	if !cleaned.Load() {
+		t.Fatalf("expected cleanup to run for expired job")
+	}
+}
+
+func TestWait(t *testing.T) {
+	m := NewManager(1, time.Hour)
+	release := make(chan struct{})
+	job := m.Submit("", "book.epub", func() (string, error) {
+		<-release
+		return "out", nil
+	}, nil)
+
+	go close(release)
+
+	job, err := m.Wait(context.Background(), job.ID)
+	if err != nil {
+		t.Fatalf("Wait error: %v", err)
+	}
+	if job.Status != StatusDone || job.Result != "out" {
+		t.Fatalf("unexpected job state: %+v", job)
+	}
+
+	if _, err := m.Wait(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	m := NewManager(1, time.Hour)
+	release := make(chan struct{})
+	defer close(release)
+	job := m.Submit("", "book.epub", func() (string, error) {
+		<-release
+		return "out", nil
+	}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.Wait(ctx, job.ID); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,263 @@
+package kepub
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Style added to every document so the wrapper divs don't add spacing
+const koboStyle = `<style type="text/css" class="kobostylehacks">div#book-inner { margin-top: 0; margin-bottom: 0; }</style>`
+
+// Elements whose text is never split into koboSpans
+var skippedElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"svg":      true,
+	"math":     true,
+	"pre":      true,
+	"textarea": true,
+}
+
+// Elements that start a new paragraph for koboSpan numbering
+var blockElements = map[string]bool{
+	"p": true, "div": true, "li": true, "blockquote": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"dd": true, "dt": true, "td": true, "th": true,
+	"caption": true, "figcaption": true,
+}
+
+// Elements that never have content and are written self-closing
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;")
+)
+
+type frame struct {
+	void    bool
+	wrapped bool // wrapped in a koboSpan that must be closed with the element
+	skipped bool
+}
+
+type transformer struct {
+	w      *bufio.Writer
+	stack  []frame
+	inBody bool
+	skip   int
+	para   int
+	seg    int
+}
+
+// TransformContent rewrites an XHTML content document the way Kobo expects:
+// the body is wrapped in the book-columns/book-inner divs and every sentence
+// and image is wrapped in a numbered koboSpan so reading position and
+// highlights can be tracked.
+func TransformContent(w io.Writer, r io.Reader) error {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	t := &transformer{w: bufio.NewWriter(w)}
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse content document: %w", err)
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			t.start(tok)
+		case xml.EndElement:
+			t.end(tok)
+		case xml.CharData:
+			t.text(string(tok))
+		case xml.Comment:
+			t.w.WriteString("<!--" + string(tok) + "-->")
+		case xml.ProcInst:
+			t.w.WriteString("<?" + tok.Target + " " + string(tok.Inst) + "?>")
+		case xml.Directive:
+			t.w.WriteString("<!" + string(tok) + ">")
+		}
+	}
+
+	return t.w.Flush()
+}
+
+func (t *transformer) start(el xml.StartElement) {
+	name := strings.ToLower(el.Name.Local)
+	f := frame{void: voidElements[name]}
+
+	if t.inBody && t.skip == 0 {
+		if blockElements[name] {
+			t.newParagraph()
+		}
+		if name == "img" {
+			t.newParagraph()
+			t.openSpan()
+			f.wrapped = true
+		}
+	}
+	if skippedElements[name] {
+		t.skip++
+		f.skipped = true
+	}
+
+	t.w.WriteString("<" + qualifiedName(el.Name))
+	for _, attr := range el.Attr {
+		t.w.WriteString(" " + qualifiedName(attr.Name) + `="` + attrEscaper.Replace(attr.Value) + `"`)
+	}
+	if f.void {
+		t.w.WriteString("/>")
+	} else {
+		t.w.WriteString(">")
+	}
+
+	if name == "body" {
+		t.inBody = true
+		t.w.WriteString(`<div id="book-columns"><div id="book-inner">`)
+	}
+
+	t.stack = append(t.stack, f)
+}
+
+func (t *transformer) end(el xml.EndElement) {
+	name := strings.ToLower(el.Name.Local)
+
+	var f frame
+	if len(t.stack) > 0 {
+		f = t.stack[len(t.stack)-1]
+		t.stack = t.stack[:len(t.stack)-1]
+	}
+	if f.skipped {
+		t.skip--
+	}
+
+	switch name {
+	case "head":
+		t.w.WriteString(koboStyle)
+	case "body":
+		t.inBody = false
+		t.w.WriteString("</div></div>")
+	}
+
+	if !f.void {
+		t.w.WriteString("</" + qualifiedName(el.Name) + ">")
+	}
+	if f.wrapped {
+		t.w.WriteString("</span>")
+	}
+}
+
+func (t *transformer) text(s string) {
+	if !t.inBody || t.skip > 0 || strings.TrimSpace(s) == "" {
+		t.w.WriteString(textEscaper.Replace(s))
+		return
+	}
+
+	if t.para == 0 {
+		t.newParagraph()
+	}
+
+	// Keep leading whitespace outside of the spans
+	trimmed := strings.TrimLeftFunc(s, unicode.IsSpace)
+	t.w.WriteString(s[:len(s)-len(trimmed)])
+
+	for _, sentence := range splitSentences(trimmed) {
+		t.openSpan()
+		t.w.WriteString(textEscaper.Replace(sentence))
+		t.w.WriteString("</span>")
+	}
+}
+
+func (t *transformer) newParagraph() {
+	t.para++
+	t.seg = 0
+}
+
+func (t *transformer) openSpan() {
+	t.seg++
+	fmt.Fprintf(t.w, `<span class="koboSpan" id="kobo.%d.%d">`, t.para, t.seg)
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// splitSentences breaks s into sentences. A sentence ends with terminal
+// punctuation, optionally followed by closing quotes or brackets, and
+// then whitespace. Trailing whitespace stays with the sentence.
+func splitSentences(s string) []string {
+	var sentences []string
+	start, i := 0, 0
+
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		if !isTerminal(r) {
+			continue
+		}
+
+		for i < len(s) {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if !isTerminal(r) && !isCloser(r) {
+				break
+			}
+			i += size
+		}
+
+		end := i
+		for end < len(s) {
+			r, size := utf8.DecodeRuneInString(s[end:])
+			if !unicode.IsSpace(r) {
+				break
+			}
+			end += size
+		}
+
+		// Punctuation inside a word such as "3.14" or "e.g." doesn't end a sentence
+		if end == i && end < len(s) {
+			continue
+		}
+
+		sentences = append(sentences, s[start:end])
+		start, i = end, end
+	}
+
+	if start < len(s) {
+		sentences = append(sentences, s[start:])
+	}
+	return sentences
+}
+
+func isTerminal(r rune) bool {
+	switch r {
+	case '.', '!', '?', '…':
+		return true
+	}
+	return false
+}
+
+func isCloser(r rune) bool {
+	switch r {
+	case '"', '\'', '”', '’', ')', ']', '»':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package kepub
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/evan-buss/opds-proxy/internal/formats"
+)
+
+// ConvertFile transforms the EPUB at src into a KEPUB written to dst.
+func ConvertFile(src, dst string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return fmt.Errorf("failed to open EPUB %q: %w", src, err)
+	}
+	defer r.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create file %q: %w", dst, err)
+	}
+
+	if err := Transform(out, &r.Reader); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("failed to write file %q: %w", dst, err)
+	}
+	return nil
+}
+
+// Transform writes a KEPUB version of the EPUB archive r to w.
+// Content documents are rewritten one at a time, everything else is
+// copied over without being decompressed.
+func Transform(w io.Writer, r *zip.Reader) error {
+	zw := zip.NewWriter(w)
+
+	// The mimetype must be the first entry and stored uncompressed
+	mimetype, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return fmt.Errorf("failed to write mimetype: %w", err)
+	}
+	if _, err := io.WriteString(mimetype, formats.EPUB.MimeType); err != nil {
+		return fmt.Errorf("failed to write mimetype: %w", err)
+	}
+
+	for _, f := range r.File {
+		if f.Name == "mimetype" {
+			continue
+		}
+
+		var err error
+		if isContentDocument(f.Name) {
+			err = transformEntry(zw, f)
+		} else {
+			err = copyEntry(zw, f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to finish KEPUB archive: %w", err)
+	}
+	return nil
+}
+
+func isContentDocument(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".xhtml", ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+func copyEntry(zw *zip.Writer, f *zip.File) error {
+	header := f.FileHeader
+	w, err := zw.CreateRaw(&header)
+	if err != nil {
+		return fmt.Errorf("failed to create entry %q: %w", f.Name, err)
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return fmt.Errorf("failed to open entry %q: %w", f.Name, err)
+	}
+	if _, err := io.Copy(w, raw); err != nil {
+		return fmt.Errorf("failed to copy entry %q: %w", f.Name, err)
+	}
+	return nil
+}
+
+func transformEntry(zw *zip.Writer, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open entry %q: %w", f.Name, err)
+	}
+	content, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read entry %q: %w", f.Name, err)
+	}
+
+	// Documents we can't parse, or that were already converted, are kept as is
+	var buf bytes.Buffer
+	if bytes.Contains(content, []byte("koboSpan")) || TransformContent(&buf, bytes.NewReader(content)) != nil {
+		buf.Reset()
+		buf.Write(content)
+	}
+
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     f.Name,
+		Method:   zip.Deflate,
+		Modified: f.Modified,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create entry %q: %w", f.Name, err)
+	}
+	if _, err := buf.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to write entry %q: %w", f.Name, err)
+	}
+	return nil
+}
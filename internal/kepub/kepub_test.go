@@ -0,0 +1,139 @@
+package kepub
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitSentences(t *testing.T) {
+	cases := []struct {
+		in  string
+		out []string
+	}{
+		{"One sentence", []string{"One sentence"}},
+		{"First. Second!  Third?", []string{"First. ", "Second!  ", "Third?"}},
+		{`He said "stop." Then left.`, []string{`He said "stop." `, "Then left."}},
+		{"Pi is 3.14 exactly. Done", []string{"Pi is 3.14 exactly. ", "Done"}},
+		{"Wait… what?", []string{"Wait… ", "what?"}},
+	}
+	for _, c := range cases {
+		if got := splitSentences(c.in); !reflect.DeepEqual(got, c.out) {
+			t.Errorf("splitSentences(%q) = %q, want %q", c.in, got, c.out)
+		}
+	}
+}
+
+func TestTransformContent(t *testing.T) {
+	in := `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>Chapter</title></head>
+<body epub:type="bodymatter">
+<h1>Title</h1>
+<p>First sentence. Second &amp; last.<br/></p>
+<img src="cover.jpg" alt=""/>
+<pre>keep. as is.</pre>
+</body>
+</html>`
+
+	var out bytes.Buffer
+	if err := TransformContent(&out, strings.NewReader(in)); err != nil {
+		t.Fatalf("TransformContent: %v", err)
+	}
+	got := out.String()
+
+	expected := []string{
+		`<?xml version="1.0" encoding="utf-8"?>`,
+		`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">`,
+		`<title>Chapter</title>` + koboStyle + `</head>`,
+		`<body epub:type="bodymatter"><div id="book-columns"><div id="book-inner">`,
+		`<h1><span class="koboSpan" id="kobo.1.1">Title</span></h1>`,
+		`<p><span class="koboSpan" id="kobo.2.1">First sentence. </span><span class="koboSpan" id="kobo.2.2">Second &amp; last.</span><br/></p>`,
+		`<span class="koboSpan" id="kobo.3.1"><img src="cover.jpg" alt=""/></span>`,
+		`<pre>keep. as is.</pre>`,
+		`</div></div></body>`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(got, e) {
+			t.Errorf("expected output to contain %q\ngot: %s", e, got)
+		}
+	}
+}
+
+func TestTransformContentHTMLEntities(t *testing.T) {
+	in := `<html><body><p>Caf&eacute;&nbsp;time</p></body></html>`
+
+	var out bytes.Buffer
+	if err := TransformContent(&out, strings.NewReader(in)); err != nil {
+		t.Fatalf("TransformContent: %v", err)
+	}
+	if !strings.Contains(out.String(), "Café time") {
+		t.Fatalf("expected entities to be decoded, got %s", out.String())
+	}
+}
+
+func TestTransform(t *testing.T) {
+	var epub bytes.Buffer
+	zw := zip.NewWriter(&epub)
+	files := map[string]string{
+		"OEBPS/content.opf":   `<package/>`,
+		"OEBPS/chapter.xhtml": `<html><body><p>Hello.</p></body></html>`,
+		"OEBPS/kepub.xhtml":   `<html><body><p><span class="koboSpan" id="kobo.1.1">Done.</span></p></body></html>`,
+	}
+	for _, name := range []string{"OEBPS/content.opf", "OEBPS/chapter.xhtml", "OEBPS/kepub.xhtml"} {
+		w, _ := zw.Create(name)
+		io.WriteString(w, files[name])
+	}
+	w, _ := zw.Create("mimetype")
+	io.WriteString(w, "application/epub+zip")
+	zw.Close()
+
+	zr, err := zip.NewReader(bytes.NewReader(epub.Bytes()), int64(epub.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := Transform(&out, zr); err != nil {
+		t.Fatalf("Transform: %v", err)
+	}
+
+	result, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+
+	if result.File[0].Name != "mimetype" || result.File[0].Method != zip.Store {
+		t.Fatalf("expected uncompressed mimetype first, got %q", result.File[0].Name)
+	}
+	if len(result.File) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(result.File))
+	}
+
+	read := func(name string) string {
+		for _, f := range result.File {
+			if f.Name == name {
+				rc, _ := f.Open()
+				defer rc.Close()
+				b, _ := io.ReadAll(rc)
+				return string(b)
+			}
+		}
+		t.Fatalf("missing entry %q", name)
+		return ""
+	}
+
+	if got := read("OEBPS/content.opf"); got != files["OEBPS/content.opf"] {
+		t.Errorf("expected non-content entries to be copied, got %q", got)
+	}
+	if got := read("OEBPS/chapter.xhtml"); !strings.Contains(got, `<span class="koboSpan" id="kobo.1.1">Hello.</span>`) {
+		t.Errorf("expected chapter to be transformed, got %q", got)
+	}
+	if got := read("OEBPS/kepub.xhtml"); got != files["OEBPS/kepub.xhtml"] {
+		t.Errorf("expected existing KEPUB content to be left alone, got %q", got)
+	}
+}
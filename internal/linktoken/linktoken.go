@@ -0,0 +1,212 @@
+package linktoken
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Length of the HMAC prefix used as a token, 12 bytes encode to 16 characters
+const tokenBytes = 12
+
+// DefaultMaxLinks is how many tokens a store keeps when New is given zero
+const DefaultMaxLinks = 100_000
+
+// Store hands out short opaque tokens for upstream URLs so links rendered by
+// the proxy don't expose upstream hosts and can't be pointed elsewhere.
+// Tokens are derived from an HMAC of the URL, and only tokens the store has
+// handed out resolve. The store keeps the most recently used maxLinks
+// tokens, older links stop resolving. When backed by a file, tokens survive
+// restarts so bookmarks keep working.
+type Store struct {
+	key      []byte
+	raw      map[string]bool
+	maxLinks int
+	urls     map[string]*list.Element
+	order    *list.List // front is the most recently used link
+	path     string
+	file     *os.File
+	lines    int // lines in the file, compacted once it holds twice maxLinks
+	mutex    sync.Mutex
+}
+
+type link struct {
+	token string
+	url   string
+}
+
+// New returns a store that signs tokens with key and keeps up to maxLinks
+// of them. Tokens are appended to the file at path, if set, and loaded from
+// it again on startup. URLs in raw resolve as themselves so configured feeds
+// can be linked to directly.
+func New(key []byte, path string, maxLinks int, raw []string) (*Store, error) {
+	// Derive a dedicated key rather than reusing the cookie key as is
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("opds-proxy link tokens"))
+
+	if maxLinks <= 0 {
+		maxLinks = DefaultMaxLinks
+	}
+	s := &Store{
+		key:      mac.Sum(nil),
+		raw:      make(map[string]bool),
+		maxLinks: maxLinks,
+		urls:     make(map[string]*list.Element),
+		order:    list.New(),
+		path:     path,
+	}
+	for _, u := range raw {
+		s.raw[u] = true
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Encode returns the token for upstreamURL.
+func (s *Store) Encode(upstreamURL string) string {
+	token := s.sign(upstreamURL)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if elem, exists := s.urls[token]; exists {
+		s.order.MoveToFront(elem)
+		return token
+	}
+
+	s.add(token, upstreamURL)
+	if s.file != nil {
+		// Losing a line only breaks that link after a restart, the token is still served
+		if _, err := fmt.Fprintf(s.file, "%s\t%s\n", token, upstreamURL); err == nil {
+			s.lines++
+		}
+		if s.lines > 2*s.maxLinks {
+			_ = s.compact()
+		}
+	}
+	return token
+}
+
+// Resolve returns the upstream URL for a token, or the value itself if it
+// is one of the raw URLs. Unknown, evicted or tampered tokens don't resolve.
+func (s *Store) Resolve(value string) (string, bool) {
+	if s.raw[value] {
+		return value, true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elem, ok := s.urls[value]
+	if !ok {
+		return "", false
+	}
+	s.order.MoveToFront(elem)
+	return elem.Value.(*link).url, true
+}
+
+func (s *Store) sign(upstreamURL string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(upstreamURL))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:tokenBytes])
+}
+
+// add stores a token and evicts the least recently used ones over the cap.
+func (s *Store) add(token, upstreamURL string) {
+	if elem, exists := s.urls[token]; exists {
+		s.order.MoveToFront(elem)
+		return
+	}
+	s.urls[token] = s.order.PushFront(&link{token: token, url: upstreamURL})
+	for s.order.Len() > s.maxLinks {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.urls, oldest.Value.(*link).token)
+	}
+}
+
+// load reads previously issued tokens, later lines being the more recently
+// used. Lines signed with another key, such as after the cookie keys were
+// regenerated, are ignored.
+func (s *Store) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open link token file %q: %w", s.path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		token, upstreamURL, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok || !hmac.Equal([]byte(token), []byte(s.sign(upstreamURL))) {
+			continue
+		}
+		s.add(token, upstreamURL)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read link token file %q: %w", s.path, err)
+	}
+	return nil
+}
+
+// compact rewrites the file with only the tokens the store still holds,
+// oldest first, and reopens it for appending.
+func (s *Store) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to compact link token file %q: %w", s.path, err)
+	}
+	w := bufio.NewWriter(tmp)
+	for elem := s.order.Back(); elem != nil; elem = elem.Prev() {
+		l := elem.Value.(*link)
+		fmt.Fprintf(w, "%s\t%s\n", l.token, l.url)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to compact link token file %q: %w", s.path, err)
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to compact link token file %q: %w", s.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to compact link token file %q: %w", s.path, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to compact link token file %q: %w", s.path, err)
+	}
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open link token file %q: %w", s.path, err)
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	s.lines = s.order.Len()
+	return nil
+}
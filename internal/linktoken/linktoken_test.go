@@ -0,0 +1,144 @@
+package linktoken
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncodeResolve(t *testing.T) {
+	s, err := New([]byte("secret"), "", 0, nil)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	upstream := "http://calibre:8083/opds/books?offset=100"
+	token := s.Encode(upstream)
+	if len(token) != 16 || strings.Contains(token, "calibre") {
+		t.Fatalf("expected a short opaque token, got %q", token)
+	}
+	if again := s.Encode(upstream); again != token {
+		t.Errorf("expected the same token for the same URL, got %q and %q", token, again)
+	}
+
+	got, ok := s.Resolve(token)
+	if !ok || got != upstream {
+		t.Errorf("Resolve(%q) = %q, %v", token, got, ok)
+	}
+}
+
+func TestResolveRejectsUnknownTokens(t *testing.T) {
+	s, err := New([]byte("secret"), "", 0, nil)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	token := s.Encode("http://calibre:8083/opds")
+
+	tampered := []byte(token)
+	tampered[0] ^= 1
+	for _, value := range []string{string(tampered), "http://169.254.169.254/", ""} {
+		if _, ok := s.Resolve(value); ok {
+			t.Errorf("expected %q not to resolve", value)
+		}
+	}
+}
+
+func TestResolveRawURLs(t *testing.T) {
+	s, err := New([]byte("secret"), "", 0, []string{"http://calibre:8083/opds"})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	if got, ok := s.Resolve("http://calibre:8083/opds"); !ok || got != "http://calibre:8083/opds" {
+		t.Errorf("expected configured feed URL to resolve to itself, got %q, %v", got, ok)
+	}
+	if _, ok := s.Resolve("http://calibre:8083/admin"); ok {
+		t.Error("expected other raw URLs not to resolve")
+	}
+}
+
+func TestTokensPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.db")
+
+	s, err := New([]byte("secret"), path, 0, nil)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	token := s.Encode("http://calibre:8083/opds/new")
+
+	reopened, err := New([]byte("secret"), path, 0, nil)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	if got, ok := reopened.Resolve(token); !ok || got != "http://calibre:8083/opds/new" {
+		t.Errorf("expected token to survive a restart, got %q, %v", got, ok)
+	}
+
+	// Lines edited by hand don't resolve either
+	data, _ := os.ReadFile(path)
+	forged := strings.Replace(string(data), "/opds/new", "/admin", 1)
+	if err := os.WriteFile(path, []byte(forged), 0600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	forgedStore, err := New([]byte("secret"), path, 0, nil)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	if _, ok := forgedStore.Resolve(token); ok {
+		t.Error("expected a forged entry to be ignored")
+	}
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	rekeyed, err := New([]byte("other"), path, 0, nil)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	if _, ok := rekeyed.Resolve(token); ok {
+		t.Error("expected tokens signed with another key to be dropped")
+	}
+}
+
+func TestTokensAreShort(t *testing.T) {
+	s, err := New([]byte("secret"), "", 0, nil)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	upstream := "http://calibre.home.lan:8083/opds/navcatalog/4f6e6577?offset=0&library_id=Calibre_Library&sort=timestamp"
+	if token := s.Encode(upstream); len(token) >= len(upstream)/2 {
+		t.Errorf("token %q isn't much shorter than %q", token, upstream)
+	}
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.db")
+	s, err := New([]byte("secret"), path, 2, nil)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	a := s.Encode("http://calibre:8083/opds/a")
+	b := s.Encode("http://calibre:8083/opds/b")
+	s.Resolve(a)
+	s.Encode("http://calibre:8083/opds/c")
+	if _, ok := s.Resolve(b); ok {
+		t.Error("expected the least recently used token to be evicted")
+	}
+	if _, ok := s.Resolve(a); !ok {
+		t.Error("expected a recently used token to survive")
+	}
+
+	// The file is compacted so it doesn't grow with every link rendered
+	for i := range 10 {
+		s.Encode(fmt.Sprintf("http://calibre:8083/opds/search?q=%d", i))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines > 4 {
+		t.Errorf("file holds %d lines, want at most twice the cap", lines)
+	}
+}
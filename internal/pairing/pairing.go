@@ -0,0 +1,229 @@
+package pairing
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/gorilla/securecookie"
+)
+
+// How long a pairing code can be redeemed for
+const CodeTTL = 10 * time.Minute
+
+// Letters that are hard to mix up, without vowels so codes don't spell words
+const codeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+const codeLength = 8
+
+const credentialsName = "device-credentials"
+
+var ErrNotFound = errors.New("device not found")
+
+// Device is an e-reader paired with a user's logins. The token handed to
+// the device isn't stored, only its hash, and credentials are encrypted
+// with the cookie keys.
+type Device struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	User        string    `json:"user"`
+	Credentials string    `json:"credentials"`
+	Created     time.Time `json:"created"`
+}
+
+type pendingCode struct {
+	token   string
+	expires time.Time
+}
+
+// Store keeps paired devices on disk and the short-lived codes used to
+// hand a device its token.
+type Store struct {
+	path    string
+	codec   *securecookie.SecureCookie
+	mutex   sync.Mutex
+	devices map[string]Device
+	codes   map[string]pendingCode
+}
+
+// New loads the devices stored at path, if any. The codec encrypts stored
+// credentials and must not expire values, since devices stay paired until
+// they're revoked.
+func New(path string, codec *securecookie.SecureCookie) (*Store, error) {
+	st := &Store{
+		path:    path,
+		codec:   codec,
+		devices: make(map[string]Device),
+		codes:   make(map[string]pendingCode),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read devices file %q: %w", path, err)
+	}
+
+	var devices []Device
+	if err := json.Unmarshal(data, &devices); err != nil {
+		return nil, fmt.Errorf("failed to parse devices file %q: %w", path, err)
+	}
+	for _, d := range devices {
+		st.devices[d.ID] = d
+	}
+	return st, nil
+}
+
+// Pair registers a new device for user with a copy of their credentials.
+// It returns the device's token and a code that can be exchanged for it
+// once within CodeTTL.
+func (st *Store) Pair(name, user string, creds map[string]auth.Credentials) (token, code string, err error) {
+	encoded, err := st.codec.Encode(credentialsName, creds)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode credentials: %w", err)
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(16))
+	code = newCode()
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	device := Device{ID: tokenID(token), Name: name, User: user, Credentials: encoded, Created: time.Now()}
+	st.devices[device.ID] = device
+	if err := st.save(); err != nil {
+		delete(st.devices, device.ID)
+		return "", "", err
+	}
+
+	now := time.Now()
+	for c, pending := range st.codes {
+		if now.After(pending.expires) {
+			delete(st.codes, c)
+		}
+	}
+	st.codes[code] = pendingCode{token: token, expires: now.Add(CodeTTL)}
+	return token, code, nil
+}
+
+// Redeem exchanges a pairing code for the device token. Codes only work
+// once and are case-insensitive, dashes and spaces are ignored.
+func (st *Store) Redeem(code string) (string, bool) {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	pending, ok := st.codes[code]
+	if !ok {
+		return "", false
+	}
+	delete(st.codes, code)
+	if time.Now().After(pending.expires) {
+		return "", false
+	}
+	return pending.token, true
+}
+
+// Restore returns the device for token and its credentials.
+func (st *Store) Restore(token string) (Device, map[string]auth.Credentials, bool) {
+	st.mutex.Lock()
+	device, ok := st.devices[tokenID(token)]
+	st.mutex.Unlock()
+	if !ok {
+		return Device{}, nil, false
+	}
+
+	creds := make(map[string]auth.Credentials)
+	if err := st.codec.Decode(credentialsName, device.Credentials, &creds); err != nil {
+		// Stored with other keys, the device has to be paired again
+		return Device{}, nil, false
+	}
+	return device, creds, true
+}
+
+// Devices returns the user's devices, newest first.
+func (st *Store) Devices(user string) []Device {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	var devices []Device
+	for _, d := range st.devices {
+		if d.User == user {
+			devices = append(devices, d)
+		}
+	}
+	slices.SortFunc(devices, func(a, b Device) int { return b.Created.Compare(a.Created) })
+	return devices
+}
+
+// Revoke unpairs one of the user's devices.
+func (st *Store) Revoke(user, id string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	device, ok := st.devices[id]
+	if !ok || device.User != user {
+		return ErrNotFound
+	}
+	delete(st.devices, id)
+	if err := st.save(); err != nil {
+		st.devices[id] = device
+		return err
+	}
+	return nil
+}
+
+// save writes all devices to disk, replacing the file atomically.
+func (st *Store) save() error {
+	devices := make([]Device, 0, len(st.devices))
+	for _, d := range st.devices {
+		devices = append(devices, d)
+	}
+	data, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write devices file: %w", err)
+	}
+	if err := os.Rename(tmp, st.path); err != nil {
+		return fmt.Errorf("failed to write devices file: %w", err)
+	}
+	return nil
+}
+
+// newCode returns a random pairing code. Bytes past the last multiple of
+// the alphabet size are skipped so every letter is equally likely.
+func newCode() string {
+	limit := byte(256 - 256%len(codeAlphabet))
+	code := make([]byte, 0, codeLength)
+	buf := make([]byte, 1)
+	for len(code) < codeLength {
+		rand.Read(buf)
+		if buf[0] < limit {
+			code = append(code, codeAlphabet[int(buf[0])%len(codeAlphabet)])
+		}
+	}
+	return string(code)
+}
+
+// tokenID identifies a device by the hash of its token, so the devices
+// file can't be used to log in.
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
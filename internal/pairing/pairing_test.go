@@ -0,0 +1,84 @@
+package pairing
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/gorilla/securecookie"
+)
+
+func testCodec() *securecookie.SecureCookie {
+	return securecookie.New([]byte("0123456789abcdef0123456789abcdef"), []byte("0123456789abcdef0123456789abcdef")).MaxAge(0)
+}
+
+func TestPairAndRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	st, err := New(path, testCodec())
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	creds := map[string]auth.Credentials{"http://calibre:8083": {Username: "alice", Password: "secret"}}
+	token, code, err := st.Pair("Kobo", "alice", creds)
+	if err != nil {
+		t.Fatalf("Pair error: %v", err)
+	}
+	if len(code) != codeLength || strings.Trim(code, codeAlphabet) != "" {
+		t.Errorf("unexpected code %q", code)
+	}
+
+	// Codes are forgiving about formatting but only work once
+	redeemed, ok := st.Redeem(strings.ToLower(code[:4] + "-" + code[4:]))
+	if !ok || redeemed != token {
+		t.Fatalf("Redeem() = %q, %v", redeemed, ok)
+	}
+	if _, ok := st.Redeem(code); ok {
+		t.Error("expected a code to only be redeemable once")
+	}
+
+	// Neither the token nor the password end up in the file
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), token) || strings.Contains(string(data), "secret") {
+		t.Error("expected the devices file not to contain the token or password")
+	}
+
+	reopened, err := New(path, testCodec())
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	device, restored, ok := reopened.Restore(token)
+	if !ok || device.User != "alice" || device.Name != "Kobo" || restored["http://calibre:8083"].Password != "secret" {
+		t.Errorf("Restore() = %+v, %+v, %v", device, restored, ok)
+	}
+	if _, _, ok := reopened.Restore("not-a-token"); ok {
+		t.Error("expected unknown token not to restore")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	st, err := New(filepath.Join(t.TempDir(), "devices.json"), testCodec())
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	token, _, err := st.Pair("Kobo", "alice", nil)
+	if err != nil {
+		t.Fatalf("Pair error: %v", err)
+	}
+
+	devices := st.Devices("alice")
+	if len(devices) != 1 || len(st.Devices("bob")) != 0 {
+		t.Fatalf("expected one device for alice only, got %+v", devices)
+	}
+	if err := st.Revoke("bob", devices[0].ID); err != ErrNotFound {
+		t.Errorf("expected other users not to revoke the device, got %v", err)
+	}
+	if err := st.Revoke("alice", devices[0].ID); err != nil {
+		t.Fatalf("Revoke error: %v", err)
+	}
+	if _, _, ok := st.Restore(token); ok {
+		t.Error("expected revoked device not to restore")
+	}
+}
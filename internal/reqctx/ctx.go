@@ -3,6 +3,7 @@ package reqctx
 import (
 	"context"
 	"log/slog"
+	"net/netip"
 )
 
 type contextKey string
@@ -10,6 +11,8 @@ type contextKey string
 const (
 	requestLoggerKey  = contextKey("requestLogger")
 	isLocalRequestKey = contextKey("isLocalRequest")
+	clientIPKey       = contextKey("clientIP")
+	userKey           = contextKey("user")
 )
 
 func WithRequestLogger(ctx context.Context, log *slog.Logger) context.Context {
@@ -37,3 +40,23 @@ func IsLocal(ctx context.Context) bool {
 	}
 	return false
 }
+
+func WithClientIP(ctx context.Context, ip netip.Addr) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+// ClientIP returns the client address resolved from trusted proxies, if set.
+func ClientIP(ctx context.Context) (netip.Addr, bool) {
+	ip, ok := ctx.Value(clientIPKey).(netip.Addr)
+	return ip, ok
+}
+
+func WithUser(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, userKey, username)
+}
+
+// User returns the name of the logged in proxy user, if any.
+func User(ctx context.Context) string {
+	username, _ := ctx.Value(userKey).(string)
+	return username
+}
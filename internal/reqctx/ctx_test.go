@@ -3,6 +3,7 @@ package reqctx
 import (
 	"context"
 	"log/slog"
+	"net/netip"
 	"testing"
 )
 
@@ -27,3 +28,13 @@ func TestIsLocalRoundTrip(t *testing.T) {
 		t.Fatalf("expected IsLocal false")
 	}
 }
+
+func TestClientIPRoundTrip(t *testing.T) {
+	if _, ok := ClientIP(context.Background()); ok {
+		t.Fatalf("expected no client IP")
+	}
+	want := netip.MustParseAddr("192.0.2.1")
+	if got, ok := ClientIP(WithClientIP(context.Background(), want)); !ok || got != want {
+		t.Fatalf("ClientIP did not round-trip, got %v", got)
+	}
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/device"
 	"github.com/evan-buss/opds-proxy/internal/envextended"
+	"github.com/evan-buss/opds-proxy/internal/formats"
 	"github.com/gorilla/securecookie"
 	"github.com/knadh/koanf/parsers/json"
 	"github.com/knadh/koanf/parsers/yaml"
@@ -17,6 +23,7 @@ import (
 	"github.com/knadh/koanf/providers/posflag"
 	"github.com/knadh/koanf/v2"
 	flag "github.com/spf13/pflag"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Version information set at build time
@@ -25,10 +32,29 @@ var commit = "unknown"
 var date = "unknown"
 
 type ProxyConfig struct {
-	Port      string       `koanf:"port"`
-	Auth      AuthConfig   `koanf:"auth"`
-	Feeds     []FeedConfig `koanf:"feeds" `
-	DebugMode bool         `koanf:"debug"`
+	Port           string            `koanf:"port"`
+	Auth           AuthConfig        `koanf:"auth"`
+	Feeds          []FeedConfig      `koanf:"feeds" `
+	Cache          CacheConfig       `koanf:"cache"`
+	Converters     []ConverterConfig `koanf:"converters"`
+	AllowedHosts   []string          `koanf:"allowed_hosts"`
+	LinksFile      string            `koanf:"links_file"`
+	DevicesFile    string            `koanf:"devices_file"`
+	TrustedProxies []string          `koanf:"trusted_proxies"`
+	ClientIPHeader string            `koanf:"client_ip_header"`
+	Users          []UserConfig      `koanf:"users"`
+	ForwardAuth    ForwardAuthConfig `koanf:"forward_auth"`
+	DebugMode      bool              `koanf:"debug"`
+}
+
+type CacheConfig struct {
+	Disabled       bool          `koanf:"disabled"`
+	Dir            string        `koanf:"dir"`
+	MaxSizeMB      int64         `koanf:"max_size_mb"`
+	ImageDir       string        `koanf:"image_dir"`
+	ImageMaxSizeMB int64         `koanf:"image_max_size_mb"`
+	FeedMaxSizeMB  int64         `koanf:"feed_max_size_mb"`
+	FeedTTL        time.Duration `koanf:"feed_ttl"`
 }
 
 type AuthConfig struct {
@@ -36,15 +62,47 @@ type AuthConfig struct {
 	BlockKey string `koanf:"block_key"`
 }
 
+type ConverterConfig struct {
+	Name    string        `koanf:"name"`
+	Command []string      `koanf:"command"`
+	Input   string        `koanf:"input"`
+	Output  string        `koanf:"output"`
+	Devices []string      `koanf:"devices"`
+	Timeout time.Duration `koanf:"timeout"`
+}
+
 type FeedConfig struct {
-	Name string          `koanf:"name"`
-	Url  string          `koanf:"url"`
-	Auth *FeedConfigAuth `koanf:"auth"`
+	Name      string          `koanf:"name"`
+	Url       string          `koanf:"url"`
+	Auth      *FeedConfigAuth `koanf:"auth"`
+	UserAgent string          `koanf:"user_agent"`
+	CacheTTL  time.Duration   `koanf:"cache_ttl"`
+}
+
+type UserConfig struct {
+	Username     string                  `koanf:"username"`
+	PasswordHash string                  `koanf:"password_hash"`
+	Feeds        []string                `koanf:"feeds"`
+	Credentials  []UserCredentialsConfig `koanf:"credentials"`
+}
+
+type UserCredentialsConfig struct {
+	Feed     string `koanf:"feed"`
+	Username string `koanf:"username"`
+	Password string `koanf:"password"`
+	Token    string `koanf:"token"`
+}
+
+type ForwardAuthConfig struct {
+	Header string `koanf:"header"`
 }
 
 type FeedConfigAuth struct {
+	Type      string `koanf:"type"`
+	Name      string `koanf:"name"`
 	Username  string `koanf:"username"`
 	Password  string `koanf:"password"`
+	Token     string `koanf:"token"`
 	LocalOnly bool   `koanf:"local_only"`
 }
 
@@ -56,6 +114,7 @@ func main() {
 	fs.StringP("port", "p", "8080", "port to listen on")
 	fs.StringP("config", "c", "config.yml", "config file to load")
 	fs.Bool("generate-keys", false, "generate cookie signing keys and exit")
+	fs.Bool("hash-password", false, "read a password from stdin, print its hash for the users section and exit")
 	fs.BoolP("version", "v", false, "print version and exit")
 	fs.Usage = func() {
 		fmt.Println("Usage: opds-proxy [flags]")
@@ -80,6 +139,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	if hashPassword, _ := fs.GetBool("hash-password"); hashPassword {
+		if err := displayPasswordHash(os.Stdin); err != nil {
+			slog.Error("error hashing password", slog.Any("error", err))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// YAML Config
 	configPath, _ := fs.GetString("config")
 	if err := k.Load(file.Provider(configPath), yaml.Parser()); err != nil && !os.IsNotExist(err) {
@@ -114,6 +181,31 @@ func main() {
 		config.Auth.BlockKey = blockKey
 	}
 
+	if config.Cache.Dir == "" {
+		config.Cache.Dir = "cache/"
+	}
+	if config.Cache.MaxSizeMB == 0 {
+		config.Cache.MaxSizeMB = 1024
+	}
+	if config.Cache.ImageDir == "" {
+		config.Cache.ImageDir = "image-cache/"
+	}
+	if config.Cache.ImageMaxSizeMB == 0 {
+		config.Cache.ImageMaxSizeMB = 128
+	}
+	if config.Cache.FeedMaxSizeMB == 0 {
+		config.Cache.FeedMaxSizeMB = 32
+	}
+	if config.Cache.FeedTTL == 0 {
+		config.Cache.FeedTTL = time.Minute
+	}
+	if config.LinksFile == "" {
+		config.LinksFile = "links.db"
+	}
+	if config.DevicesFile == "" {
+		config.DevicesFile = "devices.json"
+	}
+
 	if err := config.Validate(); err != nil {
 		slog.Error("invalid configuration", slog.Any("error", err))
 		os.Exit(1)
@@ -157,6 +249,24 @@ func displayKeys() (string, string) {
 	return hashKey, blockKey
 }
 
+func displayPasswordHash(r io.Reader) error {
+	password, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("password must not be empty")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(hash))
+	return nil
+}
+
 func envCallback(key string, value string) (string, interface{}) {
 	key = strings.TrimPrefix(key, "OPDS__")
 	key = strings.ReplaceAll(key, "__", ".")
@@ -173,6 +283,22 @@ func (c *ProxyConfig) Validate() error {
 		return errors.New("auth.hash_key and auth.block_key are required")
 	}
 
+	if c.Cache.MaxSizeMB < 0 {
+		return errors.New("cache.max_size_mb must not be negative")
+	}
+
+	if c.Cache.ImageMaxSizeMB < 0 {
+		return errors.New("cache.image_max_size_mb must not be negative")
+	}
+
+	if c.Cache.FeedMaxSizeMB < 0 {
+		return errors.New("cache.feed_max_size_mb must not be negative")
+	}
+
+	if c.Cache.FeedTTL < 0 {
+		return errors.New("cache.feed_ttl must not be negative")
+	}
+
 	if len(c.Feeds) == 0 {
 		return errors.New("at least one feed must be defined")
 	}
@@ -185,6 +311,70 @@ func (c *ProxyConfig) Validate() error {
 		if feed.Url == "" {
 			return errors.New("feed.url is required")
 		}
+
+		if feed.CacheTTL < 0 {
+			return fmt.Errorf("feed %q: cache_ttl must not be negative", feed.Name)
+		}
+
+		if feed.Auth != nil {
+			scheme, err := auth.ParseScheme(feed.Auth.Type)
+			if err != nil {
+				return fmt.Errorf("feed %q: %w", feed.Name, err)
+			}
+			if scheme.NeedsName() && feed.Auth.Name == "" {
+				return fmt.Errorf("feed %q: auth.name is required for %s auth", feed.Name, scheme)
+			}
+		}
+	}
+
+	usernames := make(map[string]bool)
+	for _, user := range c.Users {
+		if user.Username == "" {
+			return errors.New("user.username is required")
+		}
+
+		if user.PasswordHash == "" && c.ForwardAuth.Header == "" {
+			return fmt.Errorf("user %q: password_hash is required", user.Username)
+		}
+
+		for _, creds := range user.Credentials {
+			if creds.Feed == "" {
+				return fmt.Errorf("user %q: credentials.feed is required", user.Username)
+			}
+		}
+
+		if usernames[user.Username] {
+			return fmt.Errorf("user %q is defined more than once", user.Username)
+		}
+		usernames[user.Username] = true
+	}
+
+	if c.ForwardAuth.Header != "" && len(c.TrustedProxies) == 0 {
+		return errors.New("forward_auth requires trusted_proxies, the header is only accepted from them")
+	}
+
+	for _, converter := range c.Converters {
+		if converter.Name == "" {
+			return errors.New("converter.name is required")
+		}
+
+		if len(converter.Command) == 0 {
+			return fmt.Errorf("converter %q: command is required", converter.Name)
+		}
+
+		if _, ok := formats.FormatByLabel(converter.Input); !ok {
+			return fmt.Errorf("converter %q: unknown input format %q", converter.Name, converter.Input)
+		}
+
+		if _, ok := formats.FormatByLabel(converter.Output); !ok {
+			return fmt.Errorf("converter %q: unknown output format %q", converter.Name, converter.Output)
+		}
+
+		for _, d := range converter.Devices {
+			if _, ok := device.ParseDeviceType(d); !ok {
+				return fmt.Errorf("converter %q: unknown device %q", converter.Name, d)
+			}
+		}
 	}
 
 	return nil
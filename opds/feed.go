@@ -3,6 +3,9 @@ package opds
 // OPDS navigation feed type constant
 const NavigationFeedType string = "profile=opds-catalog"
 
+// OPDS 2.0 feed type constant
+const JSONFeedType string = "application/opds+json"
+
 // OPDS acquisition constant
 const AcquisitionFeedRel string = "http://opds-spec.org/acquisition"
 
@@ -15,6 +18,7 @@ type Feed struct {
 	Links        []Link  `xml:"link"`
 	TotalResults int     `xml:"totalResults"`
 	ItemsPerPage int     `xml:"itemsPerPage"`
+	StartIndex   int     `xml:"startIndex"`
 }
 
 // GetLinks returns the links as a fluent Links type for filtering
@@ -22,6 +26,25 @@ func (f Feed) GetLinks() Links {
 	return Links(f.Links)
 }
 
+// Pages returns the current page and the total number of pages of a paged feed.
+// Either is 0 when the feed doesn't provide enough information to tell.
+func (f Feed) Pages() (page, pages int) {
+	if f.ItemsPerPage <= 0 {
+		return 0, 0
+	}
+	if f.TotalResults > 0 {
+		pages = (f.TotalResults + f.ItemsPerPage - 1) / f.ItemsPerPage
+	}
+
+	// OpenSearch start indexes are 1-based
+	if f.StartIndex > 0 {
+		page = (f.StartIndex-1)/f.ItemsPerPage + 1
+	} else if f.GetLinks().Pagination("previous") == nil {
+		page = 1
+	}
+	return page, pages
+}
+
 // IsAcquisitionFeed checks if this feed contains entries with acquisition links
 func (f *Feed) IsAcquisitionFeed() bool {
 	for _, entry := range f.Entries {
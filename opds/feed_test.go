@@ -0,0 +1,40 @@
+package opds
+
+import "testing"
+
+func TestFeedPages(t *testing.T) {
+	next := Link{Rel: "next", Href: "?page=2"}
+	prev := Link{Rel: "prev", Href: "?page=1"}
+
+	tests := []struct {
+		name      string
+		feed      Feed
+		wantPage  int
+		wantPages int
+	}{
+		{"not paged", Feed{}, 0, 0},
+		{"start index", Feed{TotalResults: 230, ItemsPerPage: 25, StartIndex: 51, Links: []Link{prev, next}}, 3, 10},
+		{"first page without start index", Feed{TotalResults: 50, ItemsPerPage: 25, Links: []Link{next}}, 1, 2},
+		{"later page without start index", Feed{TotalResults: 50, ItemsPerPage: 25, Links: []Link{prev}}, 0, 2},
+		{"unknown total", Feed{ItemsPerPage: 25, StartIndex: 26}, 2, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, pages := tt.feed.Pages()
+			if page != tt.wantPage || pages != tt.wantPages {
+				t.Errorf("Pages() = %d, %d, want %d, %d", page, pages, tt.wantPage, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestLinksPagination(t *testing.T) {
+	links := Links{{Rel: "prev", Href: "/p1"}, {Rel: "next", Href: "/p3"}}
+	if l := links.Pagination("previous"); l == nil || l.Href != "/p1" {
+		t.Errorf("expected prev link for previous, got %+v", l)
+	}
+	if l := links.Pagination("last"); l != nil {
+		t.Errorf("expected no last link, got %+v", l)
+	}
+}
@@ -0,0 +1,443 @@
+package opds
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// OPDS 2.0 link relations that differ from their OPDS 1.x counterparts
+const (
+	imageRel     = "http://opds-spec.org/image"
+	thumbnailRel = "http://opds-spec.org/image/thumbnail"
+)
+
+// The types below mirror the parts of an OPDS 2.0 document we map onto
+// Feed. See https://drafts.opds.io/opds-2.0
+
+type jsonFeed struct {
+	Metadata     jsonFeedMetadata  `json:"metadata"`
+	Links        []jsonLink        `json:"links"`
+	Navigation   []jsonLink        `json:"navigation"`
+	Publications []jsonPublication `json:"publications"`
+	Groups       []jsonGroup       `json:"groups"`
+	Facets       []jsonGroup       `json:"facets"`
+}
+
+type jsonFeedMetadata struct {
+	Identifier    string        `json:"identifier"`
+	Title         jsonLocalized `json:"title"`
+	Modified      Time          `json:"modified"`
+	NumberOfItems int           `json:"numberOfItems"`
+	ItemsPerPage  int           `json:"itemsPerPage"`
+	CurrentPage   int           `json:"currentPage"`
+}
+
+type jsonGroup struct {
+	Metadata     jsonFeedMetadata  `json:"metadata"`
+	Links        []jsonLink        `json:"links"`
+	Navigation   []jsonLink        `json:"navigation"`
+	Publications []jsonPublication `json:"publications"`
+}
+
+type jsonPublication struct {
+	Metadata jsonPublicationMetadata `json:"metadata"`
+	Links    []jsonLink              `json:"links"`
+	Images   []jsonLink              `json:"images"`
+}
+
+type jsonPublicationMetadata struct {
+	Identifier  string           `json:"identifier"`
+	Title       jsonLocalized    `json:"title"`
+	Author      jsonContributors `json:"author"`
+	Publisher   jsonContributors `json:"publisher"`
+	Language    jsonStrings      `json:"language"`
+	Modified    *Time            `json:"modified"`
+	Published   *Time            `json:"published"`
+	Description string           `json:"description"`
+	Subject     jsonSubjects     `json:"subject"`
+	BelongsTo   jsonBelongsTo    `json:"belongsTo"`
+}
+
+type jsonBelongsTo struct {
+	Series jsonContributors `json:"series"`
+}
+
+type jsonLink struct {
+	Href       string         `json:"href"`
+	Type       string         `json:"type"`
+	Title      string         `json:"title"`
+	Rel        jsonStrings    `json:"rel"`
+	Templated  bool           `json:"templated"`
+	Width      int            `json:"width"`
+	Properties jsonProperties `json:"properties"`
+}
+
+type jsonProperties struct {
+	NumberOfItems       int                       `json:"numberOfItems"`
+	Price               *jsonPrice                `json:"price"`
+	IndirectAcquisition []jsonIndirectAcquisition `json:"indirectAcquisition"`
+}
+
+type jsonPrice struct {
+	Currency string  `json:"currency"`
+	Value    float64 `json:"value"`
+}
+
+type jsonIndirectAcquisition struct {
+	Type  string                    `json:"type"`
+	Child []jsonIndirectAcquisition `json:"child"`
+}
+
+// jsonStrings accepts either a single string or an array of strings
+type jsonStrings []string
+
+func (s *jsonStrings) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = jsonStrings{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+type jsonContributor struct {
+	Name     jsonLocalized `json:"name"`
+	Position float32       `json:"position"`
+	Links    []jsonLink    `json:"links"`
+}
+
+// jsonContributors accepts a name, a contributor object or an array of either
+type jsonContributors []jsonContributor
+
+func (c *jsonContributors) UnmarshalJSON(data []byte) error {
+	var list []json.RawMessage
+	if err := json.Unmarshal(data, &list); err != nil {
+		list = []json.RawMessage{data}
+	}
+
+	for _, raw := range list {
+		var name string
+		if err := json.Unmarshal(raw, &name); err == nil {
+			*c = append(*c, jsonContributor{Name: jsonLocalized(name)})
+			continue
+		}
+		var contributor jsonContributor
+		if err := json.Unmarshal(raw, &contributor); err != nil {
+			return err
+		}
+		*c = append(*c, contributor)
+	}
+	return nil
+}
+
+// jsonLocalized accepts a plain string or a map of language to string
+type jsonLocalized string
+
+func (l *jsonLocalized) UnmarshalJSON(data []byte) error {
+	var plain string
+	if err := json.Unmarshal(data, &plain); err == nil {
+		*l = jsonLocalized(plain)
+		return nil
+	}
+	var localized map[string]string
+	if err := json.Unmarshal(data, &localized); err != nil {
+		return err
+	}
+	for _, lang := range []string{"en", "und"} {
+		if v, ok := localized[lang]; ok {
+			*l = jsonLocalized(v)
+			return nil
+		}
+	}
+	for _, v := range localized {
+		*l = jsonLocalized(v)
+		break
+	}
+	return nil
+}
+
+type jsonSubject struct {
+	Name   jsonLocalized `json:"name"`
+	Code   string        `json:"code"`
+	Scheme string        `json:"scheme"`
+}
+
+// jsonSubjects accepts a subject name, a subject object or an array of either
+type jsonSubjects []jsonSubject
+
+func (s *jsonSubjects) UnmarshalJSON(data []byte) error {
+	var list []json.RawMessage
+	if err := json.Unmarshal(data, &list); err != nil {
+		list = []json.RawMessage{data}
+	}
+
+	for _, raw := range list {
+		var name string
+		if err := json.Unmarshal(raw, &name); err == nil {
+			*s = append(*s, jsonSubject{Name: jsonLocalized(name)})
+			continue
+		}
+		var subject jsonSubject
+		if err := json.Unmarshal(raw, &subject); err != nil {
+			return err
+		}
+		*s = append(*s, subject)
+	}
+	return nil
+}
+
+// ParseFeedJSON parses an OPDS 2.0 feed or publication document from an
+// io.Reader and maps it onto the same Feed model as Atom catalogs.
+func ParseFeedJSON(r io.Reader) (*Feed, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc jsonFeed
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse OPDS 2.0 feed: %w", err)
+	}
+
+	// A publication document describes a single book instead of a collection
+	if doc.Navigation == nil && doc.Publications == nil && doc.Groups == nil {
+		var publication jsonPublication
+		if err := json.Unmarshal(body, &publication); err != nil {
+			return nil, fmt.Errorf("failed to parse OPDS 2.0 publication: %w", err)
+		}
+		entry := toEntry(publication)
+		return &Feed{ID: entry.ID, Title: entry.Title, Entries: []Entry{entry}}, nil
+	}
+
+	feed := &Feed{
+		ID:           doc.Metadata.Identifier,
+		Title:        string(doc.Metadata.Title),
+		Updated:      doc.Metadata.Modified,
+		TotalResults: doc.Metadata.NumberOfItems,
+		ItemsPerPage: doc.Metadata.ItemsPerPage,
+		Links:        toLinks(doc.Links),
+	}
+	if doc.Metadata.CurrentPage > 0 {
+		feed.StartIndex = (doc.Metadata.CurrentPage-1)*doc.Metadata.ItemsPerPage + 1
+	}
+
+	feed.Entries = append(feed.Entries, navigationEntries(doc.Navigation)...)
+	for _, p := range doc.Publications {
+		feed.Entries = append(feed.Entries, toEntry(p))
+	}
+
+	for _, group := range doc.Groups {
+		// Link to the full group when it has one, then show what it previews
+		if self := selfLink(group.Links); self != nil {
+			feed.Entries = append(feed.Entries, Entry{
+				ID:    self.Href,
+				Title: string(group.Metadata.Title),
+				Links: []Link{{Rel: "subsection", Href: self.Href, TypeLink: self.Type}},
+			})
+		}
+		feed.Entries = append(feed.Entries, navigationEntries(group.Navigation)...)
+		for _, p := range group.Publications {
+			feed.Entries = append(feed.Entries, toEntry(p))
+		}
+	}
+
+	for _, facet := range doc.Facets {
+		for _, link := range toLinks(facet.Links) {
+			// OPDS 2.0 marks the active facet with the self relation
+			if link.Rel == "self" {
+				link.ActiveFacet = "true"
+			}
+			link.Rel = FacetRel
+			link.FacetGroup = string(facet.Metadata.Title)
+			feed.Links = append(feed.Links, link)
+		}
+	}
+
+	return feed, nil
+}
+
+func navigationEntries(navigation []jsonLink) []Entry {
+	var entries []Entry
+	for _, n := range navigation {
+		link := toLink(n)
+		link.Rel = "subsection"
+		entries = append(entries, Entry{
+			ID:    n.Href,
+			Title: n.Title,
+			Links: []Link{link},
+		})
+	}
+	return entries
+}
+
+func toEntry(p jsonPublication) Entry {
+	m := p.Metadata
+	entry := Entry{
+		ID:        m.Identifier,
+		Title:     string(m.Title),
+		Updated:   m.Modified,
+		Published: m.Published,
+		Language:  strings.Join(m.Language, ", "),
+		Links:     toLinks(p.Links),
+	}
+
+	if m.Description != "" {
+		entry.Summary = Content{Content: html.EscapeString(m.Description), ContentType: "html"}
+	}
+	for _, a := range m.Author {
+		author := Author{Name: string(a.Name)}
+		if len(a.Links) > 0 {
+			author.URI = a.Links[0].Href
+		}
+		entry.Author = append(entry.Author, author)
+	}
+	var publishers []string
+	for _, pub := range m.Publisher {
+		publishers = append(publishers, string(pub.Name))
+	}
+	entry.Publisher = strings.Join(publishers, ", ")
+	for _, s := range m.Subject {
+		entry.Category = append(entry.Category, Category{Scheme: s.Scheme, Term: s.Code, Label: string(s.Name)})
+	}
+	for _, s := range m.BelongsTo.Series {
+		serie := Serie{Name: string(s.Name), Position: s.Position}
+		if len(s.Links) > 0 {
+			serie.URL = s.Links[0].Href
+		}
+		entry.Series = append(entry.Series, serie)
+	}
+
+	entry.Links = append(entry.Links, imageLinks(p.Images)...)
+
+	// Entries are looked up by ID, fall back to something stable
+	if entry.ID == "" {
+		if self := selfLink(p.Links); self != nil {
+			entry.ID = self.Href
+		} else if len(p.Links) > 0 {
+			entry.ID = p.Links[0].Href
+		} else {
+			entry.ID = string(m.Title)
+		}
+	}
+
+	return entry
+}
+
+// imageLinks maps publication images to a cover and a thumbnail link.
+// The first image is the cover and the narrowest one is the thumbnail.
+func imageLinks(images []jsonLink) []Link {
+	if len(images) == 0 {
+		return nil
+	}
+
+	thumbnail := images[0]
+	for _, img := range images[1:] {
+		if img.Width > 0 && (thumbnail.Width == 0 || img.Width < thumbnail.Width) {
+			thumbnail = img
+		}
+	}
+
+	cover := toLink(images[0])
+	cover.Rel = imageRel
+	cover.TypeLink = imageType(images[0])
+	thumb := toLink(thumbnail)
+	thumb.Rel = thumbnailRel
+	thumb.TypeLink = imageType(thumbnail)
+	return []Link{thumb, cover}
+}
+
+// imageType guesses the type of images that don't declare one so they are still recognized as images
+func imageType(l jsonLink) string {
+	if l.Type != "" {
+		return l.Type
+	}
+	if t := mime.TypeByExtension(path.Ext(strings.SplitN(l.Href, "?", 2)[0])); strings.HasPrefix(t, "image/") {
+		return t
+	}
+	return "image/*"
+}
+
+func toLinks(links []jsonLink) []Link {
+	var out []Link
+	for _, l := range links {
+		out = append(out, toLink(l))
+	}
+	return out
+}
+
+func toLink(l jsonLink) Link {
+	link := Link{
+		Href:                l.Href,
+		TypeLink:            l.Type,
+		Title:               l.Title,
+		Count:               l.Properties.NumberOfItems,
+		IndirectAcquisition: toIndirect(l.Properties.IndirectAcquisition),
+	}
+	if l.Properties.Price != nil {
+		link.Price = Price{CurrencyCode: l.Properties.Price.Currency, Value: l.Properties.Price.Value}
+	}
+
+	if len(l.Rel) > 0 {
+		link.Rel = l.Rel[0]
+	}
+	// Open access downloads are plain acquisitions as far as we're concerned
+	if link.Rel == AcquisitionFeedRel+"/open-access" {
+		link.Rel = AcquisitionFeedRel
+	}
+
+	if l.Templated {
+		link.Href = expandSearchTemplate(link.Href)
+	}
+
+	return link
+}
+
+func toIndirect(acquisitions []jsonIndirectAcquisition) []IndirectAcquisition {
+	var out []IndirectAcquisition
+	for _, a := range acquisitions {
+		out = append(out, IndirectAcquisition{
+			TypeAcquisition:     a.Type,
+			IndirectAcquisition: toIndirect(a.Child),
+		})
+	}
+	return out
+}
+
+func selfLink(links []jsonLink) *jsonLink {
+	for i, l := range links {
+		for _, rel := range l.Rel {
+			if rel == "self" {
+				return &links[i]
+			}
+		}
+	}
+	return nil
+}
+
+var uriTemplateQueryRegex = regexp.MustCompile(`\{([?&])([^}]*)\}`)
+
+// expandSearchTemplate turns the query variable of an RFC 6570 form-style
+// template into the OpenSearch {searchTerms} placeholder used for Atom
+// catalogs. Other variables are dropped.
+func expandSearchTemplate(href string) string {
+	return uriTemplateQueryRegex.ReplaceAllStringFunc(href, func(expr string) string {
+		m := uriTemplateQueryRegex.FindStringSubmatch(expr)
+		for _, name := range strings.Split(m[2], ",") {
+			if name == "query" {
+				return m[1] + "query={searchTerms}"
+			}
+		}
+		return ""
+	})
+}
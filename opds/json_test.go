@@ -0,0 +1,156 @@
+package opds
+
+import (
+	"strings"
+	"testing"
+)
+
+const opds2Feed = `{
+  "metadata": {"title": "Example Library", "numberOfItems": 120, "itemsPerPage": 2},
+  "links": [
+    {"rel": "self", "href": "/catalog.json", "type": "application/opds+json"},
+    {"rel": "next", "href": "/catalog.json?page=2", "type": "application/opds+json"},
+    {"rel": "search", "href": "/search{?query,author}", "type": "application/opds+json", "templated": true}
+  ],
+  "navigation": [
+    {"href": "/new.json", "title": "New Publications", "type": "application/opds+json", "rel": "current"}
+  ],
+  "facets": [
+    {
+      "metadata": {"title": "Language"},
+      "links": [
+        {"href": "/en.json", "type": "application/opds+json", "title": "English", "rel": "self"},
+        {"href": "/fr.json", "type": "application/opds+json", "title": "French", "properties": {"numberOfItems": 18}}
+      ]
+    }
+  ],
+  "publications": [
+    {
+      "metadata": {
+        "identifier": "urn:isbn:9780000000001",
+        "title": {"en": "Moby-Dick", "fr": "Moby Dick"},
+        "author": ["Herman Melville", {"name": "Someone Else"}],
+        "language": ["en"],
+        "description": "<p>A whale</p>",
+        "subject": "Adventure",
+        "belongsTo": {"series": {"name": "Classics", "position": 3}}
+      },
+      "links": [
+        {"rel": "http://opds-spec.org/acquisition/open-access", "href": "/moby.epub", "type": "application/epub+zip"}
+      ],
+      "images": [
+        {"href": "/moby-large.jpg", "type": "image/jpeg", "width": 1400},
+        {"href": "/moby-small.jpg", "width": 200}
+      ]
+    }
+  ],
+  "groups": [
+    {
+      "metadata": {"title": "Popular"},
+      "links": [{"rel": "self", "href": "/popular.json", "type": "application/opds+json"}],
+      "publications": [
+        {"metadata": {"title": "Untitled Without ID"}, "links": [{"rel": "self", "href": "/untitled.json", "type": "application/opds-publication+json"}]}
+      ]
+    }
+  ]
+}`
+
+func TestParseFeedJSON(t *testing.T) {
+	feed, err := ParseFeedJSON(strings.NewReader(opds2Feed))
+	if err != nil {
+		t.Fatalf("ParseFeedJSON error: %v", err)
+	}
+
+	if feed.Title != "Example Library" || feed.TotalResults != 120 || feed.ItemsPerPage != 2 {
+		t.Errorf("unexpected feed metadata: %+v", feed)
+	}
+
+	search := feed.GetLinks().Where(func(l Link) bool { return l.Rel == "search" }).First()
+	if search == nil || search.Href != "/search?query={searchTerms}" {
+		t.Errorf("unexpected search link: %+v", search)
+	}
+	// self, next and the facets, like Atom catalog links
+	if nav := feed.GetLinks().Navigation(); len(nav) != 4 {
+		t.Errorf("expected all but the search link to be navigation links, got %+v", nav)
+	}
+
+	facets := feed.GetLinks().Facets()
+	if len(facets) != 2 || !facets[0].IsActiveFacet() || facets[1].IsActiveFacet() {
+		t.Errorf("expected the self facet to be active: %+v", facets)
+	}
+	if facet := facets[1]; facet.FacetGroup != "Language" || facet.Count != 18 {
+		t.Errorf("unexpected facet link: %+v", facet)
+	}
+
+	// navigation, publication, group link, group publication
+	if len(feed.Entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(feed.Entries))
+	}
+
+	if nav := feed.Entries[0]; nav.Title != "New Publications" || len(nav.GetLinks().Navigation()) != 1 {
+		t.Errorf("unexpected navigation entry: %+v", nav)
+	}
+
+	book := feed.Entries[1]
+	if book.Title != "Moby-Dick" || book.ID != "urn:isbn:9780000000001" {
+		t.Errorf("unexpected publication: %+v", book)
+	}
+	if names := book.AuthorNames(); len(names) != 2 || names[0] != "Herman Melville" || names[1] != "Someone Else" {
+		t.Errorf("unexpected authors: %v", names)
+	}
+	if book.Summary.Content != "&lt;p&gt;A whale&lt;/p&gt;" || book.Summary.ContentType != "html" {
+		t.Errorf("unexpected summary: %+v", book.Summary)
+	}
+	if len(book.Category) != 1 || book.Category[0].Label != "Adventure" {
+		t.Errorf("unexpected categories: %+v", book.Category)
+	}
+	if len(book.Series) != 1 || book.Series[0].Name != "Classics" || book.Series[0].Position != 3 {
+		t.Errorf("unexpected series: %+v", book.Series)
+	}
+	if downloads := book.GetLinks().Downloads(); len(downloads) != 1 || downloads[0].Href != "/moby.epub" {
+		t.Errorf("unexpected downloads: %+v", downloads)
+	}
+	if thumb := book.Thumbnail(); thumb == nil || thumb.Href != "/moby-small.jpg" || thumb.TypeLink != "image/jpeg" {
+		t.Errorf("unexpected thumbnail: %+v", thumb)
+	}
+
+	if group := feed.Entries[2]; group.Title != "Popular" || group.Links[0].Href != "/popular.json" {
+		t.Errorf("unexpected group entry: %+v", group)
+	}
+	if untitled := feed.Entries[3]; untitled.ID != "/untitled.json" {
+		t.Errorf("expected ID to fall back to the self link, got %q", untitled.ID)
+	}
+}
+
+func TestParseFeedJSONPublication(t *testing.T) {
+	doc := `{
+  "metadata": {"title": "Moby-Dick", "author": "Herman Melville"},
+  "links": [{"rel": "http://opds-spec.org/acquisition", "href": "/moby.epub", "type": "application/epub+zip"}]
+}`
+
+	feed, err := ParseFeedJSON(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("ParseFeedJSON error: %v", err)
+	}
+	if len(feed.Entries) != 1 || feed.Entries[0].Title != "Moby-Dick" {
+		t.Fatalf("expected a single entry, got %+v", feed.Entries)
+	}
+	if downloads := feed.Entries[0].GetLinks().Downloads(); len(downloads) != 1 {
+		t.Errorf("unexpected downloads: %+v", downloads)
+	}
+}
+
+func TestExpandSearchTemplate(t *testing.T) {
+	tests := map[string]string{
+		"/search{?query}":         "/search?query={searchTerms}",
+		"/search{?query,title}":   "/search?query={searchTerms}",
+		"/search?lang=en{&query}": "/search?lang=en&query={searchTerms}",
+		"/search{?title}":         "/search",
+		"/search?q={searchTerms}": "/search?q={searchTerms}",
+	}
+	for in, want := range tests {
+		if got := expandSearchTemplate(in); got != want {
+			t.Errorf("expandSearchTemplate(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -10,6 +10,9 @@ const (
 	LinkCategoryThumbnail LinkCategory = "thumbnail"
 )
 
+// OPDS facet link relation
+const FacetRel string = "http://opds-spec.org/facet"
+
 // Link represents a link to different resources
 type Link struct {
 	Rel                 string                `xml:"rel,attr"`
@@ -17,6 +20,7 @@ type Link struct {
 	TypeLink            string                `xml:"type,attr"`
 	Title               string                `xml:"title,attr"`
 	FacetGroup          string                `xml:"facetGroup,attr"`
+	ActiveFacet         string                `xml:"activeFacet,attr"`
 	Count               int                   `xml:"count,attr"`
 	Price               Price                 `xml:"price"`
 	IndirectAcquisition []IndirectAcquisition `xml:"indirectAcquisition"`
@@ -59,7 +63,17 @@ func (l Link) IsDataImage() bool {
 
 // IsNavigation checks if the link is a navigation link
 func (l Link) IsNavigation() bool {
-	return strings.Contains(l.TypeLink, NavigationFeedType) || l.Rel == "subsection"
+	return strings.Contains(l.TypeLink, NavigationFeedType) || l.Rel == "subsection" || (l.HasType(JSONFeedType) && l.Rel != "search")
+}
+
+// IsFacet checks if the link is a facet that sorts or filters the feed
+func (l Link) IsFacet() bool {
+	return l.Rel == FacetRel
+}
+
+// IsActiveFacet checks if the facet is the one currently applied to the feed
+func (l Link) IsActiveFacet() bool {
+	return l.IsFacet() && l.ActiveFacet == "true"
 }
 
 // IsThumbnail checks if the link is specifically a thumbnail image
@@ -97,6 +111,13 @@ func (links Links) Downloads() Links {
 	})
 }
 
+// Facets returns only facet links
+func (links Links) Facets() Links {
+	return links.Where(func(link Link) bool {
+		return link.IsFacet()
+	})
+}
+
 // Images returns only image links, optionally filtered by category
 func (links Links) Images(category ...LinkCategory) Links {
 	cat := LinkCategoryAny
@@ -122,6 +143,37 @@ func (links Links) DataImages() Links {
 	})
 }
 
+// Pagination returns the paging link for rel (first, previous, next or last), if any.
+// The "prev" spelling used by some servers is accepted for "previous".
+func (links Links) Pagination(rel string) *Link {
+	return links.Where(func(link Link) bool {
+		return link.Rel == rel || (rel == "previous" && link.Rel == "prev")
+	}).First()
+}
+
+// Search returns the search link, if any. Links that are templates are
+// preferred over OpenSearch descriptions, which have to be fetched first.
+func (links Links) Search() *Link {
+	searchLinks := links.Where(func(link Link) bool {
+		return link.Rel == "search"
+	})
+	for i, link := range searchLinks {
+		if IsSearchTemplate(link.Href) {
+			return &searchLinks[i]
+		}
+	}
+	return searchLinks.First()
+}
+
+// IsPagination checks if the link moves between pages of the same feed
+func (l Link) IsPagination() bool {
+	switch l.Rel {
+	case "first", "previous", "prev", "next", "last":
+		return true
+	}
+	return false
+}
+
 // First returns the first link that matches, or nil if none found
 func (links Links) First() *Link {
 	if len(links) > 0 {
@@ -1,19 +1,49 @@
 package opds
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// OpenSearch 1.1 parameters, and the Atom extensions used to search by field.
+// Parameters in other namespaces are named as they're written in the template.
+const (
+	SearchTerms          = "searchTerms"
+	SearchCount          = "count"
+	SearchStartIndex     = "startIndex"
+	SearchStartPage      = "startPage"
+	SearchLanguage       = "language"
+	SearchInputEncoding  = "inputEncoding"
+	SearchOutputEncoding = "outputEncoding"
+	SearchTitle          = "atom:title"
+	SearchAuthor         = "atom:author"
+)
+
+const (
+	openSearchNamespace = "http://a9.com/-/spec/opensearch/1.1/"
+	atomNamespace       = "http://www.w3.org/2005/Atom"
+)
+
+// A template parameter such as {searchTerms}, {startPage?} or {atom:author?}
+var templateParamRegex = regexp.MustCompile(`\{([^{}?]*)(\??)\}`)
+
 // OpenSearchDescription represents an OpenSearch Description Document (OSDD)
 // per https://specs.opds.io/opds-1.2#opensearch
-// We only need the <Url> elements with a template.
+// We only need the <Url> elements with a template, and the namespace
+// prefixes their parameters use.
 type OpenSearchDescription struct {
-	XMLName xml.Name `xml:"OpenSearchDescription"`
-	Urls    []OSDUrl `xml:"Url"`
+	XMLName xml.Name   `xml:"OpenSearchDescription"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Urls    []OSDUrl   `xml:"Url"`
 }
 
 // OSDUrl represents a single <Url> entry in an OSDD
@@ -21,53 +51,274 @@ type OpenSearchDescription struct {
 // <Url type="application/atom+xml;profile=opds-catalog" template="https://example.org/search?q={searchTerms}"/>
 // Some servers might omit the profile and use just application/atom+xml.
 type OSDUrl struct {
-	Type     string `xml:"type,attr"`
-	Template string `xml:"template,attr"`
+	Type        string     `xml:"type,attr"`
+	Template    string     `xml:"template,attr"`
+	IndexOffset string     `xml:"indexOffset,attr"`
+	PageOffset  string     `xml:"pageOffset,attr"`
+	Attrs       []xml.Attr `xml:",any,attr"`
+}
+
+// SearchTemplate is an OpenSearch URL template. Parameters are written as
+// {name}, or {name?} when optional, and may carry a namespace prefix.
+type SearchTemplate struct {
+	Template string
+	// URL a relative template is resolved against
+	Base string
+	// Number of the first result and page, used when the template requires them
+	IndexOffset int
+	PageOffset  int
+	// Namespace URIs by prefix
+	namespaces map[string]string
+}
+
+// NewSearchTemplate returns the template of a search link. Without a
+// description to declare prefixes, "atom" is taken to be the Atom namespace.
+func NewSearchTemplate(template string) *SearchTemplate {
+	return &SearchTemplate{
+		Template:    template,
+		IndexOffset: 1,
+		PageOffset:  1,
+		namespaces:  map[string]string{"atom": atomNamespace},
+	}
+}
+
+// IsSearchTemplate reports whether href is a search template rather than
+// the address of an OpenSearch description.
+func IsSearchTemplate(href string) bool {
+	return templateParamRegex.MatchString(href)
+}
+
+// Has reports whether the template takes the named parameter.
+func (t *SearchTemplate) Has(name string) bool {
+	for _, m := range templateParamRegex.FindAllStringSubmatch(t.Template, -1) {
+		if t.paramName(m[1]) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand fills in the template with values by parameter name. Required
+// parameters without a value get their default. Optional ones are left
+// empty, and query parameters consisting only of them are dropped.
+func (t *SearchTemplate) Expand(values map[string]string) string {
+	path, query, hasQuery := cutTemplateQuery(t.Template)
+	expanded := t.fill(path, values, url.PathEscape)
+
+	if hasQuery {
+		var pairs []string
+		for pair := range strings.SplitSeq(query, "&") {
+			_, value, _ := strings.Cut(pair, "=")
+			if m := templateParamRegex.FindStringSubmatch(value); m != nil && m[0] == value && m[2] == "?" && values[t.paramName(m[1])] == "" {
+				continue
+			}
+			pairs = append(pairs, t.fill(pair, values, url.QueryEscape))
+		}
+		if len(pairs) > 0 {
+			expanded += "?" + strings.Join(pairs, "&")
+		}
+	}
+
+	if t.Base == "" {
+		return expanded
+	}
+	base, err := url.Parse(t.Base)
+	if err != nil {
+		return expanded
+	}
+	ref, err := url.Parse(expanded)
+	if err != nil || ref.IsAbs() {
+		return expanded
+	}
+	return base.ResolveReference(ref).String()
+}
+
+func (t *SearchTemplate) fill(s string, values map[string]string, escape func(string) string) string {
+	return templateParamRegex.ReplaceAllStringFunc(s, func(param string) string {
+		m := templateParamRegex.FindStringSubmatch(param)
+		name := t.paramName(m[1])
+		if value := values[name]; value != "" {
+			return escape(value)
+		}
+		if m[2] == "?" {
+			return ""
+		}
+		return escape(t.defaultValue(name))
+	})
+}
+
+// paramName returns the name a template parameter is looked up by, which
+// doesn't depend on the prefix the description bound the namespace to.
+func (t *SearchTemplate) paramName(qualified string) string {
+	prefix, local, ok := strings.Cut(qualified, ":")
+	if !ok {
+		return qualified
+	}
+	switch t.namespaces[prefix] {
+	case openSearchNamespace:
+		return local
+	case atomNamespace:
+		return "atom:" + local
+	}
+	return qualified
+}
+
+// defaultValue returns what a required parameter without a value is set to.
+func (t *SearchTemplate) defaultValue(name string) string {
+	switch name {
+	case SearchStartIndex:
+		return strconv.Itoa(t.IndexOffset)
+	case SearchStartPage:
+		return strconv.Itoa(t.PageOffset)
+	case SearchLanguage:
+		return "*"
+	case SearchInputEncoding, SearchOutputEncoding:
+		return "UTF-8"
+	}
+	return ""
+}
+
+// cutTemplateQuery splits a template at the start of its query, skipping
+// the question marks of optional parameters.
+func cutTemplateQuery(template string) (path, query string, found bool) {
+	depth := 0
+	for i, c := range template {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '?':
+			if depth == 0 {
+				return template[:i], template[i+1:], true
+			}
+		}
+	}
+	return template, "", false
 }
 
 // ResolveOpenSearchTemplate fetches an OSDD from the given URL and returns the
-// Atom/OPDS template URL to use for search requests. It prefers
+// Atom/OPDS template to use for search requests. It prefers
 // "application/atom+xml;profile=opds-catalog" then falls back to
-// "application/atom+xml" if needed.
-func ResolveOpenSearchTemplate(osdURL string) (string, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
+// "application/atom+xml" if needed. Relative templates are resolved
+// against the OSDD URL. The fetch is given up after 10 seconds or once
+// ctx is done.
+func ResolveOpenSearchTemplate(ctx context.Context, client *http.Client, osdURL string) (*SearchTemplate, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
 
-	// simplified request: use client.Get since no headers are needed
-	resp, err := client.Get(osdURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, osdURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OpenSearch description request: %w", err)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch OpenSearch description from %q: %w", osdURL, err)
+		return nil, fmt.Errorf("failed to fetch OpenSearch description from %q: %w", osdURL, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return "", fmt.Errorf("unexpected status fetching OSDD: %s", resp.Status)
+		return nil, fmt.Errorf("unexpected status fetching OSDD: %s", resp.Status)
 	}
 
-	return parseOpenSearchTemplate(resp.Body)
+	tmpl, err := parseOpenSearchTemplate(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Base = osdURL
+	return tmpl, nil
 }
 
 // parseOpenSearchTemplate parses an OpenSearch Description XML from r and
-// returns the preferred Atom/OPDS search template URL.
-func parseOpenSearchTemplate(r io.Reader) (string, error) {
+// returns the preferred Atom/OPDS search template.
+func parseOpenSearchTemplate(r io.Reader) (*SearchTemplate, error) {
 	// Stream decode to avoid buffering entire body in memory
 	var d OpenSearchDescription
 	decoder := xml.NewDecoder(r)
 	if err := decoder.Decode(&d); err != nil && err != io.EOF {
-		return "", fmt.Errorf("failed to parse OpenSearch description: %w", err)
+		return nil, fmt.Errorf("failed to parse OpenSearch description: %w", err)
 	}
 
 	// First pass: look for the OPDS profile type
 	for _, u := range d.Urls {
 		if u.Type == "application/atom+xml;profile=opds-catalog" && u.Template != "" {
-			return u.Template, nil
+			return d.template(u), nil
 		}
 	}
 	// Second pass: any atom+xml template
 	for _, u := range d.Urls {
 		if u.Type == "application/atom+xml" && u.Template != "" {
-			return u.Template, nil
+			return d.template(u), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no suitable Atom template found in OSDD")
+}
+
+// template returns the search template of u with the namespace prefixes
+// declared on the description and the Url element.
+func (d *OpenSearchDescription) template(u OSDUrl) *SearchTemplate {
+	t := NewSearchTemplate(u.Template)
+	for _, attr := range append(d.Attrs, u.Attrs...) {
+		if attr.Name.Space == "xmlns" {
+			t.namespaces[attr.Name.Local] = attr.Value
 		}
 	}
+	if offset, err := strconv.Atoi(u.IndexOffset); err == nil {
+		t.IndexOffset = offset
+	}
+	if offset, err := strconv.Atoi(u.PageOffset); err == nil {
+		t.PageOffset = offset
+	}
+	return t
+}
 
-	return "", fmt.Errorf("no suitable Atom template found in OSDD")
+// SearchDescriptions caches the templates of OpenSearch descriptions by
+// URL, so searching a feed doesn't fetch its description every time.
+type SearchDescriptions struct {
+	ttl     time.Duration
+	mutex   sync.Mutex
+	entries map[string]cachedTemplate
+}
+
+type cachedTemplate struct {
+	template *SearchTemplate
+	expires  time.Time
+}
+
+// NewSearchDescriptions returns a cache that keeps templates for ttl.
+func NewSearchDescriptions(ttl time.Duration) *SearchDescriptions {
+	return &SearchDescriptions{ttl: ttl, entries: make(map[string]cachedTemplate)}
+}
+
+// Resolve returns the template of the description at osdURL, fetching it
+// with client when it isn't cached. Failures aren't cached. A nil cache
+// always fetches.
+func (d *SearchDescriptions) Resolve(ctx context.Context, client *http.Client, osdURL string) (*SearchTemplate, error) {
+	if d == nil {
+		return ResolveOpenSearchTemplate(ctx, client, osdURL)
+	}
+
+	now := time.Now()
+	d.mutex.Lock()
+	cached, ok := d.entries[osdURL]
+	d.mutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.template, nil
+	}
+
+	tmpl, err := ResolveOpenSearchTemplate(ctx, client, osdURL)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for key, entry := range d.entries {
+		if now.After(entry.expires) {
+			delete(d.entries, key)
+		}
+	}
+	d.entries[osdURL] = cachedTemplate{template: tmpl, expires: now.Add(d.ttl)}
+	return tmpl, nil
 }
@@ -1,8 +1,14 @@
 package opds
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseOpenSearchTemplate_PrefersOPDSProfile(t *testing.T) {
@@ -17,7 +23,7 @@ func TestParseOpenSearchTemplate_PrefersOPDSProfile(t *testing.T) {
 		t.Fatalf("expected no error, got %v", err)
 	}
 	want := "https://example.test/opds?q={searchTerms}"
-	if tmpl != want {
+	if tmpl.Template != want {
 		t.Fatalf("unexpected template. got %q want %q", tmpl, want)
 	}
 }
@@ -33,7 +39,7 @@ func TestParseOpenSearchTemplate_FallbackAtom(t *testing.T) {
 		t.Fatalf("expected no error, got %v", err)
 	}
 	want := "https://example.test/search?q={searchTerms}"
-	if tmpl != want {
+	if tmpl.Template != want {
 		t.Fatalf("unexpected template. got %q want %q", tmpl, want)
 	}
 }
@@ -63,7 +69,7 @@ func TestParseOpenSearchTemplate_EmptyTemplateIgnored(t *testing.T) {
 		t.Fatalf("expected no error, got %v", err)
 	}
 	want := "https://example.test/search?q={searchTerms}"
-	if tmpl != want {
+	if tmpl.Template != want {
 		t.Fatalf("unexpected template. got %q want %q", tmpl, want)
 	}
 }
@@ -79,3 +85,87 @@ func TestParseOpenSearchTemplate_MalformedXML(t *testing.T) {
 		t.Fatalf("expected XML parse error, got nil")
 	}
 }
+
+func TestSearchTemplateExpand(t *testing.T) {
+	tests := []struct {
+		template string
+		values   map[string]string
+		want     string
+	}{
+		{"https://example.test/search?q={searchTerms}", map[string]string{SearchTerms: "dune messiah"}, "https://example.test/search?q=dune+messiah"},
+		{"https://example.test/search/{searchTerms}", map[string]string{SearchTerms: "dune messiah"}, "https://example.test/search/dune%20messiah"},
+		{"https://example.test/search?q={searchTerms}&page={startPage?}&n={count?}", map[string]string{SearchTerms: "dune"}, "https://example.test/search?q=dune"},
+		{"https://example.test/search?q={searchTerms}&page={startPage?}", map[string]string{SearchTerms: "dune", SearchStartPage: "2"}, "https://example.test/search?q=dune&page=2"},
+		{"https://example.test/search?q={searchTerms}&page={startPage}&lang={language}", map[string]string{SearchTerms: "dune"}, "https://example.test/search?q=dune&page=1&lang=%2A"},
+		{"https://example.test/search?q={searchTerms?}&author={atom:author?}&title={atom:title?}", map[string]string{SearchAuthor: "Herbert"}, "https://example.test/search?author=Herbert"},
+		{"https://example.test/search?q={searchTerms}&x={unknown:thing?}", map[string]string{SearchTerms: "dune"}, "https://example.test/search?q=dune"},
+	}
+
+	for _, tt := range tests {
+		if got := NewSearchTemplate(tt.template).Expand(tt.values); got != tt.want {
+			t.Errorf("Expand(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestParseOpenSearchTemplate_Namespaces(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+<OpenSearchDescription xmlns="http://a9.com/-/spec/opensearch/1.1/" xmlns:a="http://www.w3.org/2005/Atom">
+  <Url type="application/atom+xml" indexOffset="0" pageOffset="0" xmlns:os="http://a9.com/-/spec/opensearch/1.1/"
+    template="/search?q={searchTerms}&amp;author={a:author?}&amp;start={os:startIndex}"/>
+</OpenSearchDescription>`
+
+	tmpl, err := parseOpenSearchTemplate(strings.NewReader(xml))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !tmpl.Has(SearchAuthor) || tmpl.Has(SearchTitle) {
+		t.Errorf("expected only the author field, got template %q", tmpl.Template)
+	}
+
+	tmpl.Base = "https://example.test/opds/osd.xml"
+	got := tmpl.Expand(map[string]string{SearchTerms: "dune", SearchAuthor: "Frank Herbert"})
+	want := "https://example.test/search?q=dune&author=Frank+Herbert&start=0"
+	if got != want {
+		t.Errorf("unexpected expansion. got %q want %q", got, want)
+	}
+}
+
+func TestSearchDescriptionsCachesTemplates(t *testing.T) {
+	fetched := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+		io.WriteString(w, `<OpenSearchDescription><Url type="application/atom+xml" template="/search?q={searchTerms}"/></OpenSearchDescription>`)
+	}))
+	defer server.Close()
+
+	descriptions := NewSearchDescriptions(time.Hour)
+	for range 2 {
+		tmpl, err := descriptions.Resolve(context.Background(), http.DefaultClient, server.URL+"/osd.xml")
+		if err != nil {
+			t.Fatalf("Resolve error: %v", err)
+		}
+		if got := tmpl.Expand(map[string]string{SearchTerms: "dune"}); got != server.URL+"/search?q=dune" {
+			t.Errorf("unexpected expansion %q", got)
+		}
+	}
+	if fetched != 1 {
+		t.Errorf("description fetched %d times, want 1", fetched)
+	}
+}
+
+func TestResolveOpenSearchTemplateStopsWithContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := ResolveOpenSearchTemplate(ctx, http.DefaultClient, server.URL+"/osd.xml"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the fetch to stop with the context, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package opds
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"strings"
 	"time"
@@ -18,11 +19,26 @@ func (ft *Time) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 		return err
 	}
 
+	ft.Time = parseTime(v)
+	return nil
+}
+
+// UnmarshalJSON handles the same date formats in OPDS 2.0 feeds
+func (ft *Time) UnmarshalJSON(data []byte) error {
+	var v string
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	ft.Time = parseTime(v)
+	return nil
+}
+
+// parseTime returns the zero time if v can't be parsed
+func parseTime(v string) time.Time {
 	// Remove any extra whitespace
 	v = strings.TrimSpace(v)
 	if v == "" {
-		ft.Time = time.Time{}
-		return nil
+		return time.Time{}
 	}
 
 	// Try different time formats commonly used in OPDS feeds
@@ -36,22 +52,19 @@ func (ft *Time) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 
 	for _, format := range formats {
 		if t, err := time.Parse(format, v); err == nil {
-			ft.Time = t
-			return nil
+			return t
 		}
 	}
 
 	// If none of the formats work, try to parse just the date part
 	if len(v) >= 10 {
 		if t, err := time.Parse("2006-01-02", v[:10]); err == nil {
-			ft.Time = t
-			return nil
+			return t
 		}
 	}
 
 	// Return a zero time if we can't parse it
-	ft.Time = time.Time{}
-	return nil
+	return time.Time{}
 }
 
 // MarshalXML implements xml.Marshaler to output in RFC3339 format
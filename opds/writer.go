@@ -0,0 +1,177 @@
+package opds
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// Atom content type for OPDS catalog documents
+const (
+	NavigationFeedContentType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	AcquisitionFeedContentType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+)
+
+// The parser ignores namespaces, so the document written back out
+// uses dedicated types that carry the right prefixes.
+
+type xmlFeed struct {
+	XMLName      xml.Name   `xml:"feed"`
+	Xmlns        string     `xml:"xmlns,attr"`
+	XmlnsOPDS    string     `xml:"xmlns:opds,attr"`
+	XmlnsDC      string     `xml:"xmlns:dc,attr"`
+	XmlnsSearch  string     `xml:"xmlns:opensearch,attr"`
+	XmlnsThr     string     `xml:"xmlns:thr,attr"`
+	ID           string     `xml:"id"`
+	Title        string     `xml:"title"`
+	Updated      Time       `xml:"updated"`
+	Links        []xmlLink  `xml:"link"`
+	TotalResults int        `xml:"opensearch:totalResults,omitempty"`
+	ItemsPerPage int        `xml:"opensearch:itemsPerPage,omitempty"`
+	StartIndex   int        `xml:"opensearch:startIndex,omitempty"`
+	Entries      []xmlEntry `xml:"entry"`
+}
+
+type xmlEntry struct {
+	Title      string      `xml:"title"`
+	ID         string      `xml:"id"`
+	Updated    *Time       `xml:"updated"`
+	Published  *Time       `xml:"published"`
+	Author     []xmlAuthor `xml:"author"`
+	Identifier string      `xml:"dc:identifier,omitempty"`
+	Publisher  string      `xml:"dc:publisher,omitempty"`
+	Language   string      `xml:"dc:language,omitempty"`
+	Issued     string      `xml:"dc:issued,omitempty"`
+	Rights     string      `xml:"rights,omitempty"`
+	Category   []Category  `xml:"category"`
+	Links      []xmlLink   `xml:"link"`
+	Summary    *xmlContent `xml:"summary"`
+	Content    *xmlContent `xml:"content"`
+}
+
+type xmlAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type xmlContent struct {
+	Content     string `xml:",innerxml"`
+	ContentType string `xml:"type,attr,omitempty"`
+}
+
+type xmlLink struct {
+	Rel                 string                   `xml:"rel,attr,omitempty"`
+	Href                string                   `xml:"href,attr"`
+	TypeLink            string                   `xml:"type,attr,omitempty"`
+	Title               string                   `xml:"title,attr,omitempty"`
+	FacetGroup          string                   `xml:"opds:facetGroup,attr,omitempty"`
+	ActiveFacet         string                   `xml:"opds:activeFacet,attr,omitempty"`
+	Count               int                      `xml:"thr:count,attr,omitempty"`
+	Price               *xmlPrice                `xml:"opds:price"`
+	IndirectAcquisition []xmlIndirectAcquisition `xml:"opds:indirectAcquisition"`
+}
+
+type xmlPrice struct {
+	CurrencyCode string  `xml:"currencycode,attr"`
+	Value        float64 `xml:",chardata"`
+}
+
+type xmlIndirectAcquisition struct {
+	TypeAcquisition     string                   `xml:"type,attr"`
+	IndirectAcquisition []xmlIndirectAcquisition `xml:"opds:indirectAcquisition"`
+}
+
+// WriteFeed serializes the feed as an OPDS 1.2 Atom document.
+func WriteFeed(w io.Writer, feed *Feed) error {
+	out := xmlFeed{
+		Xmlns:        "http://www.w3.org/2005/Atom",
+		XmlnsOPDS:    "http://opds-spec.org/2010/catalog",
+		XmlnsDC:      "http://purl.org/dc/terms/",
+		XmlnsSearch:  "http://a9.com/-/spec/opensearch/1.1/",
+		XmlnsThr:     "http://purl.org/syndication/thread/1.0",
+		ID:           feed.ID,
+		Title:        feed.Title,
+		Updated:      feed.Updated,
+		Links:        toXMLLinks(feed.Links),
+		TotalResults: feed.TotalResults,
+		ItemsPerPage: feed.ItemsPerPage,
+		StartIndex:   feed.StartIndex,
+	}
+
+	for _, e := range feed.Entries {
+		entry := xmlEntry{
+			Title:      e.Title,
+			ID:         e.ID,
+			Updated:    e.Updated,
+			Published:  e.Published,
+			Identifier: e.Identifier,
+			Publisher:  e.Publisher,
+			Language:   e.Language,
+			Issued:     e.Issued,
+			Rights:     e.Rights,
+			Category:   e.Category,
+			Links:      toXMLLinks(e.Links),
+			Summary:    toXMLContent(e.Summary),
+			Content:    toXMLContent(e.Content),
+		}
+		for _, a := range e.Author {
+			entry.Author = append(entry.Author, xmlAuthor(a))
+		}
+		out.Entries = append(out.Entries, entry)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	if err := encoder.Encode(out); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// ContentType returns the Atom content type matching the kind of feed.
+func (f *Feed) ContentType() string {
+	if f.IsAcquisitionFeed() {
+		return AcquisitionFeedContentType
+	}
+	return NavigationFeedContentType
+}
+
+func toXMLLinks(links []Link) []xmlLink {
+	out := make([]xmlLink, 0, len(links))
+	for _, l := range links {
+		link := xmlLink{
+			Rel:                 l.Rel,
+			Href:                l.Href,
+			TypeLink:            l.TypeLink,
+			Title:               l.Title,
+			FacetGroup:          l.FacetGroup,
+			ActiveFacet:         l.ActiveFacet,
+			Count:               l.Count,
+			IndirectAcquisition: toXMLIndirect(l.IndirectAcquisition),
+		}
+		if l.Price.CurrencyCode != "" {
+			link.Price = &xmlPrice{CurrencyCode: l.Price.CurrencyCode, Value: l.Price.Value}
+		}
+		out = append(out, link)
+	}
+	return out
+}
+
+func toXMLIndirect(acquisitions []IndirectAcquisition) []xmlIndirectAcquisition {
+	var out []xmlIndirectAcquisition
+	for _, a := range acquisitions {
+		out = append(out, xmlIndirectAcquisition{
+			TypeAcquisition:     a.TypeAcquisition,
+			IndirectAcquisition: toXMLIndirect(a.IndirectAcquisition),
+		})
+	}
+	return out
+}
+
+func toXMLContent(c Content) *xmlContent {
+	if c.Content == "" {
+		return nil
+	}
+	return &xmlContent{Content: c.Content, ContentType: c.ContentType}
+}
@@ -0,0 +1,74 @@
+package opds
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteFeedRoundTrip(t *testing.T) {
+	feed := &Feed{
+		ID:           "urn:catalog",
+		Title:        "Catalog",
+		TotalResults: 42,
+		ItemsPerPage: 10,
+		Links: []Link{
+			{Rel: "next", Href: "/catalog?page=2", TypeLink: "application/atom+xml;profile=opds-catalog;kind=acquisition"},
+		},
+		Entries: []Entry{{
+			ID:       "urn:book",
+			Title:    "Pride & Prejudice",
+			Author:   []Author{{Name: "Jane Austen"}},
+			Language: "en",
+			Summary:  Content{Content: "&lt;p&gt;A classic&lt;/p&gt;", ContentType: "html"},
+			Links: []Link{
+				{Rel: AcquisitionFeedRel, Href: "/books/1.epub", TypeLink: "application/epub+zip"},
+				{Rel: FacetRel, Href: "/by-author", FacetGroup: "Sort", Count: 3, ActiveFacet: "true"},
+			},
+		}},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteFeed(&buf, feed); err != nil {
+		t.Fatalf("WriteFeed error: %v", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		`xmlns="http://www.w3.org/2005/Atom"`,
+		`<opensearch:totalResults>42</opensearch:totalResults>`,
+		`<dc:language>en</dc:language>`,
+		`opds:facetGroup="Sort"`,
+		`thr:count="3"`,
+		`opds:activeFacet="true"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q:\n%s", want, out)
+		}
+	}
+
+	parsed, err := ParseFeed(strings.NewReader(out), false)
+	if err != nil {
+		t.Fatalf("ParseFeed error: %v", err)
+	}
+	if parsed.TotalResults != 42 || len(parsed.Entries) != 1 {
+		t.Fatalf("unexpected feed after round trip: %+v", parsed)
+	}
+	entry := parsed.Entries[0]
+	if entry.Title != "Pride & Prejudice" || entry.Summary.Content != feed.Entries[0].Summary.Content {
+		t.Errorf("unexpected entry after round trip: %+v", entry)
+	}
+	if len(entry.Links) != 2 || entry.Links[1].FacetGroup != "Sort" || entry.Links[1].Count != 3 || !entry.Links[1].IsActiveFacet() {
+		t.Errorf("unexpected links after round trip: %+v", entry.Links)
+	}
+}
+
+func TestFeedContentType(t *testing.T) {
+	feed := &Feed{Entries: []Entry{{Links: []Link{{Rel: AcquisitionFeedRel, Href: "/a.epub"}}}}}
+	if got := feed.ContentType(); got != AcquisitionFeedContentType {
+		t.Errorf("expected acquisition content type, got %q", got)
+	}
+	if got := (&Feed{}).ContentType(); got != NavigationFeedContentType {
+		t.Errorf("expected navigation content type, got %q", got)
+	}
+}
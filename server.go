@@ -1,22 +1,30 @@
 package main
 
 import (
-	"context"
 	"encoding/hex"
 	"fmt"
 	"log/slog"
 	"mime"
-	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
+	"github.com/evan-buss/opds-proxy/convert"
 	"github.com/evan-buss/opds-proxy/handlers"
+	"github.com/evan-buss/opds-proxy/internal/allowlist"
 	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/clientip"
 	"github.com/evan-buss/opds-proxy/internal/debounce"
+	"github.com/evan-buss/opds-proxy/internal/device"
+	"github.com/evan-buss/opds-proxy/internal/feedcache"
+	"github.com/evan-buss/opds-proxy/internal/filecache"
 	"github.com/evan-buss/opds-proxy/internal/formats"
+	"github.com/evan-buss/opds-proxy/internal/jobs"
+	"github.com/evan-buss/opds-proxy/internal/linktoken"
+	"github.com/evan-buss/opds-proxy/internal/pairing"
 	"github.com/evan-buss/opds-proxy/internal/reqctx"
+	"github.com/evan-buss/opds-proxy/opds"
 	"github.com/evan-buss/opds-proxy/view"
 	"github.com/google/uuid"
 	"github.com/gorilla/securecookie"
@@ -26,6 +34,7 @@ var (
 	_ = mime.AddExtensionType(formats.EPUB.Extension, formats.EPUB.MimeType)
 	_ = mime.AddExtensionType(formats.KEPUB.Extension, formats.KEPUB.MimeType)
 	_ = mime.AddExtensionType(formats.MOBI.Extension, formats.MOBI.MimeType)
+	_ = mime.AddExtensionType(formats.AZW3.Extension, formats.AZW3.MimeType)
 )
 
 type Server struct {
@@ -46,29 +55,119 @@ func NewServer(configData *ProxyConfig) (*Server, error) {
 
 	s := securecookie.New(hashKey, blockKey)
 
+	var fileCache, imageCache *filecache.Cache
+	var feedCache *feedcache.Cache
+	if !configData.Cache.Disabled {
+		fileCache, err = filecache.New(configData.Cache.Dir, configData.Cache.MaxSizeMB*1024*1024)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open conversion cache: %w", err)
+		}
+		imageCache, err = filecache.New(configData.Cache.ImageDir, configData.Cache.ImageMaxSizeMB*1024*1024)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open image cache: %w", err)
+		}
+		feedTTLs := make(map[string]time.Duration)
+		for _, f := range configData.Feeds {
+			if f.CacheTTL > 0 {
+				feedTTLs[f.Url] = f.CacheTTL
+			}
+		}
+		feedCache = feedcache.New(configData.Cache.FeedMaxSizeMB*1024*1024, configData.Cache.FeedTTL, feedTTLs)
+	}
+
 	// Kobo issues 2 requests for each clicked link. This middleware ensures
 	// we only process the first request and provide the same response for the second.
 	// This becomes more important when the requests aren't idempotent, such as triggering
 	// a download.
 	debounceMiddleware := debounce.NewDebounceMiddleware(time.Millisecond * 100)
 
+	converters := convert.NewConverterManager()
+	for _, c := range configData.Converters {
+		converters.RegisterConverter(toExecConverter(c), toDeviceTypes(c.Devices)...)
+	}
+
+	// Conversions run in the background one at a time. Finished jobs are kept
+	// for an hour so the progress page can still hand out the result.
+	jobManager := jobs.NewManager(1, time.Hour)
+
+	feedURLs := make([]string, len(configData.Feeds))
+	for i, f := range configData.Feeds {
+		feedURLs[i] = f.Url
+	}
+	upstreams, err := allowlist.New(feedURLs, configData.AllowedHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build upstream allowlist: %w", err)
+	}
+
+	// Links carry signed tokens instead of upstream URLs. Configured feed URLs
+	// are still accepted as is so existing bookmarks keep working.
+	linkStore, err := linktoken.New(hashKey, configData.LinksFile, linktoken.DefaultMaxLinks, feedURLs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open link store: %w", err)
+	}
+
+	adapted := make([]auth.FeedConfig, len(configData.Feeds))
+	for i, f := range configData.Feeds {
+		adapted[i] = auth.FeedConfig{Name: f.Name, Url: f.Url, Auth: toAuthPtr(f.Auth), UserAgent: f.UserAgent}
+	}
+
+	// Proxy accounts, when configured every page but the login page needs a session
+	accounts := make([]auth.User, len(configData.Users))
+	for i, u := range configData.Users {
+		accounts[i] = auth.User{Username: u.Username, PasswordHash: u.PasswordHash, Feeds: u.Feeds, Credentials: toCredentials(u.Credentials)}
+	}
+	users, err := auth.NewUsers(accounts, adapted, configData.ForwardAuth.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load users: %w", err)
+	}
+	session := sessionMiddleware(users, false)
+
+	// Forwarded client addresses and users are only believed when a trusted proxy added them
+	clientIPs, err := clientip.New(configData.TrustedProxies, configData.ClientIPHeader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure trusted proxies: %w", err)
+	}
+	requestMiddleware := newRequestMiddleware(clientIPs, users, s)
+
+	// Paired devices stay paired until revoked, so their credentials mustn't expire
+	devices, err := pairing.New(configData.DevicesFile, securecookie.New(hashKey, blockKey).MaxAge(0))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open devices file: %w", err)
+	}
+
 	router := http.NewServeMux()
 	// Home
 	links := make([]handlers.HomeLink, len(configData.Feeds))
 	for i, f := range configData.Feeds {
-		links[i] = handlers.HomeLink{Title: f.Name, URL: f.Url}
+		links[i] = handlers.HomeLink{Title: f.Name, URL: linkStore.Encode(f.Url)}
 	}
-	router.Handle("GET /{$}", requestMiddleware(handlers.Home(links)))
+	// Search descriptions rarely change, so they're fetched once an hour at most
+	searchDescriptions := opds.NewSearchDescriptions(time.Hour)
+	search := handlers.Search(adapted, s, configData.DebugMode, upstreams, linkStore, users, feedCache, searchDescriptions)
+	router.Handle("GET /{$}", requestMiddleware(session(debounceMiddleware(handlers.Home(links, users, search)))))
 
 	// Feed
-	adapted := make([]auth.FeedConfig, len(configData.Feeds))
-	for i, f := range configData.Feeds {
-		adapted[i] = auth.FeedConfig{Name: f.Name, Url: f.Url, Auth: toAuthPtr(f.Auth)}
-	}
-	router.Handle("GET /feed", requestMiddleware(debounceMiddleware(handlers.Feed("tmp/", adapted, s, configData.DebugMode))))
+	router.Handle("GET /feed", requestMiddleware(session(debounceMiddleware(handlers.Feed("tmp/", adapted, s, configData.DebugMode, converters, fileCache, jobManager, upstreams, linkStore, users, feedCache, searchDescriptions)))))
+
+	// OPDS catalog for reading apps, which log in with basic auth
+	router.Handle("GET /opds", requestMiddleware(sessionMiddleware(users, true)(handlers.Catalog("tmp/", adapted, s, configData.DebugMode, converters, fileCache, jobManager, upstreams, linkStore, users, feedCache, searchDescriptions))))
+
+	// Covers
+	router.Handle("GET /image", requestMiddleware(session(handlers.Image("tmp/", adapted, s, imageCache, upstreams, linkStore, users))))
+
+	// Conversion Jobs
+	router.Handle("GET /jobs/{id}", requestMiddleware(session(handlers.Job(jobManager))))
 
 	// Auth
-	router.Handle("/auth", requestMiddleware(handlers.Auth(s)))
+	router.Handle("/auth", requestMiddleware(session(handlers.Auth(s, linkStore, adapted))))
+	router.Handle("/login", requestMiddleware(handlers.Login(s, users)))
+	router.Handle("/logout", requestMiddleware(session(handlers.Logout(s, adapted))))
+
+	// Device pairing, e-readers aren't logged in yet when they redeem a code or token
+	router.Handle("/devices", requestMiddleware(session(handlers.Devices(s, devices))))
+	pair := handlers.Pair(s, devices, users)
+	router.Handle("/pair", requestMiddleware(debounceMiddleware(pair)))
+	router.Handle("GET /pair/{token}", requestMiddleware(debounceMiddleware(pair)))
 
 	// Static assets (serve embedded files from view package)
 	router.Handle("GET /static/", http.FileServer(http.FS(view.StaticFiles())))
@@ -80,51 +179,121 @@ func toAuthPtr(a *FeedConfigAuth) *auth.FeedAuth {
 	if a == nil {
 		return nil
 	}
-	return &auth.FeedAuth{Username: a.Username, Password: a.Password, LocalOnly: a.LocalOnly}
+	// Validated when the config is loaded
+	scheme, _ := auth.ParseScheme(a.Type)
+	return &auth.FeedAuth{Scheme: scheme, Name: a.Name, Username: a.Username, Password: a.Password, Token: a.Token, LocalOnly: a.LocalOnly}
 }
 
-func requestMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		id := uuid.New()
-		requestIP := r.Header.Get("X-Forwarded-For")
-		if requestIP == "" {
-			requestIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+func toCredentials(creds []UserCredentialsConfig) map[string]auth.Credentials {
+	out := make(map[string]auth.Credentials, len(creds))
+	for _, c := range creds {
+		out[c.Feed] = auth.Credentials{Username: c.Username, Password: c.Password, Token: c.Token}
+	}
+	return out
+}
+
+func toExecConverter(c ConverterConfig) *convert.ExecConverter {
+	input, _ := formats.FormatByLabel(c.Input)
+	output, _ := formats.FormatByLabel(c.Output)
+	return &convert.ExecConverter{
+		Name:    c.Name,
+		Command: c.Command,
+		Input:   input,
+		Output:  output,
+		Timeout: c.Timeout,
+	}
+}
+
+func toDeviceTypes(names []string) []device.DeviceType {
+	devices := make([]device.DeviceType, 0, len(names))
+	for _, name := range names {
+		if d, ok := device.ParseDeviceType(name); ok {
+			devices = append(devices, d)
 		}
+	}
+	return devices
+}
+
+// newRequestMiddleware returns middleware that sets up the request context
+// with a logger, the client address resolved by clientIPs and the user
+// making the request, if any.
+func newRequestMiddleware(clientIPs *clientip.Resolver, users *auth.Users, s *securecookie.SecureCookie) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			id := uuid.New()
+			clientIP := clientIPs.ClientIP(r)
+			isLocal := clientIP.IsValid() && (clientIP.IsPrivate() || clientIP.IsLoopback())
+			username := users.Identify(r, s, clientIPs.IsTrustedProxy(r))
+
+			query, _ := url.QueryUnescape(r.URL.RawQuery)
+			log := slog.With(
+				slog.Group("request",
+					slog.String("id", id.String()),
+					slog.String("ip", clientIP.String()),
+					slog.String("user", username),
+					slog.String("method", r.Method),
+					slog.String("path", logPath(r)),
+					slog.String("query", query),
+					slog.String("user-agent", r.UserAgent()),
+				),
+			)
+
+			ctx := reqctx.WithIsLocal(r.Context(), isLocal)
+			ctx = reqctx.WithClientIP(ctx, clientIP)
+			ctx = reqctx.WithUser(ctx, username)
+			ctx = reqctx.WithRequestLogger(ctx, log)
+			r = r.WithContext(ctx)
+
+			next.ServeHTTP(w, r)
+
+			log.Debug("Request Completed",
+				slog.String("duration", time.Since(start).String()),
+				slog.Bool("debounce", w.Header().Get("X-Debounce") == "true"),
+				slog.Bool("shared", w.Header().Get("X-Shared") == "true"),
+			)
+		})
+	}
+}
 
-		isLocal := true
-		for addr := range strings.SplitSeq(requestIP, ", ") {
-			ip := net.ParseIP(addr)
-			if ip == nil || (!ip.IsPrivate() && !ip.IsLoopback()) {
-				isLocal = false
-				break
+// logPath returns the request path for logging. Pairing tokens in the path
+// restore a device's session and feed logins, so they're left out.
+func logPath(r *http.Request) string {
+	if token := r.PathValue("token"); token != "" {
+		return strings.Replace(r.URL.Path, token, "{token}", 1)
+	}
+	return r.URL.Path
+}
+
+// sessionMiddleware requires a user identified by the request middleware
+// when accounts or forward auth are configured. Browsers are sent to the
+// login page. Catalog clients can't show it, so with basicAuth set they are
+// asked for basic auth instead.
+func sessionMiddleware(users *auth.Users, basicAuth bool) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !users.LoginRequired() {
+				next(w, r)
+				return
 			}
-		}
 
-		query, _ := url.QueryUnescape(r.URL.RawQuery)
-		log := slog.With(
-			slog.Group("request",
-				slog.String("id", id.String()),
-				slog.String("ip", requestIP),
-				slog.String("method", r.Method),
-				slog.String("path", r.URL.Path),
-				slog.String("query", query),
-				slog.String("user-agent", r.UserAgent()),
-			),
-		)
-
-		ctx := reqctx.WithIsLocal(context.Background(), isLocal)
-		ctx = reqctx.WithRequestLogger(ctx, log)
-		r = r.WithContext(ctx)
-
-		next.ServeHTTP(w, r)
-
-		log.Debug("Request Completed",
-			slog.String("duration", time.Since(start).String()),
-			slog.Bool("debounce", w.Header().Get("X-Debounce") == "true"),
-			slog.Bool("shared", w.Header().Get("X-Shared") == "true"),
-		)
-	})
+			username := reqctx.User(r.Context())
+			switch {
+			case username != "" && !users.Known(username):
+				http.Error(w, fmt.Sprintf("User %q has no access to this server", username), http.StatusForbidden)
+			case username != "":
+				next(w, r)
+			case basicAuth && users.Enabled():
+				w.Header().Set("WWW-Authenticate", `Basic realm="opds-proxy"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			case !users.Enabled():
+				// Without accounts the only way in is through the gateway
+				http.Error(w, "Unauthorized, log in through your authentication gateway", http.StatusUnauthorized)
+			default:
+				http.Redirect(w, r, "/login?return="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			}
+		}
+	}
 }
 
 func (s *Server) Serve() error {
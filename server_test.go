@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/evan-buss/opds-proxy/internal/auth"
+	"github.com/evan-buss/opds-proxy/internal/clientip"
+	"github.com/evan-buss/opds-proxy/internal/httpx"
+	"github.com/gorilla/securecookie"
+)
+
+func TestRequestMiddlewareCancelsUpstreamFetches(t *testing.T) {
+	aborted := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+
+	clientIPs, err := clientip.New(nil, "")
+	if err != nil {
+		t.Fatalf("clientip.New error: %v", err)
+	}
+	users, err := auth.NewUsers(nil, nil, "")
+	if err != nil {
+		t.Fatalf("NewUsers error: %v", err)
+	}
+	s := securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	proxy := httptest.NewServer(newRequestMiddleware(clientIPs, users, s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := httpx.FetchContext(r.Context(), http.DefaultClient, upstream.URL, 10, nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+	})))
+	defer proxy.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, proxy.URL, nil)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the upstream fetch to be aborted when the client went away")
+	}
+}
+
+func TestLogPathRedactsPairingTokens(t *testing.T) {
+	var got string
+	router := http.NewServeMux()
+	router.HandleFunc("GET /pair/{token}", func(w http.ResponseWriter, r *http.Request) { got = logPath(r) })
+	router.HandleFunc("GET /jobs/{id}", func(w http.ResponseWriter, r *http.Request) { got = logPath(r) })
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/pair/s3cr3t-token", nil))
+	if got != "/pair/{token}" {
+		t.Errorf("logged path %q, want the token left out", got)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/jobs/42", nil))
+	if got != "/jobs/42" {
+		t.Errorf("logged path %q, want /jobs/42", got)
+	}
+}
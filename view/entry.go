@@ -8,6 +8,7 @@ import (
 	"strings"
 	"unicode/utf8"
 
+	"github.com/evan-buss/opds-proxy/convert"
 	"github.com/evan-buss/opds-proxy/internal/formats"
 )
 
@@ -57,6 +58,7 @@ type EntryViewModel struct {
 	ImageURL        string
 	ImageData       template.URL
 	Search          string
+	SearchFields    SearchFieldsViewModel
 	Navigation      []NavigationViewModel
 }
 
@@ -66,11 +68,21 @@ type EntryLinkViewModel struct {
 	Href     string
 	TypeLink string
 	Subtext  string
+	Formats  []FormatOptionViewModel
 }
 
+// FormatOptionViewModel lets the reader pick the format of a download.
+type FormatOptionViewModel struct {
+	Label string
+	As    string
+}
+
+// AsOriginal is the "as" query value that skips conversion entirely.
+const AsOriginal = "original"
+
 func constructEntryVM(params EntryParams) (EntryViewModel, error) {
 	// Extract navigation data using shared function from feed.go
-	navData, err := extractNavigationData(params.Feed, params.URL)
+	navData, err := extractNavigationData(params.Feed, params.URL, params.Links)
 	if err != nil {
 		return EntryViewModel{}, fmt.Errorf("failed to extract navigation data: %w", err)
 	}
@@ -83,8 +95,9 @@ func constructEntryVM(params EntryParams) (EntryViewModel, error) {
 		Content:         template.HTML(truncateSummary(params.Entry.SummaryText(), maxSummaryLength)),
 		Author:          strings.Join(params.Entry.AuthorNames(), " & "),
 		Search:          navData.Search,
+		SearchFields:    searchFields(params.SearchTemplate),
 		Navigation:      navData.Navigation,
-		// ImageURL: resolveHref(params.URL, params.Entry.Image()),
+		// ImageURL: proxyHref(params.Links, params.URL, params.Entry.Image()),
 	}
 
 	imageLink := params.Entry.Image()
@@ -92,7 +105,7 @@ func constructEntryVM(params EntryParams) (EntryViewModel, error) {
 		if imageLink.IsDataImage() {
 			vm.ImageData = template.URL(imageLink.Href)
 		} else {
-			imageURL, err := resolveHref(params.URL, imageLink.Href)
+			imageURL, err := proxyHref(params.Links, params.URL, imageLink.Href)
 			if err != nil {
 				return EntryViewModel{}, fmt.Errorf("failed to resolve image link: %w", err)
 			}
@@ -103,7 +116,7 @@ func constructEntryVM(params EntryParams) (EntryViewModel, error) {
 	links := params.Entry.GetLinks()
 
 	for _, link := range links.Navigation() {
-		href, err := resolveHref(params.URL, link.Href)
+		href, err := proxyHref(params.Links, params.URL, link.Href)
 		if err != nil {
 			return EntryViewModel{}, fmt.Errorf("failed to resolve navigation link: %w", err)
 		}
@@ -129,7 +142,7 @@ func constructEntryVM(params EntryParams) (EntryViewModel, error) {
 
 		format, exists := formats.FormatByMimeType(link.TypeLink)
 		if !exists {
-			href, err := resolveHref(params.URL, link.Href)
+			href, err := proxyHref(params.Links, params.URL, link.Href)
 			if err != nil {
 				return EntryViewModel{}, fmt.Errorf("failed to resolve download link: %w", err)
 			}
@@ -140,14 +153,14 @@ func constructEntryVM(params EntryParams) (EntryViewModel, error) {
 			})
 			continue
 		}
-		converter := params.ConverterManager.GetConverterForDevice(params.DeviceType, format)
+		chain := params.ConverterManager.GetChainForDevice(params.DeviceType, format)
 		subtext := ""
-		if converter != nil {
-			// If the converter handles this format, we can add a note
-			subtext += "Automatically converted to " + params.DeviceType.GetPreferredFormat().Label + ". "
+		if chain != nil {
+			// If the file will be converted, show how it gets to the device's format
+			subtext += "Automatically converted to " + chain.Output().Label + " (" + chain.String() + "). "
 		}
 
-		href, err := resolveHref(params.URL, link.Href)
+		href, err := proxyHref(params.Links, params.URL, link.Href)
 		if err != nil {
 			return EntryViewModel{}, fmt.Errorf("failed to resolve download link: %w", err)
 		}
@@ -156,8 +169,27 @@ func constructEntryVM(params EntryParams) (EntryViewModel, error) {
 			Href:     href,
 			TypeLink: link.TypeLink,
 			Subtext:  subtext,
+			Formats:  formatOptions(params, format, chain),
 		})
 	}
 
 	return vm, nil
 }
+
+// formatOptions lists the explicit formats a download can be requested in.
+// The original file is always offered when the default download converts it.
+func formatOptions(params EntryParams, input formats.Format, chain *convert.Chain) []FormatOptionViewModel {
+	var options []FormatOptionViewModel
+	if chain != nil {
+		options = append(options, FormatOptionViewModel{Label: "Original " + input.Label, As: AsOriginal})
+	}
+
+	for _, target := range params.ConverterManager.Targets(params.DeviceType, input) {
+		if chain != nil && target == chain.Output() {
+			continue
+		}
+		options = append(options, FormatOptionViewModel{Label: target.Label, As: strings.ToLower(target.Label)})
+	}
+
+	return options
+}
@@ -10,10 +10,55 @@ import (
 )
 
 type FeedViewModel struct {
-	Title      string
-	Search     string
-	Navigation []NavigationViewModel
-	Links      []LinkViewModel
+	Title        string
+	Search       string
+	SearchFields SearchFieldsViewModel
+	Navigation   []NavigationViewModel
+	Pagination   *PaginationViewModel
+	Facets       []FacetGroupViewModel
+	Links        []LinkViewModel
+}
+
+// FacetGroupViewModel is a group of facets such as "Sort" or "Language".
+type FacetGroupViewModel struct {
+	Title  string
+	Facets []FacetViewModel
+}
+
+// FacetViewModel is a single selectable facet.
+type FacetViewModel struct {
+	Title  string
+	Href   string
+	Count  int
+	Active bool
+}
+
+// PaginationViewModel holds the paging controls of a paged feed.
+// Page and Pages are 0 when the feed doesn't report its position.
+type PaginationViewModel struct {
+	First    string
+	Previous string
+	Next     string
+	Last     string
+	Page     int
+	Pages    int
+}
+
+// SearchFieldsViewModel holds the fields besides the search terms a feed
+// can be searched by, shown as an advanced search form.
+type SearchFieldsViewModel struct {
+	Title  bool
+	Author bool
+}
+
+func searchFields(tmpl *opds.SearchTemplate) SearchFieldsViewModel {
+	if tmpl == nil {
+		return SearchFieldsViewModel{}
+	}
+	return SearchFieldsViewModel{
+		Title:  tmpl.Has(opds.SearchTitle),
+		Author: tmpl.Has(opds.SearchAuthor),
+	}
 }
 
 // NavigationData contains the common navigation and search data
@@ -23,20 +68,17 @@ type NavigationData struct {
 }
 
 // extractNavigationData extracts navigation and search links from a feed
-func extractNavigationData(feed *opds.Feed, baseURL string) (NavigationData, error) {
+func extractNavigationData(feed *opds.Feed, baseURL string, links LinkEncoder) (NavigationData, error) {
 	nav := NavigationData{
 		Search:     "",
 		Navigation: make([]NavigationViewModel, 0),
 	}
 
-	links := feed.GetLinks()
+	feedLinks := feed.GetLinks()
 
 	// Find search link
-	searchLinks := links.Where(func(link opds.Link) bool {
-		return link.Rel == "search"
-	})
-	if searchLink := searchLinks.First(); searchLink != nil {
-		search, err := resolveHref(baseURL, searchLink.Href)
+	if searchLink := feedLinks.Search(); searchLink != nil {
+		search, err := proxyHref(links, baseURL, searchLink.Href)
 		if err != nil {
 			return NavigationData{}, fmt.Errorf("failed to resolve search link: %w", err)
 		}
@@ -44,13 +86,14 @@ func extractNavigationData(feed *opds.Feed, baseURL string) (NavigationData, err
 	}
 
 	// Extract navigation links
-	for _, link := range links.Navigation() {
+	for _, link := range feedLinks.Navigation() {
 		if link.Rel == "self" || // self link
+			link.IsPagination() || // rendered as paging controls
 			strings.Contains(link.Rel, "http") { // opds sort links
 			continue // skip to save screen space
 		}
 
-		href, err := resolveHref(baseURL, link.Href)
+		href, err := proxyHref(links, baseURL, link.Href)
 		if err != nil {
 			return NavigationData{}, fmt.Errorf("failed to resolve navigation link: %w", err)
 		}
@@ -63,6 +106,72 @@ func extractNavigationData(feed *opds.Feed, baseURL string) (NavigationData, err
 	return nav, nil
 }
 
+// extractPagination returns the paging controls of the feed, or nil if it isn't paged.
+// Paging links are picked by rel alone since their types vary between servers.
+func extractPagination(feed *opds.Feed, baseURL string, links LinkEncoder) (*PaginationViewModel, error) {
+	feedLinks := feed.GetLinks()
+	vm := &PaginationViewModel{}
+	page, pages := feed.Pages()
+
+	for rel, href := range map[string]*string{
+		"first":    &vm.First,
+		"previous": &vm.Previous,
+		"next":     &vm.Next,
+		"last":     &vm.Last,
+	} {
+		link := feedLinks.Pagination(rel)
+		if link == nil {
+			continue
+		}
+		resolved, err := proxyHref(links, baseURL, link.Href)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s link: %w", rel, err)
+		}
+		*href = resolved
+	}
+
+	if vm.Previous == "" && vm.Next == "" && vm.First == "" && vm.Last == "" {
+		return nil, nil
+	}
+
+	// Only show a position the feed agrees with
+	if pages > 0 && page <= pages {
+		vm.Page, vm.Pages = page, pages
+	} else if pages == 0 {
+		vm.Page = page
+	}
+	return vm, nil
+}
+
+// extractFacets groups the feed's facet links by their facet group,
+// keeping the order in which the groups first appear.
+func extractFacets(feed *opds.Feed, baseURL string, links LinkEncoder) ([]FacetGroupViewModel, error) {
+	var groups []FacetGroupViewModel
+	index := make(map[string]int)
+
+	for _, link := range feed.GetLinks().Facets() {
+		href, err := proxyHref(links, baseURL, link.Href)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve facet link: %w", err)
+		}
+
+		i, exists := index[link.FacetGroup]
+		if !exists {
+			i = len(groups)
+			index[link.FacetGroup] = i
+			groups = append(groups, FacetGroupViewModel{Title: link.FacetGroup})
+		}
+		groups[i].Facets = append(groups[i].Facets, FacetViewModel{
+			Title:  link.Title,
+			Href:   href,
+			Count:  link.Count,
+			Active: link.IsActiveFacet(),
+		})
+	}
+
+	return groups, nil
+}
+
 type NavigationViewModel struct {
 	Href  string
 	Label string
@@ -80,20 +189,33 @@ type LinkViewModel struct {
 
 func convertFeed(p *FeedParams) (FeedViewModel, error) {
 	// Extract navigation data using shared function
-	navData, err := extractNavigationData(p.Feed, p.URL)
+	navData, err := extractNavigationData(p.Feed, p.URL, p.Links)
 	if err != nil {
 		return FeedViewModel{}, fmt.Errorf("failed to extract navigation data: %w", err)
 	}
 
 	vm := FeedViewModel{
-		Title:      p.Feed.Title,
-		Search:     navData.Search,
-		Navigation: navData.Navigation,
-		Links:      make([]LinkViewModel, 0),
+		Title:        p.Feed.Title,
+		Search:       navData.Search,
+		SearchFields: searchFields(p.SearchTemplate),
+		Navigation:   navData.Navigation,
+		Links:        make([]LinkViewModel, 0),
+	}
+
+	pagination, err := extractPagination(p.Feed, p.URL, p.Links)
+	if err != nil {
+		return FeedViewModel{}, fmt.Errorf("failed to extract pagination: %w", err)
 	}
+	vm.Pagination = pagination
+
+	facets, err := extractFacets(p.Feed, p.URL, p.Links)
+	if err != nil {
+		return FeedViewModel{}, fmt.Errorf("failed to extract facets: %w", err)
+	}
+	vm.Facets = facets
 
 	for _, entry := range p.Feed.Entries {
-		link, err := constructLink(p.URL, entry)
+		link, err := constructLink(p.URL, entry, p.Links)
 		if err != nil {
 			return FeedViewModel{}, fmt.Errorf("failed to construct link for entry %s: %w", entry.ID, err)
 		}
@@ -103,7 +225,7 @@ func convertFeed(p *FeedParams) (FeedViewModel, error) {
 	return vm, nil
 }
 
-func constructLink(baseUrl string, entry opds.Entry) (LinkViewModel, error) {
+func constructLink(baseUrl string, entry opds.Entry, links LinkEncoder) (LinkViewModel, error) {
 	vm := LinkViewModel{
 		Title:   entry.Title,
 		Content: entry.Content.Content,
@@ -120,15 +242,15 @@ func constructLink(baseUrl string, entry opds.Entry) (LinkViewModel, error) {
 
 	// If there is 1 link and it's a navigation link, don't link to the entry details page
 	if len(navLinks) == 1 {
-		href, err := resolveHref(baseUrl, navLinks[0].Href)
+		href, err := proxyHref(links, baseUrl, navLinks[0].Href)
 		if err != nil {
 			return LinkViewModel{}, fmt.Errorf("failed to resolve navigation link: %w", err)
 		}
-		vm.Href = url.QueryEscape(href)
+		vm.Href = href
 		vm.EntryID = ""
 	} else {
 		// Otherwise, link to the entry details page
-		vm.Href = url.QueryEscape(baseUrl)
+		vm.Href = links.Encode(baseUrl)
 		vm.EntryID = entry.ID
 	}
 
@@ -137,7 +259,7 @@ func constructLink(baseUrl string, entry opds.Entry) (LinkViewModel, error) {
 		if imageLink.IsDataImage() {
 			vm.ImageData = template.URL(imageLink.Href)
 		} else {
-			imageURL, err := resolveHref(baseUrl, imageLink.Href)
+			imageURL, err := proxyHref(links, baseUrl, imageLink.Href)
 			if err != nil {
 				return LinkViewModel{}, fmt.Errorf("failed to resolve image link: %w", err)
 			}
@@ -148,7 +270,13 @@ func constructLink(baseUrl string, entry opds.Entry) (LinkViewModel, error) {
 	return vm, nil
 }
 
-func resolveHref(feedUrl string, relativePath string) (string, error) {
+// LinkEncoder turns upstream URLs into the opaque values used in proxy links.
+type LinkEncoder interface {
+	Encode(upstreamURL string) string
+}
+
+// proxyHref resolves relativePath against the feed URL and encodes it for use in a proxy link.
+func proxyHref(links LinkEncoder, feedUrl string, relativePath string) (string, error) {
 	baseUrl, err := url.Parse(feedUrl)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse feed URL %q: %w", feedUrl, err)
@@ -158,5 +286,5 @@ func resolveHref(feedUrl string, relativePath string) (string, error) {
 		return "", fmt.Errorf("failed to parse relative path %q: %w", relativePath, err)
 	}
 
-	return baseUrl.ResolveReference(relativeUrl).String(), nil
+	return links.Encode(baseUrl.ResolveReference(relativeUrl).String()), nil
 }
@@ -17,10 +17,15 @@ import (
 var files embed.FS
 
 var (
-	home  = parse("home.html")
-	login = parse("login.html")
-	feed  = parse("feed.html", "partials/search.html")
-	entry = parse("entry.html", "partials/search.html")
+	home    = parse("home.html", "partials/global-search.html")
+	search  = parse("search.html", "partials/global-search.html")
+	login   = parse("login.html")
+	feed    = parse("feed.html", "partials/search.html", "partials/pagination.html")
+	entry   = parse("entry.html", "partials/search.html")
+	job     = parse("job.html")
+	logout  = parse("logout.html")
+	devices = parse("devices.html")
+	pair    = parse("pair.html")
 )
 
 func parse(file ...string) *template.Template {
@@ -66,15 +71,69 @@ func Home(w io.Writer, vm []HomeParams) error {
 
 type LoginParams struct {
 	ReturnURL string
+	Host      string
+	Prompt    string
+	Error     string
 }
 
 func Login(w io.Writer, p LoginParams) error {
 	return login.Execute(w, p)
 }
 
+type LogoutLogin struct {
+	Origin   string
+	Name     string
+	Username string
+}
+
+type LogoutParams struct {
+	Logins []LogoutLogin
+	// Proxy user, if logged in
+	User string
+	// Whether the proxy session can be ended here, which isn't the case with forward auth
+	CanEndSession bool
+}
+
+func Logout(w io.Writer, p LogoutParams) error {
+	return logout.Execute(w, p)
+}
+
+type DeviceViewModel struct {
+	ID      string
+	Name    string
+	Created string
+}
+
+type DevicesParams struct {
+	Devices []DeviceViewModel
+	// Set right after pairing a device
+	Name        string
+	Code        string
+	CodeMinutes int
+	PairPage    string
+	PairURL     string
+}
+
+func Devices(w io.Writer, p DevicesParams) error {
+	return devices.Execute(w, p)
+}
+
+type PairParams struct {
+	Paired bool
+	Name   string
+	Error  string
+}
+
+func Pair(w io.Writer, p PairParams) error {
+	return pair.Execute(w, p)
+}
+
 type FeedParams struct {
-	URL  string
-	Feed *opds.Feed
+	URL   string
+	Feed  *opds.Feed
+	Links LinkEncoder
+	// Template of the feed's search link, if it could be resolved
+	SearchTemplate *opds.SearchTemplate
 }
 
 func Feed(w io.Writer, p FeedParams) error {
@@ -91,6 +150,8 @@ type EntryParams struct {
 	Entry            opds.Entry
 	DeviceType       device.DeviceType
 	ConverterManager *convert.ConverterManager
+	Links            LinkEncoder
+	SearchTemplate   *opds.SearchTemplate
 }
 
 func Entry(w io.Writer, p EntryParams) error {
@@ -101,6 +162,41 @@ func Entry(w io.Writer, p EntryParams) error {
 	return entry.Execute(w, vm)
 }
 
+// SearchResult is one feed's answer to a search across all feeds.
+type SearchResult struct {
+	Title string
+	// Results page, or the feed itself when it couldn't be searched
+	URL   string
+	Feed  *opds.Feed
+	Error string
+}
+
+type SearchParams struct {
+	Search  string
+	Results []SearchResult
+	Links   LinkEncoder
+}
+
+func Search(w io.Writer, p SearchParams) error {
+	vm, err := convertSearch(&p)
+	if err != nil {
+		return err
+	}
+	return search.Execute(w, vm)
+}
+
+type JobParams struct {
+	Name     string
+	Status   string
+	Error    string
+	Elapsed  string
+	Finished bool
+}
+
+func Job(w io.Writer, p JobParams) error {
+	return job.Execute(w, p)
+}
+
 func StaticFiles() embed.FS {
 	return files
 }
@@ -0,0 +1,40 @@
+package view
+
+import "fmt"
+
+type SearchViewModel struct {
+	Search string
+	Groups []SearchGroupViewModel
+}
+
+// SearchGroupViewModel holds the results from one feed.
+type SearchGroupViewModel struct {
+	Title string
+	Href  string
+	Error string
+	Links []LinkViewModel
+}
+
+func convertSearch(p *SearchParams) (SearchViewModel, error) {
+	vm := SearchViewModel{Search: p.Search}
+
+	for _, result := range p.Results {
+		group := SearchGroupViewModel{
+			Title: result.Title,
+			Href:  p.Links.Encode(result.URL),
+			Error: result.Error,
+		}
+		if result.Feed != nil {
+			for _, entry := range result.Feed.Entries {
+				link, err := constructLink(result.URL, entry, p.Links)
+				if err != nil {
+					return SearchViewModel{}, fmt.Errorf("failed to construct link for entry %s: %w", entry.ID, err)
+				}
+				group.Links = append(group.Links, link)
+			}
+		}
+		vm.Groups = append(vm.Groups, group)
+	}
+
+	return vm, nil
+}